@@ -3,18 +3,40 @@ package main
 import (
 	"bytes"
 	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"image"
 	"image/color"
-	_ "image/png"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
 	"io"
 	"log"
 	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/audio"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+	"github.com/hajimehoshi/ebiten/v2/vector"
+	"github.com/olivierh59500/ym-player/pkg/lzh"
 	"github.com/olivierh59500/ym-player/pkg/stsound"
 )
 
@@ -22,8 +44,430 @@ const (
 	screenWidth  = 640
 	screenHeight = 400
 	sampleRate   = 44100
+
+	// defaultVolumeRamp is how long a volume change takes to be fully applied
+	defaultVolumeRamp = 10 * time.Millisecond
+
+	// maxFrameDelta caps the clock time one Update accounts for, so a stall
+	// or a long pause does not make the effects jump
+	maxFrameDelta = 250 * time.Millisecond
+
+	// Sprite cell size in the sprite strip and scale bounds. The sprite
+	// trajectory was laid out for defaultSpriteScale
+	spriteWidth        = 16
+	spriteHeight       = 10
+	defaultSpriteScale = 2
+	spriteScaleStep    = 0.5
+	minSpriteScale     = 0.5
+	maxSpriteScale     = 6
+
+	// orbitPeriod is the number of frames after which the sprite trajectory
+	// repeats: swing and swingy complete 2 and 3 turns respectively
+	orbitPeriod = 200 * math.Pi
+
+	// noticeFrames is how long a notice such as the track name stays on
+	// screen
+	noticeFrames = 180
+
+	// titleFade is how long the startup title card takes to fade out, at
+	// the end of its display time
+	titleFade = time.Second
+
+	// recordEvery is the number of drawn frames per recorded GIF frame, and
+	// recordDelay the matching GIF frame delay in 1/100s at 60 FPS
+	recordEvery = 3
+	recordDelay = 5
+
+	// scrollRestartGap is how far outside the viewport a scroll text is
+	// parked when it wraps around, so it re-enters from off screen
+	scrollRestartGap = 100
+
+	// The big scroll is drawn at font size and magnified this much on screen
+	bigScrollZoomX = 8
+	bigScrollZoomY = 6
+
+	// Accepted range for the audio output buffer
+	minAudioBuffer = 10 * time.Millisecond
+	maxAudioBuffer = time.Second
+
+	// Confetti particle settings, in pixels and seconds
+	maxConfetti     = 400
+	confettiRate    = 120 // Particles spawned per second
+	confettiGravity = 120
+	confettiWind    = 30
+	confettiSize    = 3
+
+	// VU meter bar size and gap in pixels, the level above which a bar
+	// turns red, and how long a bar takes to fall back after a peak
+	vuBarWidth  = 6
+	vuBarHeight = 48
+	vuBarGap    = 2
+	vuHot       = 0.9
+	vuRelease   = 300 * time.Millisecond
+
+	// Channel scope size in pixels: each channel gets a voiceWidth x
+	// voiceHeight band. A tone of period P draws voicePitchScale/P cycles
+	// across the band, capped at voiceMaxCycles.
+	voiceWidth      = 96
+	voiceHeight     = 16
+	voicePitchScale = 4096
+	voiceMaxCycles  = 24
+
+	// wavePhaseStep is how far the big scroll wave travels per update, in
+	// radians, and maxWaveAmplitude the largest wave fitting its canvas
+	wavePhaseStep    = 0.1
+	maxWaveAmplitude = 3
+
+	// statsRefreshFrames is how often, in updates, the FPS / TPS readout
+	// is reformatted
+	statsRefreshFrames = 30
+
+	// Metronome indicator size in pixels and how long it stays lit per beat
+	metronomeSize        = 8
+	metronomeFlashFrames = 15
+
+	// Film grain texture size in pixels, drawn doubled, and its opacity
+	grainSize  = 128
+	grainAlpha = 0.08
+
+	// prerenderTileWidth is the width of each texture a pre-rendered scroll
+	// is split into, kept well below common maximum texture sizes
+	prerenderTileWidth = 4096
+
+	// bigRasterWidth is the width of a generated big scroll raster, which
+	// is stretched 4x across the screen
+	bigRasterWidth = screenWidth / 4
+
+	// Gamma adjustment step and bounds
+	gammaStep = 0.1
+	minGamma  = 0.2
+	maxGamma  = 4
+
+	// Master volume step of the - and = keys and the volume at startup
+	volumeStep    = 0.05
+	defaultVolume = 0.7
+
+	// fadeOutGrace is how much longer than requested the exit waits for the
+	// music fade-out, covering the audio buffer still queued
+	fadeOutGrace = 500 * time.Millisecond
+
+	// pauseBlinkFrames is how long the PAUSED label stays on, then off
+	pauseBlinkFrames = 30
+
+	// pulseDepth is how much the sprites grow per unit of music level
+	pulseDepth = 2
+
+	// sectionScaleEase is the fraction of the way the big scroll scale moves
+	// towards a new section's scale each frame
+	sectionScaleEase = 0.1
+
+	// spriteTintSpread is the fraction of the color wheel between
+	// neighbouring sprites when palette cycling is on
+	spriteTintSpread = 1.0 / 12
+)
+
+// Config holds the startup options of the demo
+type Config struct {
+	LowRes      bool            // Render the scene at half resolution and upscale it
+	Crop        image.Rectangle // Scene region shown in the window; empty shows it all
+	SpriteScale float64         // Display scale of the orbiting sprites
+
+	BackgroundFadeFrames int // Duration of the background scheme crossfade
+
+	ClearColor color.RGBA // Color behind the backgrounds
+
+	PathSamples int // Points sampled along the sprite path preview
+
+	CameraSegmentFrames int // Frames the camera takes between waypoints
+
+	// Memory caps for GIF recording; recording stops at whichever is hit first
+	RecordMaxFrames int
+	RecordMaxBytes  int
+
+	KeyMap map[string]string // Action name to Ebiten key name overrides
+
+	PrerenderBigScroll bool // Render the big scroll text once into wide textures
+
+	// Sprite pixels of SpriteColorKey become transparent when SpriteKeyed is
+	// set, for sprite art drawn on a solid background
+	SpriteKeyed    bool
+	SpriteColorKey color.RGBA
+
+	// AudioBuffer is the audio output buffer size; zero keeps Ebiten's
+	// default. Larger buffers survive hiccups on busy or high-latency
+	// systems at the cost of more delay between visuals and sound.
+	AudioBuffer time.Duration
+
+	ExitFadeFrames int // Duration of the fade to black on quit; 0 quits at once
+
+	Grain bool // Start with the film grain overlay shown
+
+	VUMeter bool // Start with the VU meter shown
+	Voices  bool // Start with the AY channel scope shown
+
+	Metronome bool // Start with the beat indicator shown
+
+	Tracking int // Extra pixels between the big scroll characters; may be negative
+
+	EdgeFade int // Width in pixels over which the big scroll fades at the screen edges
+
+	// Sine wobble of the big scroll characters, in font pixels and radians
+	// between neighbours; zero amplitude keeps the scroll flat
+	WaveAmplitude float64
+	WaveFrequency float64
+
+	// Proportional trims the big and small font glyphs to their detected
+	// widths instead of the fixed cell width
+	Proportional bool
+
+	SongInfo bool // Show the playing song's title and author
+
+	TitleCard time.Duration // How long the startup title card shows; 0 hides it
+
+	// Seed drives every randomized effect so runs can be reproduced; zero
+	// picks a new seed each run
+	Seed int64
+
+	MusicFadeIn  time.Duration // Fade-in of the music at startup; 0 starts at full volume
+	MusicFadeOut time.Duration // Fade-out of the music on exit; 0 cuts it
+
+	// TickSync advances the background and sprite animation on the tune's
+	// replay ticks rather than on video frames
+	TickSync bool
+
+	PauseUnfocused bool // Pause the music while the window is not focused
+
+	SpriteTint bool // Cycle the sprites through the color wheel
+
+	// ScrollTint cycles the small scrolls through the color wheel at
+	// ScrollTintSpeed full turns per second
+	ScrollTint      bool
+	ScrollTintSpeed float64
+
+	ScrollEaseFrames int // Frames the big scroll takes to reach full speed
+
+	LogScroll bool // Print each big scroll word to stdout as it appears
+
+	// When RasterBands is set, the big scroll raster is generated with that
+	// many color bands of RasterBandHeight pixels instead of loaded, either
+	// as hard stripes or, with RasterSmooth, as a continuous gradient
+	RasterBands      int
+	RasterBandHeight int
+	RasterSmooth     bool
+
+	Gamma float64 // Gamma correction of the final image; above 1 brightens
+
+	StartMs int64 // Position in the first tune to start playing from
+
+	// Background motion per animation step, in pixels. Each background
+	// ping-pongs at these speeds across its range.
+	Bg1SpeedX, Bg1SpeedY float64
+	Bg2SpeedX, Bg2SpeedY float64
+
+	InvertBackgrounds bool // Start with the background motion reversed
+
+	// SectionScale resizes the big scroll for sections of its text marked
+	// with "{scale}", such as the smaller aside in the opening sentence
+	SectionScale bool
+
+	// Pulse makes the sprites swell with the music level, smoothed by an
+	// envelope with the given attack and release times
+	Pulse        bool
+	PulseAttack  time.Duration
+	PulseRelease time.Duration
+
+	LoopCount int // Times a tune restarts before stopping; negative loops forever
+
+	MusicEnd string // What happens once the tune stops: musicEndStop or musicEndQuit
+
+	TrackCrossfade time.Duration // Crossfade between jukebox tracks; 0 cuts
+
+	// RasterClamp stretches and shifts the rasters as needed so they always
+	// cover the whole text canvas
+	RasterClamp bool
+
+	// SwingAmplitude bounds the slowly ping-ponging vertical swing of the
+	// sprite orbit, in pixels
+	SwingAmplitude float64
+
+	// Screen rows of the two small scrolls; their raster follows them
+	SmallScroll1Y float64
+	SmallScroll2Y float64
+}
+
+// Config.MusicEnd behaviors
+const (
+	musicEndStop = "stop" // Release the audio players, the demo keeps running
+	musicEndQuit = "quit" // Fade to black and quit
 )
 
+// DefaultConfig returns the configuration matching the original demo
+func DefaultConfig() Config {
+	return Config{
+		SpriteScale: defaultSpriteScale,
+
+		BackgroundFadeFrames: 60,
+
+		ClearColor: color.RGBA{A: 0xff},
+
+		PathSamples: 256,
+
+		CameraSegmentFrames: 240,
+
+		RecordMaxFrames: 300,
+		RecordMaxBytes:  128 << 20,
+
+		RasterBandHeight: 8,
+
+		Gamma: 1,
+
+		Bg1SpeedX: 16,
+		Bg1SpeedY: 1,
+		Bg2SpeedX: 16,
+		Bg2SpeedY: 2,
+
+		LoopCount: -1,
+		MusicEnd:  musicEndStop,
+
+		RasterClamp: true,
+
+		SwingAmplitude: 50,
+
+		SmallScroll1Y: 16,
+		SmallScroll2Y: 64,
+
+		PulseAttack:  20 * time.Millisecond,
+		PulseRelease: 250 * time.Millisecond,
+
+		ExitFadeFrames: 45,
+
+		TitleCard: 4 * time.Second,
+		SongInfo:  true,
+
+		WaveFrequency: 0.4,
+
+		ScrollTintSpeed: 0.25,
+
+		MusicFadeIn:  2 * time.Second,
+		MusicFadeOut: time.Second,
+	}
+}
+
+// parseCrop parses a crop region given as "x,y,w,h" in scene pixels
+func parseCrop(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("crop %q: want x,y,w,h", s)
+	}
+
+	var v [4]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return image.Rectangle{}, fmt.Errorf("crop %q: %w", s, err)
+		}
+		v[i] = n
+	}
+
+	r := image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3])
+	if err := validateCrop(r); err != nil {
+		return image.Rectangle{}, err
+	}
+	return r, nil
+}
+
+// validateCrop checks that a crop region is non-empty and inside the scene
+func validateCrop(r image.Rectangle) error {
+	if r.Dx() <= 0 || r.Dy() <= 0 {
+		return fmt.Errorf("crop %v: region is empty", r)
+	}
+	if !r.In(image.Rect(0, 0, screenWidth, screenHeight)) {
+		return fmt.Errorf("crop %v: region exceeds the %dx%d scene", r, screenWidth, screenHeight)
+	}
+	return nil
+}
+
+// cropSource returns the part of an offscreen frame rendered at 1/upscale
+// resolution that holds the crop region; an empty crop selects everything
+func cropSource(crop image.Rectangle, upscale float64) image.Rectangle {
+	if crop.Empty() {
+		crop = image.Rect(0, 0, screenWidth, screenHeight)
+	}
+	return image.Rect(
+		int(float64(crop.Min.X)/upscale), int(float64(crop.Min.Y)/upscale),
+		int(float64(crop.Max.X)/upscale), int(float64(crop.Max.Y)/upscale),
+	)
+}
+
+// parseTimestamp parses a "mm:ss" position into milliseconds
+func parseTimestamp(s string) (int64, error) {
+	minutes, seconds, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid timestamp %q: want mm:ss", s)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 {
+		return 0, fmt.Errorf("invalid minutes in timestamp %q", s)
+	}
+	sec, err := strconv.Atoi(seconds)
+	if err != nil || len(seconds) != 2 || sec < 0 || sec > 59 {
+		return 0, fmt.Errorf("invalid seconds in timestamp %q", s)
+	}
+	return (int64(m)*60 + int64(sec)) * 1000, nil
+}
+
+// parseColor parses a color given as RRGGBB hex digits
+func parseColor(s string) (color.RGBA, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	if err != nil || len(strings.TrimPrefix(s, "#")) != 6 {
+		return color.RGBA{}, fmt.Errorf("color %q: want RRGGBB", s)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, nil
+}
+
+// applyColorKey returns a copy of img where pixels matching the key's RGB
+// are fully transparent
+func applyColorKey(img image.Image, key color.RGBA) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	draw.Draw(out, b, img, b.Min, draw.Src)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := out.NRGBAAt(x, y)
+			if c.R == key.R && c.G == key.G && c.B == key.B {
+				out.SetNRGBA(x, y, color.NRGBA{})
+			}
+		}
+	}
+	return out
+}
+
+// opaqueBackground reports whether an image looks like it has a solid
+// background, judging by an opaque top-left pixel, and returns that color
+func opaqueBackground(img image.Image) (color.RGBA, bool) {
+	b := img.Bounds()
+	c := color.NRGBAModel.Convert(img.At(b.Min.X, b.Min.Y)).(color.NRGBA)
+	return color.RGBA{c.R, c.G, c.B, 0xff}, c.A == 0xff
+}
+
+// validateAudioBuffer checks that an audio buffer size is within bounds
+func validateAudioBuffer(d time.Duration) error {
+	if d < minAudioBuffer || d > maxAudioBuffer {
+		return fmt.Errorf("audio buffer %v: must be between %v and %v", d, minAudioBuffer, maxAudioBuffer)
+	}
+	return nil
+}
+
+// internalResolution returns the size the scene is rendered at and the
+// factor needed to scale it back up to the screen
+func internalResolution(lowRes bool) (width, height int, upscale float64) {
+	if lowRes {
+		return screenWidth / 2, screenHeight / 2, 2
+	}
+	return screenWidth, screenHeight, 1
+}
+
 // Embedded assets
 var (
 	//go:embed assets/Grodan_green.png
@@ -42,813 +486,4248 @@ var (
 	upFontData []byte
 	//go:embed assets/lfont.png
 	lFontData []byte
+	//go:embed assets/bsfont.json
+	bsFontMapData []byte
+	//go:embed assets/upfonts.json
+	upFontMapData []byte
+	//go:embed assets/lfont.json
+	lFontMapData []byte
 	//go:embed assets/music.ym
 	musicData []byte
+
+	// Jukebox tunes
+	//go:embed assets/jukebox/giana.ym
+	gianaData []byte
+	//go:embed assets/jukebox/jambala4.ym
+	jambala4Data []byte
+	//go:embed assets/jukebox/cuddly.ym
+	cuddlyData []byte
+	//go:embed assets/jukebox/medusa.ym
+	medusaData []byte
+	//go:embed assets/jukebox/union.ym
+	unionData []byte
+	//go:embed assets/jukebox/turrican.ym
+	turricanData []byte
+	//go:embed assets/jukebox/teramis.ym
+	teramisData []byte
+	//go:embed assets/jukebox/amberstar.ym
+	amberstarData []byte
 )
 
-// YMPlayer wraps the YM player for Ebiten
-type YMPlayer struct {
-	player       *stsound.StSound
-	sampleRate   int
-	buffer       []int16
-	mutex        sync.Mutex
-	position     int64
-	totalSamples int64
-	loop         bool
-	volume       float64
+// Assets holds the raw data of everything the demo loads
+type Assets struct {
+	BgGreen  []byte
+	BgPink   []byte
+	UpRaster []byte
+	BsRaster []byte
+	Sprite   []byte
+	BsFont   []byte
+	UpFont   []byte
+	LFont    []byte
+	Tracks   []musicTrack
 }
 
-// NewYMPlayer creates a new YM player
-func NewYMPlayer(data []byte, sampleRate int, loop bool) (*YMPlayer, error) {
-	player := stsound.CreateWithRate(sampleRate)
-
-	if err := player.LoadMemory(data); err != nil {
-		player.Destroy()
-		return nil, fmt.Errorf("failed to load YM data: %w", err)
+// embeddedAssets returns the assets compiled into the binary
+func embeddedAssets() Assets {
+	return Assets{
+		BgGreen:  bgGreenData,
+		BgPink:   bgPinkData,
+		UpRaster: upRasterData,
+		BsRaster: bsRasterData,
+		Sprite:   spriteData,
+		BsFont:   bsFontData,
+		UpFont:   upFontData,
+		LFont:    lFontData,
+		Tracks:   embeddedTracks(),
 	}
+}
 
-	player.SetLoopMode(loop)
-
-	info := player.GetInfo()
-	totalSamples := int64(info.MusicTimeInMs) * int64(sampleRate) / 1000
-
-	return &YMPlayer{
-		player:       player,
-		sampleRate:   sampleRate,
-		buffer:       make([]int16, 4096),
-		totalSamples: totalSamples,
-		loop:         loop,
-		volume:       0.7,
-	}, nil
+// StubAssets returns tiny placeholder images and no music, so Game logic
+// can be exercised without the large embedded data
+func StubAssets() Assets {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		panic(err) // Encoding an in-memory image cannot fail
+	}
+	stub := buf.Bytes()
+
+	return Assets{
+		BgGreen:  stub,
+		BgPink:   stub,
+		UpRaster: stub,
+		BsRaster: stub,
+		Sprite:   stub,
+		BsFont:   stub,
+		UpFont:   stub,
+		LFont:    stub,
+	}
 }
 
-// Read implements io.Reader
-func (y *YMPlayer) Read(p []byte) (n int, err error) {
-	y.mutex.Lock()
-	defer y.mutex.Unlock()
+// SampleFormat selects how YMPlayer.Read encodes the stereo samples
+type SampleFormat int
 
-	samplesNeeded := len(p) / 4
-	outBuffer := make([]int16, samplesNeeded*2)
+const (
+	// SampleFormatInt16 is signed 16-bit little endian. Ebiten's audio
+	// context only accepts this format, so it is the default.
+	SampleFormatInt16 SampleFormat = iota
+	// SampleFormatInt8 is signed 8-bit
+	SampleFormatInt8
+	// SampleFormatFloat32 is 32-bit little endian float in [-1, 1]
+	SampleFormatFloat32
+)
 
-	processed := 0
-	for processed < samplesNeeded {
-		chunkSize := samplesNeeded - processed
-		if chunkSize > len(y.buffer) {
-			chunkSize = len(y.buffer)
-		}
+// bytesPerSample returns the size of one encoded sample for one channel
+func (f SampleFormat) bytesPerSample() int {
+	switch f {
+	case SampleFormatInt8:
+		return 1
+	case SampleFormatFloat32:
+		return 4
+	default:
+		return 2
+	}
+}
 
-		if !y.player.Compute(y.buffer[:chunkSize], chunkSize) {
-			if !y.loop {
-				for i := processed * 2; i < len(outBuffer); i++ {
-					outBuffer[i] = 0
-				}
-				err = io.EOF
-				break
-			}
-		}
+// putSample encodes a 16-bit sample in the format at the start of dst,
+// which must hold bytesPerSample bytes, and returns the bytes written
+func (f SampleFormat) putSample(dst []byte, sample int16) int {
+	switch f {
+	case SampleFormatInt8:
+		dst[0] = byte(int8(sample >> 8))
+		return 1
+	case SampleFormatFloat32:
+		binary.LittleEndian.PutUint32(dst, math.Float32bits(float32(sample)/32768))
+		return 4
+	default:
+		binary.LittleEndian.PutUint16(dst, uint16(sample))
+		return 2
+	}
+}
 
-		for i := 0; i < chunkSize; i++ {
-			sample := int16(float64(y.buffer[i]) * y.volume)
-			outBuffer[(processed+i)*2] = sample
-			outBuffer[(processed+i)*2+1] = sample
-		}
+// Clock abstracts wall-clock time so time-based effects can be driven
+// deterministically
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
 
-		processed += chunkSize
-		y.position += int64(chunkSize)
-	}
+// realClock is the Clock backed by the system time
+type realClock struct{}
 
-	buf := make([]byte, 0, len(outBuffer)*2)
-	for _, sample := range outBuffer {
-		buf = append(buf, byte(sample), byte(sample>>8))
-	}
+// Now returns the current system time
+func (realClock) Now() time.Time {
+	return time.Now()
+}
 
-	copy(p, buf)
-	n = len(buf)
-	if n > len(p) {
-		n = len(p)
-	}
+// After waits for d of system time
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
 
-	return n, err
+// ManualClock is a Clock that only moves when advanced, for deterministic
+// runs such as frame-exact captures. It is safe for concurrent use, so one
+// goroutine can advance it while another waits on After.
+type ManualClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []manualWaiter
 }
 
-// Seek implements io.Seeker
-func (y *YMPlayer) Seek(offset int64, whence int) (int64, error) {
-	y.mutex.Lock()
-	defer y.mutex.Unlock()
+// manualWaiter is a pending After on a ManualClock
+type manualWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
 
-	var newPos int64
-	switch whence {
-	case io.SeekStart:
-		newPos = offset
-	case io.SeekCurrent:
-		newPos = y.position + offset
-	case io.SeekEnd:
-		newPos = y.totalSamples + offset
-	default:
-		return 0, fmt.Errorf("invalid whence: %d", whence)
-	}
+// NewManualClock creates a manual clock starting at the given time
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
 
-	if newPos < 0 {
-		newPos = 0
-	}
-	if newPos > y.totalSamples {
-		newPos = y.totalSamples
-	}
+// Now returns the clock's current time
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	y.position = newPos
-	return newPos, nil
+	return c.now
 }
 
-// Close releases resources
-func (y *YMPlayer) Close() error {
-	y.mutex.Lock()
-	defer y.mutex.Unlock()
+// After returns a channel that receives the clock time once it has been
+// advanced by d
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	if y.player != nil {
-		y.player.Destroy()
-		y.player = nil
+	w := manualWaiter{at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.ch <- c.now
+		return w.ch
 	}
-	return nil
+	c.waiters = append(c.waiters, w)
+	return w.ch
 }
 
-// CharMapping represents character position in font image
-type CharMapping struct {
-	x, y, width, height int
+// Advance moves the clock forward by d, firing the After channels that
+// have come due
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
 }
 
-// FontMap manages character mappings for a bitmap font
-type FontMap struct {
-	chars      map[rune]CharMapping
-	charWidth  int
-	charHeight int
+// musicTrack is a tune that can be selected from the jukebox
+type musicTrack struct {
+	name string
+	data []byte
 }
 
-// NewFontMap creates a font map with automatic character detection
-func NewFontMap(charWidth, charHeight int) *FontMap {
-	return &FontMap{
-		chars:      make(map[rune]CharMapping),
-		charWidth:  charWidth,
-		charHeight: charHeight,
+// embeddedTracks lists the bundled tunes, selected with the number keys
+func embeddedTracks() []musicTrack {
+	return []musicTrack{
+		{"JAMBALA MAGIC STAFF SONG", musicData},
+		{"GREAT GIANA SISTERS TITLE", gianaData},
+		{"7 GATES OF JAMBALA LEVEL 4", jambala4Data},
+		{"CUDDLY DEMOS MAIN MENU", cuddlyData},
+		{"RINGS OF MEDUSA TITLE", medusaData},
+		{"UNION DEMO LOADER", unionData},
+		{"TURRICAN LOADER", turricanData},
+		{"LEAVING TERAMIS TITLE", teramisData},
+		{"AMBERSTAR 18", amberstarData},
 	}
 }
 
-// AddChar adds a character mapping
-func (fm *FontMap) AddChar(char rune, col, row int, width int) {
-	if width == 0 {
-		width = fm.charWidth
+// loadMusicFile reads a YM tune from disk as a jukebox track named after
+// its song, checking that it plays and describing it on w
+func loadMusicFile(path string, w io.Writer) (musicTrack, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return musicTrack{}, fmt.Errorf("failed to read music file: %w", err)
 	}
-	fm.chars[char] = CharMapping{
-		x:      col * fm.charWidth,
-		y:      row * fm.charHeight,
-		width:  width,
-		height: fm.charHeight,
+	player, err := NewYMPlayer(data, sampleRate, false)
+	if err != nil {
+		return musicTrack{}, err
 	}
-}
+	defer player.Close()
 
-// InitBigScrollFont initializes the big scroll font (24x33)
-func initBigScrollFont() *FontMap {
-	fm := NewFontMap(24, 33)
-
-	// Row 0: [NA]![NA][NA][NA]'"()
-	fm.AddChar('!', 1, 0, 0)
-	fm.AddChar('\'', 5, 0, 0)
-	fm.AddChar('"', 6, 0, 0)
-	fm.AddChar('(', 7, 0, 0)
-	fm.AddChar(')', 8, 0, 0)
-
-	// Row 1: [NA][NA][NA][NA].,0123
-	fm.AddChar('.', 4, 1, 0)
-	fm.AddChar(',', 5, 1, 0)
-	fm.AddChar('0', 6, 1, 0)
-	fm.AddChar('1', 7, 1, 0)
-	fm.AddChar('2', 8, 1, 0)
-	fm.AddChar('3', 9, 1, 0)
-
-	// Row 2: 456789:[NA][NA][NA]
-	fm.AddChar('4', 0, 2, 0)
-	fm.AddChar('5', 1, 2, 0)
-	fm.AddChar('6', 2, 2, 0)
-	fm.AddChar('7', 3, 2, 0)
-	fm.AddChar('8', 4, 2, 0)
-	fm.AddChar('9', 5, 2, 0)
-	fm.AddChar(':', 6, 2, 0)
-
-	// Row 3: [NA]?[NA]ABCDEFG
-	fm.AddChar('?', 1, 3, 0)
-	fm.AddChar('A', 3, 3, 0)
-	fm.AddChar('B', 4, 3, 0)
-	fm.AddChar('C', 5, 3, 0)
-	fm.AddChar('D', 6, 3, 0)
-	fm.AddChar('E', 7, 3, 0)
-	fm.AddChar('F', 8, 3, 0)
-	fm.AddChar('G', 9, 3, 0)
-
-	// Row 4: HIJKLMNOPQ
-	fm.AddChar('H', 0, 4, 0)
-	fm.AddChar('I', 1, 4, 0)
-	fm.AddChar('J', 2, 4, 0)
-	fm.AddChar('K', 3, 4, 0)
-	fm.AddChar('L', 4, 4, 0)
-	fm.AddChar('M', 5, 4, 0)
-	fm.AddChar('N', 6, 4, 0)
-	fm.AddChar('O', 7, 4, 0)
-	fm.AddChar('P', 8, 4, 0)
-	fm.AddChar('Q', 9, 4, 0)
-
-	// Row 5: RSTUVWXYZ[NA]
-	fm.AddChar('R', 0, 5, 0)
-	fm.AddChar('S', 1, 5, 0)
-	fm.AddChar('T', 2, 5, 0)
-	fm.AddChar('U', 3, 5, 0)
-	fm.AddChar('V', 4, 5, 0)
-	fm.AddChar('W', 5, 5, 0)
-	fm.AddChar('X', 6, 5, 0)
-	fm.AddChar('Y', 7, 5, 0)
-	fm.AddChar('Z', 8, 5, 0)
-
-	// Space is handled separately (no graphic)
-	fm.AddChar(' ', 0, 0, 24) // Use width but no actual drawing
-	fm.AddChar('-', 0, 0, 24) // Missing in font, use space width
+	info := player.Info()
+	length := "unknown"
+	if ms := player.LengthMs(); ms > 0 {
+		length = formatMs(ms)
+	}
+	fmt.Fprintf(w, "Music: %s\n  Title:  %s\n  Author: %s\n  Type:   %s\n  Length: %s\n",
+		path, info.SongName, info.SongAuthor, info.SongType, length)
 
-	return fm
+	name := strings.TrimSpace(info.SongName)
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return musicTrack{strings.ToUpper(name), data}, nil
 }
 
-// InitUpScrollFont initializes the vertical scroll font (33x29)
-func initUpScrollFont() *FontMap {
-	fm := NewFontMap(33, 29)
-
-	// Row 0: [NA]![NA][NA][NA][NA][NA][NA]()
-	fm.AddChar('!', 1, 0, 0)
-	fm.AddChar('(', 8, 0, 0)
-	fm.AddChar(')', 9, 0, 0)
-
-	// Row 1: [NA][NA][NA][NA].[NA][NA][NA][NA][NA]
-	fm.AddChar('.', 4, 1, 0)
-
-	// Row 2: [NA][NA][NA][NA][NA]#:[NA][NA][NA]
-	fm.AddChar('#', 5, 2, 0)
-	fm.AddChar(':', 6, 2, 0)
-
-	// Row 3: [NA]?[NA]ABCDEFG
-	fm.AddChar('?', 1, 3, 0)
-	fm.AddChar('A', 3, 3, 0)
-	fm.AddChar('B', 4, 3, 0)
-	fm.AddChar('C', 5, 3, 0)
-	fm.AddChar('D', 6, 3, 0)
-	fm.AddChar('E', 7, 3, 0)
-	fm.AddChar('F', 8, 3, 0)
-	fm.AddChar('G', 9, 3, 0)
-
-	// Row 4: HIJKLMNOPQ
-	fm.AddChar('H', 0, 4, 0)
-	fm.AddChar('I', 1, 4, 0)
-	fm.AddChar('J', 2, 4, 0)
-	fm.AddChar('K', 3, 4, 0)
-	fm.AddChar('L', 4, 4, 0)
-	fm.AddChar('M', 5, 4, 0)
-	fm.AddChar('N', 6, 4, 0)
-	fm.AddChar('O', 7, 4, 0)
-	fm.AddChar('P', 8, 4, 0)
-	fm.AddChar('Q', 9, 4, 0)
-
-	// Row 5: RSTUVWXYZ[NA]
-	fm.AddChar('R', 0, 5, 0)
-	fm.AddChar('S', 1, 5, 0)
-	fm.AddChar('T', 2, 5, 0)
-	fm.AddChar('U', 3, 5, 0)
-	fm.AddChar('V', 4, 5, 0)
-	fm.AddChar('W', 5, 5, 0)
-	fm.AddChar('X', 6, 5, 0)
-	fm.AddChar('Y', 7, 5, 0)
-	fm.AddChar('Z', 8, 5, 0)
-
-	// Numbers 0-9 (not in this font, but referenced in text)
-	fm.AddChar('0', 0, 0, 33)
-	fm.AddChar('1', 0, 0, 33)
-	fm.AddChar('2', 0, 0, 33)
-	fm.AddChar('3', 0, 0, 33)
-	fm.AddChar('4', 0, 0, 33)
-	fm.AddChar('5', 0, 0, 33)
-	fm.AddChar('6', 0, 0, 33)
-	fm.AddChar('7', 0, 0, 33)
-	fm.AddChar('8', 0, 0, 33)
-	fm.AddChar('9', 0, 0, 33)
-
-	// Space and missing characters
-	fm.AddChar(' ', 0, 0, 33)
-	fm.AddChar('-', 0, 0, 33)
-	fm.AddChar(',', 0, 0, 33)
-	fm.AddChar('\'', 0, 0, 33)
-
-	return fm
+// trackKeys are the keys selecting the tracks, in order
+var trackKeys = []ebiten.Key{
+	ebiten.KeyDigit1, ebiten.KeyDigit2, ebiten.KeyDigit3,
+	ebiten.KeyDigit4, ebiten.KeyDigit5, ebiten.KeyDigit6,
+	ebiten.KeyDigit7, ebiten.KeyDigit8, ebiten.KeyDigit9,
 }
 
-// InitSmallFont initializes the small font (8x8)
-func initSmallFont() *FontMap {
-	fm := NewFontMap(8, 8)
-
-	// Row 0: [NA]![NA][NA][NA][NA][NA]'()
-	fm.AddChar('!', 1, 0, 0)
-	fm.AddChar('\'', 7, 0, 0)
-	fm.AddChar('(', 8, 0, 0)
-	fm.AddChar(')', 9, 0, 0)
-
-	// Row 1: [NA][NA][NA][NA]./0123
-	fm.AddChar('.', 4, 1, 0)
-	fm.AddChar('/', 5, 1, 0)
-	fm.AddChar('0', 6, 1, 0)
-	fm.AddChar('1', 7, 1, 0)
-	fm.AddChar('2', 8, 1, 0)
-	fm.AddChar('3', 9, 1, 0)
-
-	// Row 2: 456789:[NA][NA][NA]
-	fm.AddChar('4', 0, 2, 0)
-	fm.AddChar('5', 1, 2, 0)
-	fm.AddChar('6', 2, 2, 0)
-	fm.AddChar('7', 3, 2, 0)
-	fm.AddChar('8', 4, 2, 0)
-	fm.AddChar('9', 5, 2, 0)
-	fm.AddChar(':', 6, 2, 0)
-
-	// Row 3: [NA]?[NA]ABCDEFG
-	fm.AddChar('?', 1, 3, 0)
-	fm.AddChar('A', 3, 3, 0)
-	fm.AddChar('B', 4, 3, 0)
-	fm.AddChar('C', 5, 3, 0)
-	fm.AddChar('D', 6, 3, 0)
-	fm.AddChar('E', 7, 3, 0)
-	fm.AddChar('F', 8, 3, 0)
-	fm.AddChar('G', 9, 3, 0)
-
-	// Row 4: HIJKLMNOPQ
-	fm.AddChar('H', 0, 4, 0)
-	fm.AddChar('I', 1, 4, 0)
-	fm.AddChar('J', 2, 4, 0)
-	fm.AddChar('K', 3, 4, 0)
-	fm.AddChar('L', 4, 4, 0)
-	fm.AddChar('M', 5, 4, 0)
-	fm.AddChar('N', 6, 4, 0)
-	fm.AddChar('O', 7, 4, 0)
-	fm.AddChar('P', 8, 4, 0)
-	fm.AddChar('Q', 9, 4, 0)
-
-	// Row 5: RSTUVWXYZ[NA]
-	fm.AddChar('R', 0, 5, 0)
-	fm.AddChar('S', 1, 5, 0)
-	fm.AddChar('T', 2, 5, 0)
-	fm.AddChar('U', 3, 5, 0)
-	fm.AddChar('V', 4, 5, 0)
-	fm.AddChar('W', 5, 5, 0)
-	fm.AddChar('X', 6, 5, 0)
-	fm.AddChar('Y', 7, 5, 0)
-	fm.AddChar('Z', 8, 5, 0)
-
-	// Space and missing characters
-	fm.AddChar(' ', 0, 0, 8)
-	fm.AddChar('-', 0, 0, 8)
-	fm.AddChar(',', 0, 0, 8)
-	fm.AddChar('"', 0, 0, 8)
+// Loudness meter settings, loosely following ITU-R BS.1770
+const (
+	loudnessBlockMs  = 400   // Gating block length
+	loudnessAbsGate  = -70.0 // Absolute gate in LUFS
+	loudnessRelGate  = -10.0 // Relative gate in LU below the ungated level
+	loudnessBinWidth = 0.1   // Histogram resolution in LU
+	loudnessMaxLUFS  = 5.0   // Upper bound of the histogram
+	loudnessBins     = int((loudnessMaxLUFS - loudnessAbsGate) / loudnessBinWidth)
+)
 
-	return fm
+// loudnessBin accumulates the gating blocks falling in one loudness range
+type loudnessBin struct {
+	count  int
+	energy float64
 }
 
-// ScrollText manages scrolling text
-type ScrollText struct {
-	text     string
-	fontImg  *ebiten.Image
-	fontMap  *FontMap
-	scrollX  float64
-	speed    float64
-	vertical bool // For vertical scrolling
+// loudnessMeter approximates integrated loudness from gated 400ms blocks.
+// It skips the K-weighting filter, so values are a ballpark figure. Blocks
+// are kept in a fixed histogram so memory stays bounded on endless loops.
+type loudnessMeter struct {
+	blockSize  int
+	blockSum   float64
+	blockCount int
+	bins       [loudnessBins]loudnessBin
 }
 
-// NewScrollText creates a new scrolling text
-func NewScrollText(text string, fontImg *ebiten.Image, fontMap *FontMap, speed float64, vertical bool) *ScrollText {
-	return &ScrollText{
-		text:     text,
-		fontImg:  fontImg,
-		fontMap:  fontMap,
-		speed:    speed,
-		vertical: vertical,
-	}
+// newLoudnessMeter creates a meter for the given sample rate
+func newLoudnessMeter(sampleRate int) *loudnessMeter {
+	return &loudnessMeter{blockSize: sampleRate * loudnessBlockMs / 1000}
 }
 
-// Update updates the scroll position
-func (s *ScrollText) Update() {
+// blockLoudness converts a block's channel-summed mean square to LUFS
+func blockLoudness(energy float64) float64 {
+	return -0.691 + 10*math.Log10(energy)
+}
+
+// add feeds one normalized sample that is played on both stereo channels
+func (m *loudnessMeter) add(sample float64) {
+	m.blockSum += 2 * sample * sample
+	m.blockCount++
+	if m.blockCount < m.blockSize {
+		return
+	}
+
+	energy := m.blockSum / float64(m.blockCount)
+	m.blockSum, m.blockCount = 0, 0
+
+	l := blockLoudness(energy)
+	if l <= loudnessAbsGate {
+		return
+	}
+	bin := int((l - loudnessAbsGate) / loudnessBinWidth)
+	if bin >= loudnessBins {
+		bin = loudnessBins - 1
+	}
+	m.bins[bin].count++
+	m.bins[bin].energy += energy
+}
+
+// integrated returns the gated integrated loudness in LUFS, or -Inf when
+// nothing above the absolute gate has been measured yet
+func (m *loudnessMeter) integrated() float64 {
+	gated := func(fromBin int) (float64, int) {
+		sum, count := 0.0, 0
+		for _, b := range m.bins[fromBin:] {
+			sum += b.energy
+			count += b.count
+		}
+		return sum, count
+	}
+
+	sum, count := gated(0)
+	if count == 0 {
+		return math.Inf(-1)
+	}
+
+	relGate := blockLoudness(sum/float64(count)) + loudnessRelGate
+	from := 0
+	if relGate > loudnessAbsGate {
+		from = int((relGate - loudnessAbsGate) / loudnessBinWidth)
+	}
+	sum, count = gated(from)
+	if count == 0 {
+		return math.Inf(-1)
+	}
+	return blockLoudness(sum / float64(count))
+}
+
+// YMPlayer wraps the YM player for Ebiten
+type YMPlayer struct {
+	player       *stsound.CYmMusic // Driven directly, as StSound.Compute allocates per call
+	sampleRate   int
+	buffer       []stsound.YmSample
+	out          []int16 // Interleaved output scratch reused across Reads
+	mutex        sync.Mutex
+	position     int64
+	totalSamples int64
+	loopStart    int64 // Sample the tune restarts from when it loops
+	loop         bool
+	volume       float64 // Gain currently applied to the samples
+	targetVolume float64 // Gain the applied volume is ramping towards
+	rampSamples  int     // Samples needed to ramp across the full gain range
+	format       SampleFormat
+	channels     int // Interleaved output channels, the same sample in each
+
+	// While scrubbing, position reporting holds the last requested target
+	scrubbing     bool
+	scrubTargetMs int64
+
+	loudness *loudnessMeter
+
+	replayHz   int    // Register update rate of the tune
+	interleave string // Register layout of the file, for diagnostics
+
+	info stsound.YmMusicInfo // Song details from the file header
+
+	quietSamples int64 // Consecutive output samples below silenceThreshold
+
+	level float64 // RMS level of the last Read, from 0 to 1
+
+	// States of AY channels A, B and C by output frame, oldest first, so
+	// Voices can return the one being heard rather than the newest made
+	voices  []voiceSnapshot
+	written int64 // Frames written by Read so far
+
+	// Peak magnitudes of the left and right channels in the last Read
+	lastPeakL float64
+	lastPeakR float64
+
+	// A looping tune restarts loopCount times before ending, or forever
+	// when loopCount is negative; passes counts the restarts so far
+	loopCount int
+	passes    int
+	ended     bool
+	paused    bool
+
+	// onEnd runs once, outside the lock, on the Read that ends the tune
+	onEnd       func()
+	endNotified bool
+
+	// Tune being crossfaded in, mixed over fadeSamples samples of output
+	next        *YMPlayer
+	fadeSamples int
+	fadeDone    int
+
+	// Fade-in from silence over fadeInSamples samples of output. It counts
+	// samples played rather than the song position, so loops and seeks
+	// never restart it.
+	fadeInSamples int
+	fadeInDone    int
+
+	// Fade-out to silence over fadeOutSamples samples of output, on top of
+	// the volume so its ramp is left alone; fadedOut is closed once the
+	// output is silent
+	fadingOut      bool
+	fadeOutSamples int
+	fadeOutDone    int
+	fadedOut       chan struct{}
+}
+
+// silenceThreshold is the largest sample magnitude counted as silence,
+// about -54 dBFS
+const silenceThreshold = 64
+
+// defaultReplayHz is the Atari ST VBL rate, used by tunes without a header rate
+const defaultReplayHz = 50
+
+// ymReplayHz reads the replay frequency from an unpacked YM file header.
+// Only YM5 and YM6 files store it; older formats always play at 50Hz.
+func ymReplayHz(data []byte) int {
+	// "YMx!LeOnArD!", frames, attributes, digidrums, master clock, then rate
+	if len(data) < 28 || (string(data[:4]) != "YM5!" && string(data[:4]) != "YM6!") {
+		return defaultReplayHz
+	}
+	if hz := int(binary.BigEndian.Uint16(data[26:28])); hz > 0 {
+		return hz
+	}
+	return defaultReplayHz
+}
+
+// unpackYM returns the raw YM file inside an LZH archive, as most YM files
+// are shipped, or data itself when it is not compressed
+func unpackYM(data []byte) []byte {
+	if !lzh.IsLZHCompressed(data) {
+		return data
+	}
+	decompressed, err := lzh.Decompress(data)
+	if err != nil {
+		return nil
+	}
+	return decompressed
+}
+
+// ymLoopFrame reads the frame a tune restarts from when it loops and its
+// frame count from an unpacked YM file header. Only YM5 and YM6 files store
+// a loop frame; older formats loop back to the start.
+func ymLoopFrame(data []byte) (loop, frames int) {
+	// "YMx!LeOnArD!", frames, attributes, digidrums, master clock, replay
+	// rate, then the loop frame
+	if len(data) < 32 || (string(data[:4]) != "YM5!" && string(data[:4]) != "YM6!") {
+		return 0, 0
+	}
+	return int(binary.BigEndian.Uint32(data[28:32])), int(binary.BigEndian.Uint32(data[12:16]))
+}
+
+// Register layouts of YM files, as reported by InterleaveMode
+const (
+	ymInterleaved = "interleaved" // All frames of register 0, then register 1...
+	ymSequential  = "sequential"  // All registers of frame 0, then frame 1...
+	ymUnknown     = "unknown"
+)
+
+// ymStreamInterleaved is the attribute bit of YM5 and YM6 headers marking
+// interleaved register data
+const ymStreamInterleaved = 1
+
+// ymInterleaveMode reads the register layout from an unpacked YM file
+// header. YM2 and YM3 are always interleaved; YM5 and YM6 store it in their
+// attributes.
+func ymInterleaveMode(data []byte) string {
+	if len(data) < 4 {
+		return ymUnknown
+	}
+	switch string(data[:4]) {
+	case "YM2!", "YM3!", "YM3b":
+		return ymInterleaved
+	case "YM5!", "YM6!":
+		// "YMx!LeOnArD!", frames, then attributes
+		if len(data) < 20 {
+			return ymUnknown
+		}
+		if binary.BigEndian.Uint32(data[16:20])&ymStreamInterleaved != 0 {
+			return ymInterleaved
+		}
+		return ymSequential
+	}
+	return ymUnknown
+}
+
+// NewYMPlayer creates a new YM player
+func NewYMPlayer(data []byte, sampleRate int, loop bool) (*YMPlayer, error) {
+	player := stsound.NewYmMusic(sampleRate)
+
+	if err := player.LoadMemory(data); err != nil {
+		player.UnLoad()
+		return nil, fmt.Errorf("failed to load YM data: %w", err)
+	}
+
+	player.SetLoopMode(stsound.YmBool(loop))
+
+	info := player.GetMusicInfo()
+	totalSamples := int64(info.MusicTimeInMs) * int64(sampleRate) / 1000
+
+	header := unpackYM(data)
+	var loopStart int64
+	if loopFrame, frames := ymLoopFrame(header); loopFrame < frames {
+		loopStart = totalSamples * int64(loopFrame) / int64(frames)
+	}
+
+	return &YMPlayer{
+		player:       player,
+		sampleRate:   sampleRate,
+		buffer:       make([]stsound.YmSample, 4096),
+		totalSamples: totalSamples,
+		loopStart:    loopStart,
+		loop:         loop,
+		volume:       0.7,
+		targetVolume: 0.7,
+		rampSamples:  durationToSamples(defaultVolumeRamp, sampleRate),
+		loudness:     newLoudnessMeter(sampleRate),
+		replayHz:     ymReplayHz(header),
+		interleave:   ymInterleaveMode(header),
+		info:         *info,
+		loopCount:    -1,
+		channels:     2,
+		voices:       make([]voiceSnapshot, 0, voiceHistory),
+	}, nil
+}
+
+// ReplayHz returns the tune's native register update rate (50, 60, 200...)
+func (y *YMPlayer) ReplayHz() int {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	return y.replayHz
+}
+
+// InterleaveMode returns the register layout declared by the file header:
+// "interleaved", "sequential" or "unknown". stsound de-interleaves on load,
+// so both layouts play the same; this is only for diagnostics.
+func (y *YMPlayer) InterleaveMode() string {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	return y.interleave
+}
+
+// TickCount returns the number of replay ticks played so far
+func (y *YMPlayer) TickCount() int64 {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	return y.position * int64(y.replayHz) / int64(y.sampleRate)
+}
+
+// durationToSamples converts a duration to a sample count at the given rate
+func durationToSamples(d time.Duration, sampleRate int) int {
+	return int(d.Seconds() * float64(sampleRate))
+}
+
+// SetVolume sets the target volume; the applied gain ramps towards it
+// inside Read to avoid audible clicks
+func (y *YMPlayer) SetVolume(volume float64) {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	y.targetVolume = volume
+}
+
+// SetFadeIn makes the tune ramp up linearly from silence over d, counted
+// from the next sample played; zero or negative durations disable it
+func (y *YMPlayer) SetFadeIn(d time.Duration) {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	y.fadeInSamples = durationToSamples(d, y.sampleRate)
+	y.fadeInDone = 0
+}
+
+// SetPaused holds the tune where it is: while paused, Read returns silence
+// without advancing the position
+func (y *YMPlayer) SetPaused(paused bool) {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	y.paused = paused
+}
+
+// SetVolumeRamp sets how long a full-range volume change takes; zero or
+// negative durations apply volume changes instantly
+func (y *YMPlayer) SetVolumeRamp(d time.Duration) {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	y.rampSamples = durationToSamples(d, y.sampleRate)
+}
+
+// SetSampleFormat selects how Read encodes samples. Ebiten needs the default
+// SampleFormatInt16; the other formats are meant for consumers reading the
+// player directly, such as file exporters.
+func (y *YMPlayer) SetSampleFormat(format SampleFormat) {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	y.format = format
+}
+
+// SetChannels sets how many interleaved channels Read writes: 1 for mono or
+// 2 for stereo. Ebiten's audio context needs the default stereo output.
+func (y *YMPlayer) SetChannels(n int) error {
+	if n != 1 && n != 2 {
+		return fmt.Errorf("unsupported channel count %d: want 1 or 2", n)
+	}
+
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	y.channels = n
+	return nil
+}
+
+// stepVolume moves the applied gain one sample closer to the target volume
+func (y *YMPlayer) stepVolume() {
+	if y.volume == y.targetVolume {
+		return
+	}
+	if y.rampSamples <= 0 {
+		y.volume = y.targetVolume
+		return
+	}
+
+	step := 1 / float64(y.rampSamples)
+	if y.volume < y.targetVolume {
+		y.volume = math.Min(y.volume+step, y.targetVolume)
+	} else {
+		y.volume = math.Max(y.volume-step, y.targetVolume)
+	}
+}
+
+// FadeOut fades the output linearly to silence over d as Read keeps being
+// pulled; a fade already under way keeps its length. The returned channel
+// is closed once the output is silent, or when the player ends or is
+// closed first, so waiting on it cannot hang on a finished tune.
+func (y *YMPlayer) FadeOut(d time.Duration) <-chan struct{} {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	if y.fadedOut == nil {
+		y.fadedOut = make(chan struct{})
+	}
+	done := y.fadedOut
+
+	if !y.fadingOut {
+		y.fadingOut = true
+		y.fadeOutSamples = durationToSamples(d, y.sampleRate)
+		y.fadeOutDone = 0
+	}
+	y.checkFadeOut()
+	return done
+}
+
+// checkFadeOut signals a pending FadeOut once there is nothing left to hear
+func (y *YMPlayer) checkFadeOut() {
+	silent := y.fadeOutDone >= y.fadeOutSamples || y.volume == 0
+	if y.fadedOut != nil && (silent || y.player == nil || y.ended) {
+		close(y.fadedOut)
+		y.fadedOut = nil
+	}
+}
+
+// OnEnd registers fn to run once when the tune ends, from the audio
+// goroutine. Every Read from then on returns io.EOF.
+func (y *YMPlayer) OnEnd(fn func()) {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	y.onEnd = fn
+}
+
+// endCallback returns the OnEnd callback the first time it finds the tune
+// ended, and nil otherwise
+func (y *YMPlayer) endCallback() func() {
+	if !y.ended || y.endNotified {
+		return nil
+	}
+	y.endNotified = true
+	return y.onEnd
+}
+
+// Read implements io.Reader. It writes whole frames only, leaving any
+// trailing partial frame of p untouched, and returns io.ErrShortBuffer when p
+// cannot hold a single frame.
+func (y *YMPlayer) Read(p []byte) (n int, err error) {
+	var onEnd func()
+	defer func() {
+		// Run after unlocking, so the callback may use the player
+		if onEnd != nil {
+			onEnd()
+		}
+	}()
+
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+	defer y.checkFadeOut()
+	defer func() { onEnd = y.endCallback() }()
+
+	// The audio goroutine may still pull data after Close or the last loop
+	if y.player == nil || y.ended {
+		return 0, io.EOF
+	}
+
+	channels := y.channels
+	frameSize := channels * y.format.bytesPerSample()
+	if len(p) > 0 && len(p) < frameSize {
+		// Only whole frames are written, so 0, nil would repeat forever
+		return 0, io.ErrShortBuffer
+	}
+	if y.paused {
+		n = len(p) / frameSize * frameSize
+		clear(p[:n])
+		y.written += int64(n / frameSize)
+		y.level, y.lastPeakL, y.lastPeakR = 0, 0, 0
+		return n, nil
+	}
+
+	samplesNeeded := len(p) / frameSize
+	if cap(y.out) < samplesNeeded*channels {
+		y.out = make([]int16, samplesNeeded*channels)
+	}
+	outBuffer := y.out[:samplesNeeded*channels]
+
+	var sumSquares float64
+	processed := 0
+	for processed < samplesNeeded {
+		chunkSize := samplesNeeded - processed
+		if chunkSize > len(y.buffer) {
+			chunkSize = len(y.buffer)
+		}
+		if y.loop && y.loopCount >= 0 && y.totalSamples > 0 {
+			// Stop the chunk at the end of the song so a limited loop ends there
+			if remaining := y.totalSamples - y.position; remaining > 0 && int64(chunkSize) > remaining {
+				chunkSize = int(remaining)
+			}
+		}
+		if y.next != nil {
+			// End the chunk with the crossfade, so the mix never overshoots
+			// and the rest plays from the new tune alone
+			chunkSize = min(chunkSize, y.fadeSamples-y.fadeDone)
+		}
+
+		ok := y.player.Update(y.buffer[:chunkSize], chunkSize) == stsound.YmTrue
+		// Snapshot the registers as they were at the end of the chunk just
+		// generated, not before computing the next one
+		y.captureVoices(y.written + int64(processed+chunkSize))
+		if !ok {
+			if !y.loop && y.next == nil {
+				for i := processed * channels; i < len(outBuffer); i++ {
+					outBuffer[i] = 0
+				}
+				y.quietSamples += int64(samplesNeeded - processed)
+				y.ended = true
+				err = io.EOF
+				break
+			}
+		}
+
+		if y.next != nil {
+			y.next.player.Update(y.next.buffer[:chunkSize], chunkSize)
+		}
+
+		for i := 0; i < chunkSize; i++ {
+			y.stepVolume()
+			mixed := float64(y.buffer[i])
+			if y.next != nil {
+				t := float64(y.fadeDone) / float64(y.fadeSamples)
+				mixed = mixed*(1-t) + float64(y.next.buffer[i])*t
+				y.fadeDone++
+			}
+			if y.fadeInDone < y.fadeInSamples {
+				mixed *= float64(y.fadeInDone) / float64(y.fadeInSamples)
+				y.fadeInDone++
+			}
+			if y.fadingOut {
+				if y.fadeOutDone < y.fadeOutSamples {
+					mixed *= 1 - float64(y.fadeOutDone)/float64(y.fadeOutSamples)
+					y.fadeOutDone++
+				} else {
+					mixed = 0
+				}
+			}
+			sample := int16(mixed * y.volume)
+			y.loudness.add(float64(sample) / 32768)
+			sumSquares += float64(sample) * float64(sample)
+			if sample > -silenceThreshold && sample < silenceThreshold {
+				y.quietSamples++
+			} else {
+				y.quietSamples = 0
+			}
+			for c := 0; c < channels; c++ {
+				outBuffer[(processed+i)*channels+c] = sample
+			}
+		}
+
+		processed += chunkSize
+		y.position += int64(chunkSize)
+		if y.next != nil {
+			y.next.position += int64(chunkSize)
+			if y.fadeDone >= y.fadeSamples {
+				y.finishCrossfade()
+			}
+		}
+
+		// Keep the position inside the song when it loops around; the tune
+		// restarts from its loop frame, not necessarily from the start
+		if y.loop && y.position >= y.totalSamples && y.totalSamples > y.loopStart {
+			y.position = y.loopStart + (y.position-y.totalSamples)%(y.totalSamples-y.loopStart)
+			y.passes++
+			if y.loopCount >= 0 && y.passes > y.loopCount && y.next == nil {
+				for i := processed * channels; i < len(outBuffer); i++ {
+					outBuffer[i] = 0
+				}
+				y.quietSamples += int64(samplesNeeded - processed)
+				y.ended = true
+				err = io.EOF
+				break
+			}
+		}
+	}
+
+	y.written += int64(samplesNeeded)
+	if samplesNeeded > 0 {
+		y.level = math.Sqrt(sumSquares/float64(samplesNeeded)) / 32768
+	}
+
+	// The first channel is left and the last is right, so mono output
+	// feeds both
+	y.lastPeakL, y.lastPeakR = 0, 0
+	for i, sample := range outBuffer {
+		peak := math.Abs(float64(sample)) / 32768
+		c := i % channels
+		if c == 0 {
+			y.lastPeakL = max(y.lastPeakL, peak)
+		}
+		if c == channels-1 {
+			y.lastPeakR = max(y.lastPeakR, peak)
+		}
+	}
+
+	// samplesNeeded was rounded down to whole frames, so this stays within p
+	// and any trailing partial frame is left for the next call
+	for _, sample := range outBuffer {
+		n += y.format.putSample(p[n:], sample)
+	}
+
+	return n, err
+}
+
+// Crossfade starts mixing in the tune in data, fading the current tune out
+// and the new one in over d, after which the new tune replaces the old one
+func (y *YMPlayer) Crossfade(data []byte, d time.Duration) error {
+	next, err := NewYMPlayer(data, y.sampleRate, y.loop)
+	if err != nil {
+		return fmt.Errorf("failed to load crossfade tune: %w", err)
+	}
+
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	if y.next != nil {
+		y.next.Close() // Only the latest requested tune fades in
+	}
+	y.next = next
+	y.fadeSamples = max(durationToSamples(d, y.sampleRate), 1)
+	y.fadeDone = 0
+	return nil
+}
+
+// finishCrossfade replaces the current tune with the one faded in
+func (y *YMPlayer) finishCrossfade() {
+	if y.player != nil {
+		y.player.UnLoad()
+	}
+	y.player = y.next.player
+	y.position = y.next.position
+	y.totalSamples = y.next.totalSamples
+	y.loopStart = y.next.loopStart
+	y.replayHz = y.next.replayHz
+	y.interleave = y.next.interleave
+	y.info = y.next.info
+	y.passes = 0
+	y.next = nil
+}
+
+// SetLoopCount limits how often a looping tune restarts from now on: n > 0
+// plays it n more times after the current pass, 0 ends it after the current
+// pass, and n < 0 loops forever
+func (y *YMPlayer) SetLoopCount(n int) {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	y.loopCount = n
+	y.passes = 0
+}
+
+// VoiceState is a snapshot of one of the three YM2149 tone channels
+type VoiceState struct {
+	Volume   int  // Fixed volume, 0 to 15
+	Envelope bool // The volume follows the hardware envelope instead
+	Period   int  // 12-bit tone period; the pitch falls as it grows
+	ToneOn   bool // The square wave is enabled in the mixer
+}
+
+// voiceHistory is how many channel states are kept for Voices. States only
+// change at the tune's replay rate, so this spans seconds of output.
+const voiceHistory = 256
+
+// voiceSnapshot is the state of the three channels up to an output frame
+type voiceSnapshot struct {
+	end    int64 // Frames written when the state was last current
+	voices [3]VoiceState
+}
+
+// captureVoices reads the channel registers of the chip as they are once
+// end frames have been written, dropping the oldest state when full
+func (y *YMPlayer) captureVoices(end int64) {
+	var voices [3]VoiceState
+	mixer := y.player.ReadYmRegister(7)
+	for i := range voices {
+		vol := y.player.ReadYmRegister(8 + i)
+		voices[i] = VoiceState{
+			Volume:   vol & 0x0f,
+			Envelope: vol&0x10 != 0,
+			Period:   y.player.ReadYmRegister(2*i) | (y.player.ReadYmRegister(2*i+1)&0x0f)<<8,
+			ToneOn:   mixer&(1<<i) == 0,
+		}
+	}
+
+	if last := len(y.voices) - 1; last >= 0 && y.voices[last].voices == voices {
+		y.voices[last].end = end
+		return
+	}
+	if len(y.voices) == cap(y.voices) {
+		y.voices = append(y.voices[:0], y.voices[1:]...)
+	}
+	y.voices = append(y.voices, voiceSnapshot{end, voices})
+}
+
+// Voices returns the state of channels A, B and C in the output being heard
+// once played of it has come out of the speakers, as told by the audio
+// player's Position. Output still queued in the audio buffer is skipped, so
+// the state follows the sound rather than leading it.
+func (y *YMPlayer) Voices(played time.Duration) [3]VoiceState {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	frame := int64(durationToSamples(played, y.sampleRate))
+	for _, s := range y.voices {
+		if s.end > frame {
+			return s.voices
+		}
+	}
+	if len(y.voices) == 0 {
+		return [3]VoiceState{}
+	}
+	return y.voices[len(y.voices)-1].voices
+}
+
+// Peaks returns the peak levels of the left and right channels in the most
+// recent output, from 0 to 1
+func (y *YMPlayer) Peaks() (left, right float64) {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	return y.lastPeakL, y.lastPeakR
+}
+
+// Level returns the RMS level of the most recent output, from 0 to 1
+func (y *YMPlayer) Level() float64 {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	return y.level
+}
+
+// IsSilent reports whether the output has stayed below silenceThreshold for
+// at least the last windowMs milliseconds
+func (y *YMPlayer) IsSilent(windowMs int) bool {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	return y.quietSamples >= int64(windowMs)*int64(y.sampleRate)/1000
+}
+
+// errUnseekable is returned by Seek when the tune length is unknown
+var errUnseekable = errors.New("ym stream is not seekable: unknown length")
+
+// Seek implements io.Seeker
+func (y *YMPlayer) Seek(offset int64, whence int) (int64, error) {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	if y.totalSamples <= 0 {
+		return y.position, errUnseekable
+	}
+
+	var newPos int64
+	switch whence {
+	case io.SeekStart:
+		newPos = offset
+	case io.SeekCurrent:
+		newPos = y.position + offset
+	case io.SeekEnd:
+		newPos = y.totalSamples + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+
+	if newPos < 0 {
+		newPos = 0
+	}
+	if newPos > y.totalSamples {
+		newPos = y.totalSamples
+	}
+
+	y.position = newPos
+	if y.player != nil {
+		y.player.SetMusicTime(stsound.YmU32(newPos * 1000 / int64(y.sampleRate)))
+	}
+	return newPos, nil
+}
+
+// IntegratedLoudness returns the approximate integrated loudness of the
+// output so far in LUFS, or -Inf before enough audio has played
+func (y *YMPlayer) IntegratedLoudness() float64 {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	return y.loudness.integrated()
+}
+
+// CurrentTimeMs returns the playback position in milliseconds. While
+// scrubbing it returns the last requested target so the UI stays steady.
+func (y *YMPlayer) CurrentTimeMs() int64 {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	if y.scrubbing {
+		return y.scrubTargetMs
+	}
+	return y.position * 1000 / int64(y.sampleRate)
+}
+
+// Info returns the song details stored in the YM file
+func (y *YMPlayer) Info() stsound.YmMusicInfo {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	return y.info
+}
+
+// LengthMs returns the length of the tune in milliseconds, or 0 when the
+// file does not tell
+func (y *YMPlayer) LengthMs() int64 {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	return y.totalSamples * 1000 / int64(y.sampleRate)
+}
+
+// SetPositionMs moves playback to the given time in milliseconds; it does
+// nothing when the tune length is unknown
+func (y *YMPlayer) SetPositionMs(ms int64) {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	if y.totalSamples <= 0 {
+		return
+	}
+
+	pos := ms * int64(y.sampleRate) / 1000
+	if pos < 0 {
+		pos = 0
+	}
+	if pos > y.totalSamples {
+		pos = y.totalSamples
+	}
+
+	y.position = pos
+	y.scrubTargetMs = pos * 1000 / int64(y.sampleRate)
+	if y.player != nil {
+		y.player.SetMusicTime(stsound.YmU32(y.scrubTargetMs))
+	}
+}
+
+// BeginScrub starts scrubbing: CurrentTimeMs reports the target of the last
+// SetPositionMs call instead of the live position until EndScrub
+func (y *YMPlayer) BeginScrub() {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	y.scrubbing = true
+	y.scrubTargetMs = y.position * 1000 / int64(y.sampleRate)
+}
+
+// EndScrub resumes live position reporting
+func (y *YMPlayer) EndScrub() {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	y.scrubbing = false
+}
+
+// Close releases resources
+func (y *YMPlayer) Close() error {
+	y.mutex.Lock()
+	defer y.mutex.Unlock()
+
+	if y.player != nil {
+		y.player.UnLoad()
+		y.player = nil
+	}
+	if y.next != nil {
+		y.next.Close()
+		y.next = nil
+	}
+	y.checkFadeOut()
+	return nil
+}
+
+// CharMapping represents character position in font image
+type CharMapping struct {
+	x, y, width, height int
+	spacing             int  // Gap after the glyph, outside its source rect
+	blank               bool // Advances by width without drawing anything
+}
+
+// FontMap manages character mappings for a bitmap font
+type FontMap struct {
+	chars      map[rune]CharMapping
+	charWidth  int
+	charHeight int
+	tracking   int // Extra pixels after every character that takes room
+
+	// caseSensitive looks runes up as they are, falling back to uppercase
+	// only when the exact rune is missing; otherwise every rune is
+	// uppercased first, for sheets that only have capitals
+	caseSensitive bool
+
+	// missingGlyph stands in for characters the font lacks; 0 leaves a
+	// blank cell in their place
+	missingGlyph rune
+}
+
+// NewFontMap creates a font map with automatic character detection
+func NewFontMap(charWidth, charHeight int) *FontMap {
+	return &FontMap{
+		chars:      make(map[rune]CharMapping),
+		charWidth:  charWidth,
+		charHeight: charHeight,
+	}
+}
+
+// AddChar adds a character mapping
+func (fm *FontMap) AddChar(char rune, col, row int, width int) {
+	if width == 0 {
+		width = fm.charWidth
+	}
+	fm.chars[char] = CharMapping{
+		x:      col * fm.charWidth,
+		y:      row * fm.charHeight,
+		width:  width,
+		height: fm.charHeight,
+	}
+}
+
+// AddBlank maps a character to empty space of the given width, for spaces
+// and characters the font sheet lacks
+func (fm *FontMap) AddBlank(char rune, width int) {
+	fm.chars[char] = CharMapping{width: width, height: fm.charHeight, blank: true}
+}
+
+// glyphSpacing is the gap left after each glyph trimmed by AutoDetect
+const glyphSpacing = 2
+
+// AutoDetect trims every glyph to the opaque columns of its cell in img and
+// spaces it by glyphSpacing, so text using the map lays out proportionally.
+// Blank characters and empty cells keep their widths.
+func (fm *FontMap) AutoDetect(img image.Image) {
+	for char, m := range fm.chars {
+		if m.blank {
+			continue
+		}
+		left, right := -1, -1
+		for x := m.x; x < m.x+m.width; x++ {
+			for y := m.y; y < m.y+m.height; y++ {
+				if _, _, _, a := img.At(x, y).RGBA(); a != 0 {
+					if left < 0 {
+						left = x
+					}
+					right = x
+					break
+				}
+			}
+		}
+		if left < 0 {
+			continue
+		}
+		m.x, m.width, m.spacing = left, right-left+1, glyphSpacing
+		fm.chars[char] = m
+	}
+}
+
+// SetTracking sets the extra spacing added after every character, spaces
+// included; 0 keeps the font's own widths
+func (fm *FontMap) SetTracking(px int) {
+	fm.tracking = px
+}
+
+// SetCaseSensitive chooses whether lowercase runes use their own glyphs
+// when the font has them, rather than always being drawn uppercase
+func (fm *FontMap) SetCaseSensitive(on bool) {
+	fm.caseSensitive = on
+}
+
+// SetMissingGlyph chooses the character drawn in place of ones the font
+// lacks, such as '?'; 0 leaves a blank cell instead
+func (fm *FontMap) SetMissingGlyph(ch rune) {
+	fm.missingGlyph = ch
+}
+
+// lookup finds the mapping used for ch, returning the rune it is stored
+// under: the missing glyph for characters the font lacks, spaces aside.
+// Drawing and layout both go through it so they always agree.
+func (fm *FontMap) lookup(ch rune) (rune, CharMapping, bool) {
+	if r, mapping, ok := fm.mapped(ch); ok || ch == ' ' || fm.missingGlyph == 0 {
+		return r, mapping, ok
+	}
+	return fm.mapped(fm.missingGlyph)
+}
+
+// Has reports whether the font maps ch itself rather than standing in for it
+func (fm *FontMap) Has(ch rune) bool {
+	_, _, ok := fm.mapped(ch)
+	return ok
+}
+
+// mapped finds the font's own mapping for ch, honoring caseSensitive
+func (fm *FontMap) mapped(ch rune) (rune, CharMapping, bool) {
+	if fm.caseSensitive {
+		if mapping, ok := fm.chars[ch]; ok {
+			return ch, mapping, true
+		}
+	}
+	ch = unicode.ToUpper(ch)
+	mapping, ok := fm.chars[ch]
+	return ch, mapping, ok
+}
+
+// Advance returns how far a character moves the pen: its width, spacing
+// and the tracking, or the cell width plus the tracking when nothing maps it
+func (fm *FontMap) Advance(ch rune) int {
+	if _, mapping, ok := fm.lookup(ch); ok {
+		return mapping.width + mapping.spacing + fm.tracking
+	}
+	return fm.charWidth + fm.tracking
+}
+
+// Runes returns the sorted set of mapped runes
+func (fm *FontMap) Runes() []rune {
+	runes := make([]rune, 0, len(fm.chars))
+	for r := range fm.chars {
+		runes = append(runes, r)
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+	return runes
+}
+
+// Extent returns the size an image needs to hold every mapped glyph
+func (fm *FontMap) Extent() (width, height int) {
+	for _, m := range fm.chars {
+		if m.blank {
+			continue
+		}
+		if m.x+m.width > width {
+			width = m.x + m.width
+		}
+		if m.y+m.height > height {
+			height = m.y + m.height
+		}
+	}
+	return width, height
+}
+
+// checkFontImage reports whether a font image is large enough for its
+// FontMap, logging a warning naming the font if it is not
+func checkFontImage(name string, img *ebiten.Image, fm *FontMap) bool {
+	needW, needH := fm.Extent()
+	b := img.Bounds()
+	if b.Dx() < needW || b.Dy() < needH {
+		log.Printf("Warning: font %s image is %dx%d but its map needs %dx%d; glyphs will be clipped",
+			name, b.Dx(), b.Dy(), needW, needH)
+		return false
+	}
+	return true
+}
+
+// fontMapFile is the JSON layout of a font table: the cell size, the size
+// of the sheet the cells are cut from and one entry per character
+type fontMapFile struct {
+	CharWidth   int `json:"charWidth"`
+	CharHeight  int `json:"charHeight"`
+	ImageWidth  int `json:"imageWidth"`
+	ImageHeight int `json:"imageHeight"`
+
+	// CaseSensitive is set for sheets with their own lowercase glyphs
+	CaseSensitive bool `json:"caseSensitive"`
+	// MissingGlyph names the character drawn for ones the font lacks
+	MissingGlyph string `json:"missingGlyph"`
+
+	Chars []struct {
+		Char  string `json:"char"`
+		Col   int    `json:"col"`
+		Row   int    `json:"row"`
+		Width int    `json:"width"` // 0 means the cell width
+		Blank bool   `json:"blank"` // No graphic, only advances by width
+	} `json:"chars"`
+}
+
+// LoadFontMap builds a font map from a JSON font table, checking that every
+// glyph lies within the font image the table describes
+func LoadFontMap(data []byte) (*FontMap, error) {
+	var file fontMapFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse font table: %w", err)
+	}
+	if file.CharWidth <= 0 || file.CharHeight <= 0 {
+		return nil, fmt.Errorf("invalid font cell size %dx%d", file.CharWidth, file.CharHeight)
+	}
+	if file.ImageWidth < file.CharWidth || file.ImageHeight < file.CharHeight {
+		return nil, fmt.Errorf("font image %dx%d cannot hold a %dx%d cell",
+			file.ImageWidth, file.ImageHeight, file.CharWidth, file.CharHeight)
+	}
+
+	fm := NewFontMap(file.CharWidth, file.CharHeight)
+	fm.SetCaseSensitive(file.CaseSensitive)
+	if file.MissingGlyph != "" {
+		if utf8.RuneCountInString(file.MissingGlyph) != 1 {
+			return nil, fmt.Errorf("missing glyph %q must be a single character", file.MissingGlyph)
+		}
+		missing, _ := utf8.DecodeRuneInString(file.MissingGlyph)
+		fm.SetMissingGlyph(missing)
+	}
+	cols, rows := file.ImageWidth/file.CharWidth, file.ImageHeight/file.CharHeight
+	for i, c := range file.Chars {
+		if utf8.RuneCountInString(c.Char) != 1 {
+			return nil, fmt.Errorf("font entry %d: char %q must be a single character", i, c.Char)
+		}
+		char, _ := utf8.DecodeRuneInString(c.Char)
+		if _, dup := fm.chars[char]; dup {
+			return nil, fmt.Errorf("font entry %d: char %q is mapped twice", i, c.Char)
+		}
+		if c.Width < 0 {
+			return nil, fmt.Errorf("font entry %d: char %q has negative width %d", i, c.Char, c.Width)
+		}
+		width := c.Width
+		if width == 0 {
+			width = file.CharWidth
+		}
+		if c.Blank {
+			fm.AddBlank(char, width)
+			continue
+		}
+		if c.Col < 0 || c.Col >= cols || c.Row < 0 || c.Row >= rows {
+			return nil, fmt.Errorf("font entry %d: char %q at col %d row %d is outside the %dx%d grid of the %dx%d image",
+				i, c.Char, c.Col, c.Row, cols, rows, file.ImageWidth, file.ImageHeight)
+		}
+		if right := c.Col*file.CharWidth + width; right > file.ImageWidth {
+			return nil, fmt.Errorf("font entry %d: char %q is %d wide and runs past the image edge at x=%d",
+				i, c.Char, width, file.ImageWidth)
+		}
+		fm.AddChar(char, c.Col, c.Row, width)
+	}
+	return fm, nil
+}
+
+// mustLoadFontMap parses one of the font tables compiled into the binary,
+// where a bad table is a build mistake rather than a runtime condition
+func mustLoadFontMap(name string, data []byte) *FontMap {
+	fm, err := LoadFontMap(data)
+	if err != nil {
+		panic(fmt.Sprintf("embedded font table %s: %v", name, err))
+	}
+	return fm
+}
+
+// InitBigScrollFont initializes the big scroll font (24x33)
+func initBigScrollFont() *FontMap {
+	return mustLoadFontMap("bsfont.json", bsFontMapData)
+}
+
+// InitUpScrollFont initializes the vertical scroll font (33x29)
+func initUpScrollFont() *FontMap {
+	return mustLoadFontMap("upfonts.json", upFontMapData)
+}
+
+// InitSmallFont initializes the small font (8x8)
+func initSmallFont() *FontMap {
+	return mustLoadFontMap("lfont.json", lFontMapData)
+}
+
+// envelope is an attack/release follower smoothing a jittery input such as
+// the music level. Rises take about attack to settle and falls release.
+type envelope struct {
+	value   float64
+	attack  time.Duration
+	release time.Duration
+}
+
+// Step moves the envelope towards input over a time step of dt
+func (e *envelope) Step(input float64, dt time.Duration) float64 {
+	tau := e.release
+	if input > e.value {
+		tau = e.attack
+	}
+	if tau <= 0 {
+		e.value = input
+	} else {
+		e.value += (input - e.value) * (1 - math.Exp(-dt.Seconds()/tau.Seconds()))
+	}
+	return e.value
+}
+
+// bgTransition is the state machine crossfading between background schemes
+type bgTransition struct {
+	from, to int
+	frame    int
+	frames   int
+	active   bool
+}
+
+// Start begins fading from one scheme to another over the given frames
+func (t *bgTransition) Start(from, to, frames int) {
+	t.from = from
+	t.to = to
+	t.frame = 0
+	t.frames = frames
+	t.active = frames > 0
+}
+
+// Step advances the fade by one frame, ending it once fully faded in
+func (t *bgTransition) Step() {
+	if !t.active {
+		return
+	}
+	t.frame++
+	if t.frame >= t.frames {
+		t.active = false
+	}
+}
+
+// Alpha returns the opacity of the incoming scheme, from 0 to 1
+func (t *bgTransition) Alpha() float64 {
+	if !t.active {
+		return 1
+	}
+	return float64(t.frame) / float64(t.frames)
+}
+
+// cameraPath pans smoothly between waypoints across the background extent
+type cameraPath struct {
+	// Waypoints as fractions of the pannable range, (0,0) being the
+	// top-left of the background and (1,1) the bottom-right
+	points        [][2]float64
+	segmentFrames int
+	frame         int
+}
+
+// newCameraPath creates a camera touring the corners of the background
+func newCameraPath(segmentFrames int) *cameraPath {
+	if segmentFrames < 1 {
+		segmentFrames = 1
+	}
+	return &cameraPath{
+		points:        [][2]float64{{0, 0}, {1, 0}, {1, 1}, {0, 1}, {0.5, 0.5}},
+		segmentFrames: segmentFrames,
+	}
+}
+
+// Step advances the camera by one frame, looping over the waypoints
+func (c *cameraPath) Step() {
+	c.frame = (c.frame + 1) % (len(c.points) * c.segmentFrames)
+}
+
+// Offset returns the background translation for the current frame, easing
+// between waypoints; the result stays within [-rangeX, 0] x [-rangeY, 0]
+func (c *cameraPath) Offset(rangeX, rangeY float64) (x, y float64) {
+	seg := c.frame / c.segmentFrames
+	from := c.points[seg]
+	to := c.points[(seg+1)%len(c.points)]
+
+	t := float64(c.frame%c.segmentFrames) / float64(c.segmentFrames)
+	t = t * t * (3 - 2*t) // Smoothstep easing
+
+	fx := from[0] + (to[0]-from[0])*t
+	fy := from[1] + (to[1]-from[1])*t
+	return -fx * rangeX, -fy * rangeY
+}
+
+// confettiColors is the palette the confetti quads are drawn in
+var confettiColors = []color.RGBA{
+	{0xff, 0x40, 0x40, 0xff}, {0xff, 0xc0, 0x20, 0xff}, {0x40, 0xe0, 0x40, 0xff},
+	{0x40, 0xa0, 0xff, 0xff}, {0xc0, 0x60, 0xff, 0xff}, {0xff, 0xff, 0xff, 0xff},
+}
+
+// particle is one confetti quad
+type particle struct {
+	x, y   float64
+	vx, vy float64
+	clr    color.RGBA
+}
+
+// confetti is a bounded particle system of falling colored quads
+type confetti struct {
+	particles []particle
+	max       int
+	spawnAcc  float64 // Fractional particles owed to the spawn rate
+	rng       *rand.Rand
+}
+
+// newRand returns the random source for the effects, seeded from the clock
+// when seed is zero
+func newRand(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// newConfetti creates a particle system holding at most max particles
+func newConfetti(max int, rng *rand.Rand) *confetti {
+	return &confetti{
+		particles: make([]particle, 0, max),
+		max:       max,
+		rng:       rng,
+	}
+}
+
+// Update advances the particles by dt seconds, spawning new ones along the
+// top edge while spawning is set and dropping those below the bottom
+func (c *confetti) Update(dt float64, spawning bool, width, height float64) {
+	if spawning {
+		c.spawnAcc += confettiRate * dt
+		for ; c.spawnAcc >= 1 && len(c.particles) < c.max; c.spawnAcc-- {
+			c.particles = append(c.particles, particle{
+				x:   c.rng.Float64() * width,
+				y:   -confettiSize,
+				vx:  (c.rng.Float64() - 0.5) * 40,
+				vy:  c.rng.Float64() * 40,
+				clr: confettiColors[c.rng.Intn(len(confettiColors))],
+			})
+		}
+		if len(c.particles) >= c.max {
+			c.spawnAcc = 0
+		}
+	}
+
+	alive := c.particles[:0]
+	for _, p := range c.particles {
+		p.vy += confettiGravity * dt
+		p.vx += confettiWind * dt
+		p.x += p.vx * dt
+		p.y += p.vy * dt
+		if p.y < height {
+			alive = append(alive, p)
+		}
+	}
+	c.particles = alive
+}
+
+// filmGrain is an animated noise overlay, regenerated every step from its
+// own random source
+type filmGrain struct {
+	rng   *rand.Rand
+	pix   []byte // RGBA pixels of the current noise frame
+	img   *ebiten.Image
+	dirty bool // Set when pix changed since it was last uploaded to img
+}
+
+// newFilmGrain creates a grain overlay with a first noise frame
+func newFilmGrain(rng *rand.Rand) *filmGrain {
+	f := &filmGrain{rng: rng, pix: make([]byte, 4*grainSize*grainSize)}
+	f.Step()
+	return f
+}
+
+// fillGrain fills RGBA pixels with opaque grey noise from rng
+func fillGrain(pix []byte, rng *rand.Rand) {
+	for i := 0; i+3 < len(pix); i += 4 {
+		v := byte(rng.Intn(256))
+		pix[i], pix[i+1], pix[i+2], pix[i+3] = v, v, v, 0xff
+	}
+}
+
+// Step generates the next noise frame
+func (f *filmGrain) Step() {
+	fillGrain(f.pix, f.rng)
+	f.dirty = true
+}
+
+// Draw tiles the current noise frame over dst at low opacity
+func (f *filmGrain) Draw(dst *ebiten.Image) {
+	if f.img == nil {
+		f.img = ebiten.NewImage(grainSize, grainSize)
+	}
+	if f.dirty {
+		f.img.WritePixels(f.pix)
+		f.dirty = false
+	}
+
+	b := dst.Bounds()
+	op := &ebiten.DrawImageOptions{}
+	op.ColorScale.ScaleAlpha(grainAlpha)
+	for y := 0; y < b.Dy(); y += 2 * grainSize {
+		for x := 0; x < b.Dx(); x += 2 * grainSize {
+			op.GeoM.Reset()
+			op.GeoM.Scale(2, 2)
+			op.GeoM.Translate(float64(x), float64(y))
+			dst.DrawImage(f.img, op)
+		}
+	}
+}
+
+// gifRecorder accumulates frames in memory up to a cap and writes them as an
+// animated GIF
+type gifRecorder struct {
+	frames    []*image.Paletted
+	size      int // Bytes held by the recorded frames
+	maxFrames int
+	maxBytes  int
+	capped    bool // Set once a cap stopped the recording
+}
+
+// newGIFRecorder creates a recorder holding at most maxFrames frames and
+// maxBytes bytes of pixel data
+func newGIFRecorder(maxFrames, maxBytes int) *gifRecorder {
+	return &gifRecorder{maxFrames: maxFrames, maxBytes: maxBytes}
+}
+
+// Append adds a frame unless that would exceed a cap; it returns false once
+// the recording is full
+func (r *gifRecorder) Append(frame *image.Paletted) bool {
+	if r.capped {
+		return false
+	}
+	if len(r.frames) >= r.maxFrames || r.size+len(frame.Pix) > r.maxBytes {
+		r.capped = true
+		return false
+	}
+	r.frames = append(r.frames, frame)
+	r.size += len(frame.Pix)
+	return true
+}
+
+// Write encodes the recorded frames as a looping GIF
+func (r *gifRecorder) Write(w io.Writer) error {
+	anim := &gif.GIF{
+		Image: r.frames,
+		Delay: make([]int, len(r.frames)),
+	}
+	for i := range anim.Delay {
+		anim.Delay[i] = recordDelay
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// ScrollText manages scrolling text
+type ScrollText struct {
+	text     string
+	glyphs   GlyphRenderer
+	scrollX  float64
+	speed    float64
+	vertical bool // For vertical scrolling
+
+	lineSpacing float64 // Extra gap between vertical characters, in font pixels
+
+	// Viewport the text scrolls across, used for culling and wrap-around
+	viewWidth  float64
+	viewHeight float64
+
+	triggers []*wordTrigger
+
+	// Pre-rendered horizontal text, split into tiles of tileWidth pixels
+	tiles     []*ebiten.Image
+	tileWidth int
+
+	// Cached layout of the text, valid until the text changes: the byte
+	// offset of every character and the width of the text before it, each
+	// with a final entry for the end of the text, and the number of
+	// characters taking room, which is the line count of vertical text
+	charStarts  []int
+	prefix      []int
+	lines       int
+	layoutValid bool
+
+	// Speed ramps up from 0 over rampFrames updates after start or SetText
+	rampFrames int
+	rampFrame  int
+
+	// Display scales of marked sections of the text
+	sections []scrollSection
+
+	// Vertical sine wobble of horizontal text: each character is offset by
+	// waveAmplitude * sin(waveFrequency * index + wavePhase)
+	waveAmplitude float64
+	waveFrequency float64
+	wavePhase     float64
+
+	// Color cycling: while tintEnabled the glyphs are multiplied by tint,
+	// whose hue moves tintStep degrees per update
+	tint        color.RGBA
+	tintEnabled bool
+	tintHue     float64
+	tintStep    float64
+}
+
+// scrollSection gives the display scale of the text from byte offset start
+// up to the next section
+type scrollSection struct {
+	start int
+	scale float64
+}
+
+// parseScrollSections strips "{scale}" markers such as "{0.75}" from text,
+// returning the plain text and the sections they start. Text before the
+// first marker has scale 1.
+func parseScrollSections(text string) (string, []scrollSection) {
+	var b strings.Builder
+	var sections []scrollSection
+	for {
+		open := strings.IndexByte(text, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(text[open:], '}')
+		if end < 0 {
+			break
+		}
+		scale, err := strconv.ParseFloat(text[open+1:open+end], 64)
+		if err != nil || scale <= 0 {
+			// Not a marker, keep it as text
+			b.WriteString(text[:open+end+1])
+			text = text[open+end+1:]
+			continue
+		}
+		b.WriteString(text[:open])
+		sections = append(sections, scrollSection{start: b.Len(), scale: scale})
+		text = text[open+end+1:]
+	}
+	b.WriteString(text)
+	return b.String(), sections
+}
+
+// sectionScale returns the scale of the section containing byte offset pos
+func sectionScale(sections []scrollSection, pos int) float64 {
+	scale := 1.0
+	for _, sec := range sections {
+		if sec.start > pos {
+			break
+		}
+		scale = sec.scale
+	}
+	return scale
+}
+
+// MissingRunes returns, sorted, the characters of the text that the font
+// lacks and shows as its missing glyph or a blank cell
+func (s *ScrollText) MissingRunes() []rune {
+	seen := make(map[rune]bool)
+	var missing []rune
+	for _, ch := range s.text {
+		if seen[ch] {
+			continue
+		}
+		seen[ch] = true
+		if ch != ' ' && !s.glyphs.Mapped(ch) {
+			missing = append(missing, ch)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	return missing
+}
+
+// CenterScale returns the section scale of the character at the centre of
+// a horizontal scroll's viewport
+func (s *ScrollText) CenterScale() float64 {
+	if len(s.sections) == 0 {
+		return 1
+	}
+	i := s.firstCharAfter(s.viewWidth/2 - s.scrollX)
+	if i == len(s.charStarts)-1 {
+		return 1 // Nothing at the centre
+	}
+	return sectionScale(s.sections, s.charStarts[i])
+}
+
+// tileSpan is the part of one pre-rendered tile that is visible on screen
+type tileSpan struct {
+	tile  int
+	srcX0 int // Visible range within the tile
+	srcX1 int
+	dstX  float64 // Where the range lands in the viewport
+}
+
+// visibleTileSpans returns the tile ranges covering the viewport for a
+// text of totalWidth pixels split into tiles of tileWidth, at scrollX
+func visibleTileSpans(scrollX, viewWidth float64, tileWidth, totalWidth int) []tileSpan {
+	// Visible part of the text, in text coordinates
+	start := int(math.Floor(-scrollX))
+	end := int(math.Ceil(-scrollX + viewWidth))
+	if start < 0 {
+		start = 0
+	}
+	if end > totalWidth {
+		end = totalWidth
+	}
+
+	var spans []tileSpan
+	for x := start; x < end; {
+		tile := x / tileWidth
+		tileEnd := min((tile+1)*tileWidth, end)
+		spans = append(spans, tileSpan{
+			tile:  tile,
+			srcX0: x - tile*tileWidth,
+			srcX1: tileEnd - tile*tileWidth,
+			dstX:  scrollX + float64(x),
+		})
+		x = tileEnd
+	}
+	return spans
+}
+
+// wordTrigger fires a callback when an occurrence of a word scrolls into view
+type wordTrigger struct {
+	word    string
+	spans   [][2]int // Byte ranges of each occurrence in the text
+	visible []bool   // Whether each occurrence was visible last update
+	fn      func()
+}
+
+// NewScrollText creates a new scrolling text
+func NewScrollText(text string, fontImg *ebiten.Image, fontMap *FontMap, speed float64, vertical bool) *ScrollText {
+	return NewScrollTextWithRenderer(text, &bitmapGlyphs{img: fontImg, fontMap: fontMap}, speed, vertical)
+}
+
+// NewScrollTextWithRenderer creates a scroll text drawn by the given glyph renderer
+func NewScrollTextWithRenderer(text string, glyphs GlyphRenderer, speed float64, vertical bool) *ScrollText {
+	text, sections := parseScrollSections(text)
+	return &ScrollText{
+		text:     text,
+		sections: sections,
+		glyphs:   glyphs,
+		speed:    speed,
+		vertical: vertical,
+
+		viewWidth:  screenWidth,
+		viewHeight: screenHeight,
+	}
+}
+
+// SetViewport sets the size of the area the text scrolls across
+func (s *ScrollText) SetViewport(width, height float64) {
+	s.viewWidth = width
+	s.viewHeight = height
+}
+
+// SetLineSpacing sets the extra gap between vertical characters; negative
+// values tighten the column
+func (s *ScrollText) SetLineSpacing(spacing float64) {
+	s.lineSpacing = spacing
+}
+
+// verticalStride returns the vertical advance between characters
+func (s *ScrollText) verticalStride(scale float64) float64 {
+	return (float64(s.glyphs.LineHeight()) + s.lineSpacing) * scale
+}
+
+// verticalCharY returns the top of the index-th line of vertical text; the
+// first line enters at the bottom of the viewport
+func (s *ScrollText) verticalCharY(index int, scale float64) float64 {
+	return s.viewHeight - s.scrollX + float64(index)*s.verticalStride(scale)
+}
+
+// verticalResetBoundary returns the scroll offset past which vertical text
+// has completely left the top of the viewport
+func (s *ScrollText) verticalResetBoundary() float64 {
+	return s.contentHeight() + s.viewHeight
+}
+
+// contentHeight returns the unscaled height of vertical text: one line per
+// character that takes room. Characters the font lacks take a line, drawn
+// as the missing glyph or left blank, as they take a cell in horizontal
+// text; only characters with no advance are skipped.
+func (s *ScrollText) contentHeight() float64 {
+	s.layout()
+	return float64(s.lines) * s.verticalStride(1)
+}
+
+// Update updates the scroll position
+func (s *ScrollText) Update() {
+	if s.tintEnabled {
+		s.tintHue = math.Mod(s.tintHue+s.tintStep, 360)
+		s.tint = hsvColor(s.tintHue, 1, 1)
+	}
+
 	if s.vertical {
 		s.scrollX += s.speed // Move up (positive direction)
 		// For vertical scroll, reset when text has completely scrolled off top
-		totalHeight := float64(len(s.text) * s.fontMap.charHeight)
-		if s.scrollX > totalHeight+400 {
-			s.scrollX = -100 // Start from below screen
+		if s.scrollX > s.verticalResetBoundary() {
+			s.scrollX = -scrollRestartGap // Start from below screen
+		}
+	} else {
+		s.scrollX -= s.currentSpeed()
+		if s.rampFrame < s.rampFrames {
+			s.rampFrame++
+		}
+		if s.waveAmplitude != 0 {
+			s.wavePhase = math.Mod(s.wavePhase+wavePhaseStep, 2*math.Pi)
+		}
+		if s.scrollX < -float64(s.textWidth()) {
+			s.scrollX = s.viewWidth
+		}
+
+		s.checkTriggers()
+	}
+}
+
+// SetWave makes each character of horizontal text bob up and down by up to
+// amplitude pixels, neighbours frequency radians apart; zero amplitude keeps
+// the text flat
+func (s *ScrollText) SetWave(amplitude, frequency float64) {
+	s.waveAmplitude = amplitude
+	s.waveFrequency = frequency
+}
+
+// SetTint turns color cycling of the glyphs on or off, sweeping the hue
+// step degrees per update; off draws them in the font's own colors
+func (s *ScrollText) SetTint(enabled bool, step float64) {
+	s.tintEnabled = enabled
+	s.tintStep = step
+	s.tint = hsvColor(s.tintHue, 1, 1)
+}
+
+// tintScale returns the color scale glyphs are drawn with, the identity
+// unless tinting is on
+func (s *ScrollText) tintScale() ebiten.ColorScale {
+	var cs ebiten.ColorScale
+	if s.tintEnabled {
+		cs.ScaleWithColor(s.tint)
+	}
+	return cs
+}
+
+// waveOffset returns the vertical offset of the index-th character
+func (s *ScrollText) waveOffset(index int) float64 {
+	return s.waveAmplitude * math.Sin(s.waveFrequency*float64(index)+s.wavePhase)
+}
+
+// OnWordVisible registers fn to be called each time an occurrence of word
+// scrolls into view. Only horizontal scroll texts fire triggers.
+func (s *ScrollText) OnWordVisible(word string, fn func()) {
+	if word == "" {
+		return
+	}
+
+	t := &wordTrigger{word: word, fn: fn}
+	t.locate(s.text)
+	s.triggers = append(s.triggers, t)
+}
+
+// locate finds every occurrence of the trigger's word in text
+func (t *wordTrigger) locate(text string) {
+	t.spans = t.spans[:0]
+	for offset := 0; ; {
+		i := strings.Index(text[offset:], t.word)
+		if i < 0 {
+			break
+		}
+		start := offset + i
+		t.spans = append(t.spans, [2]int{start, start + len(t.word)})
+		offset = start + len(t.word)
+	}
+	t.visible = make([]bool, len(t.spans))
+}
+
+// checkTriggers fires the word triggers whose words just became visible
+func (s *ScrollText) checkTriggers() {
+	if len(s.triggers) == 0 {
+		return
+	}
+
+	start, end := s.VisibleRange()
+	for _, t := range s.triggers {
+		for i, span := range t.spans {
+			visible := span[0] < end && span[1] > start
+			if visible && !t.visible[i] {
+				t.fn()
+			}
+			t.visible[i] = visible
+		}
+	}
+}
+
+// scrollLogger writes each word of a horizontal scroll as it enters the
+// viewport, stamped with the music position, to help time the text
+type scrollLogger struct {
+	w    io.Writer
+	last int // End of the visible range at the previous check
+}
+
+// Check logs the words that scrolled into view since the previous call
+func (l *scrollLogger) Check(s *ScrollText, musicMs int64) {
+	_, end := s.VisibleRange()
+	if end < l.last {
+		l.last = 0 // The text wrapped around
+	}
+
+	for i := l.last; i < end; i++ {
+		if s.text[i] == ' ' || (i > 0 && s.text[i-1] != ' ') {
+			continue
+		}
+		word := s.text[i:]
+		if j := strings.IndexByte(word, ' '); j >= 0 {
+			word = word[:j]
+		}
+		fmt.Fprintf(l.w, "%s %s\n", formatMs(musicMs), word)
+	}
+	l.last = end
+}
+
+// formatMs formats a duration in milliseconds as mm:ss.mmm
+func formatMs(ms int64) string {
+	return fmt.Sprintf("%02d:%02d.%03d", ms/60000, ms/1000%60, ms%1000)
+}
+
+// SetSpeedRamp makes the text ease in from standstill to full speed over the
+// given number of updates, starting now; 0 starts at full speed
+func (s *ScrollText) SetSpeedRamp(frames int) {
+	s.rampFrames = frames
+	s.rampFrame = 0
+}
+
+// currentSpeed returns the scroll speed, eased in during the start ramp
+func (s *ScrollText) currentSpeed() float64 {
+	if s.rampFrame >= s.rampFrames {
+		return s.speed
+	}
+	t := float64(s.rampFrame) / float64(s.rampFrames)
+	return s.speed * t * t * (3 - 2*t)
+}
+
+// SetText replaces the scrolling text, refreshing everything derived from it
+func (s *ScrollText) SetText(text string) {
+	s.text, s.sections = parseScrollSections(text)
+	s.rampFrame = 0
+	s.layoutValid = false
+	for _, t := range s.triggers {
+		t.locate(s.text)
+	}
+	if s.tiles != nil {
+		for _, tile := range s.tiles {
+			tile.Deallocate()
+		}
+		s.tiles = nil
+		s.Prerender(s.tileWidth)
+	}
+}
+
+// layout computes the character offsets and prefix widths of the text,
+// only once per text
+func (s *ScrollText) layout() {
+	if s.layoutValid {
+		return
+	}
+	s.charStarts = s.charStarts[:0]
+	s.prefix = s.prefix[:0]
+	s.lines = 0
+	width := 0
+	for i, ch := range s.text {
+		s.charStarts = append(s.charStarts, i)
+		s.prefix = append(s.prefix, width)
+		advance := s.charAdvance(ch)
+		if advance > 0 {
+			s.lines++
+		}
+		width += advance
+	}
+	s.charStarts = append(s.charStarts, len(s.text))
+	s.prefix = append(s.prefix, width)
+	s.layoutValid = true
+}
+
+// textWidth returns the total width of the text in font pixels
+func (s *ScrollText) textWidth() int {
+	s.layout()
+	return s.prefix[len(s.prefix)-1]
+}
+
+// firstCharAfter returns the index of the first character whose right edge
+// lies past offset font pixels into the text, or the character count when
+// none does
+func (s *ScrollText) firstCharAfter(offset float64) int {
+	s.layout()
+	n := len(s.prefix) - 1
+	return sort.Search(n, func(i int) bool { return float64(s.prefix[i+1]) > offset })
+}
+
+// firstCharFrom returns the index of the first character whose left edge
+// lies at or past offset font pixels into the text, or the character count
+// when none does
+func (s *ScrollText) firstCharFrom(offset float64) int {
+	s.layout()
+	n := len(s.prefix) - 1
+	return sort.Search(n, func(i int) bool { return float64(s.prefix[i]) >= offset })
+}
+
+// charAdvance returns the horizontal advance of a character in font pixels
+func (s *ScrollText) charAdvance(ch rune) int {
+	return s.glyphs.Advance(ch)
+}
+
+// VisibleRange returns the byte offsets [start, end) of the characters of a
+// horizontal scroll that are at least partly inside the viewport. start
+// equals end when nothing is visible.
+func (s *ScrollText) VisibleRange() (start, end int) {
+	first := s.firstCharAfter(-s.scrollX)
+	last := s.firstCharFrom(s.viewWidth-s.scrollX) - 1
+
+	// Characters taking no room are not visible at either end
+	for first <= last && s.prefix[first+1] == s.prefix[first] {
+		first++
+	}
+	for last >= first && s.prefix[last+1] == s.prefix[last] {
+		last--
+	}
+	if first > last {
+		return 0, 0
+	}
+	return s.charStarts[first], s.charStarts[last+1]
+}
+
+// FullyVisibleText returns the characters of a horizontal scroll that are
+// entirely inside the viewport, leaving out glyphs cut by its edges, with
+// surrounding spaces trimmed
+func (s *ScrollText) FullyVisibleText() string {
+	first := s.firstCharFrom(-s.scrollX)
+	end := s.firstCharAfter(s.viewWidth - s.scrollX)
+	if first >= end {
+		return ""
+	}
+	return strings.TrimSpace(s.text[s.charStarts[first]:s.charStarts[end]])
+}
+
+// Prerender draws the whole horizontal text once into wide tiles so Draw
+// only has to blit the visible window each frame
+func (s *ScrollText) Prerender(tileWidth int) {
+	if s.vertical {
+		return
+	}
+
+	totalWidth := s.textWidth()
+	if totalWidth == 0 {
+		return
+	}
+
+	s.tileWidth = tileWidth
+	s.tiles = make([]*ebiten.Image, (totalWidth+tileWidth-1)/tileWidth)
+	for i := range s.tiles {
+		s.tiles[i] = ebiten.NewImage(tileWidth, s.glyphs.LineHeight())
+	}
+
+	x := 0
+	for _, ch := range s.text {
+		advance := s.charAdvance(ch)
+		if s.glyphs.HasGlyph(ch) && advance > 0 {
+			// A glyph crossing a tile edge is drawn into both tiles
+			for t := x / tileWidth; t <= (x+advance-1)/tileWidth; t++ {
+				s.glyphs.DrawGlyph(s.tiles[t], ch, float64(x-t*tileWidth), 0, 1, ebiten.ColorScale{})
+			}
+		}
+		x += advance
+	}
+}
+
+// drawPrerendered blits the visible window of the pre-rendered tiles
+func (s *ScrollText) drawPrerendered(dst *ebiten.Image, y, scale float64) {
+	// Work in unscaled text pixels, then scale the result
+	for _, span := range visibleTileSpans(s.scrollX/scale, s.viewWidth/scale, s.tileWidth, s.textWidth()) {
+		src := image.Rect(span.srcX0, 0, span.srcX1, s.glyphs.LineHeight())
+		op := &ebiten.DrawImageOptions{}
+		op.GeoM.Translate(span.dstX, 0)
+		op.GeoM.Scale(scale, scale)
+		op.GeoM.Translate(0, y)
+		op.ColorScale = s.tintScale()
+		dst.DrawImage(s.tiles[span.tile].SubImage(src).(*ebiten.Image), op)
+	}
+}
+
+// Draw draws the scrolling text
+func (s *ScrollText) Draw(dst *ebiten.Image, y float64, scale float64) {
+	// Pre-rendered tiles are flat, so a waving text draws glyph by glyph
+	if !s.vertical && s.tiles != nil && s.waveAmplitude == 0 {
+		s.drawPrerendered(dst, y, scale)
+		return
+	}
+
+	if s.vertical {
+		// Vertical scrolling - the column moves from bottom to top, so the
+		// first character leads at the top and the rest follow below it,
+		// reading top-to-bottom in text order
+		stride := s.verticalStride(scale)
+		index := 0
+		for _, char := range s.text {
+			if s.charAdvance(char) == 0 {
+				continue // Takes no line, matching contentHeight
+			}
+			yPos := s.verticalCharY(index, scale)
+			if yPos >= s.viewHeight {
+				break // This and all following characters are still below
+			}
+			if yPos > -stride {
+				s.drawChar(dst, char, 0, yPos, scale)
+			}
+			index++
+		}
+	} else {
+		// Horizontal scrolling, skipping straight to the first character
+		// not yet scrolled off the left edge
+		first := s.firstCharAfter(-s.scrollX / scale)
+		x := s.scrollX + float64(s.prefix[first])*scale
+		index := first
+		for _, char := range s.text[s.charStarts[first]:] {
+			if x >= s.viewWidth {
+				break // This and all following characters are still to come
+			}
+			advance := float64(s.charAdvance(char)) * scale
+			if s.glyphs.HasGlyph(char) && x > -advance {
+				charY := y
+				if s.waveAmplitude != 0 {
+					charY += s.waveOffset(index) * scale
+				}
+				s.drawChar(dst, char, x, charY, scale)
+			}
+			x += advance
+			index++
+		}
+	}
+}
+
+// drawChar draws a single character, tinted when color cycling is on
+func (s *ScrollText) drawChar(dst *ebiten.Image, char rune, x, y, scale float64) {
+	s.glyphs.DrawGlyph(dst, char, x, y, scale, s.tintScale())
+}
+
+// GlyphRenderer lays out and draws the characters of a scroll text, keeping
+// ScrollText independent of how glyphs are stored. Metrics are in unscaled
+// font pixels.
+type GlyphRenderer interface {
+	HasGlyph(ch rune) bool // Whether ch has anything to draw
+	Mapped(ch rune) bool   // Whether the font has ch rather than a stand-in
+	Advance(ch rune) int   // Horizontal space taken by ch
+	LineHeight() int       // Height of a line of text
+	DrawGlyph(dst *ebiten.Image, ch rune, x, y, scale float64, clr ebiten.ColorScale)
+}
+
+// bitmapGlyphs renders characters from a bitmap font sheet
+type bitmapGlyphs struct {
+	img     *ebiten.Image
+	fontMap *FontMap
+
+	// Per-glyph sub-images and draw options reused across frames, so the
+	// hot path allocates nothing per glyph
+	subImages map[rune]*ebiten.Image
+	op        ebiten.DrawImageOptions
+}
+
+// HasGlyph reports whether the font sheet has a visible glyph for ch
+func (b *bitmapGlyphs) HasGlyph(ch rune) bool {
+	_, mapping, ok := b.fontMap.lookup(ch)
+	return ok && !mapping.blank
+}
+
+// Mapped reports whether the font map has ch itself
+func (b *bitmapGlyphs) Mapped(ch rune) bool {
+	return b.fontMap.Has(ch)
+}
+
+// Advance returns the font map advance of ch
+func (b *bitmapGlyphs) Advance(ch rune) int {
+	return b.fontMap.Advance(ch)
+}
+
+// LineHeight returns the font cell height
+func (b *bitmapGlyphs) LineHeight() int {
+	return b.fontMap.charHeight
+}
+
+// DrawGlyph draws ch from the font sheet, uppercased unless the font is
+// case sensitive and has the exact rune
+func (b *bitmapGlyphs) DrawGlyph(dst *ebiten.Image, ch rune, x, y, scale float64, clr ebiten.ColorScale) {
+	ch, mapping, ok := b.fontMap.lookup(ch)
+	if !ok || mapping.blank {
+		return // Nothing to draw
+	}
+
+	sub, ok := b.subImages[ch]
+	if !ok {
+		if b.subImages == nil {
+			b.subImages = make(map[rune]*ebiten.Image)
+		}
+		sub = b.img.SubImage(image.Rect(mapping.x, mapping.y, mapping.x+mapping.width, mapping.y+mapping.height)).(*ebiten.Image)
+		b.subImages[ch] = sub
+	}
+
+	b.op.GeoM.Reset()
+	b.op.GeoM.Scale(scale, scale)
+	b.op.GeoM.Translate(x, y)
+	b.op.ColorScale = clr
+	dst.DrawImage(sub, &b.op)
+}
+
+// drawGlyph draws the glyph described by mapping from a font image
+func drawGlyph(dst, fontImg *ebiten.Image, mapping CharMapping, x, y, scale float64) {
+	if mapping.blank {
+		return
+	}
+	srcRect := image.Rect(mapping.x, mapping.y, mapping.x+mapping.width, mapping.y+mapping.height)
+
+	op := &ebiten.DrawImageOptions{}
+	op.GeoM.Scale(scale, scale)
+	op.GeoM.Translate(x, y)
+
+	dst.DrawImage(fontImg.SubImage(srcRect).(*ebiten.Image), op)
+}
+
+// Font preview layout
+const (
+	previewMargin     = 8
+	previewLabelSpace = 16 // Room for the rune label below each glyph
+)
+
+// glyphGrid computes how many columns and rows are needed to lay out n
+// cells of the given width across an area of the given width
+func glyphGrid(n, cellWidth, areaWidth int) (cols, rows int) {
+	if n <= 0 {
+		return 0, 0
+	}
+	cols = areaWidth / cellWidth
+	if cols < 1 {
+		cols = 1
+	}
+	if cols > n {
+		cols = n
+	}
+	rows = (n + cols - 1) / cols
+	return cols, rows
+}
+
+// Game represents the game state
+type Game struct {
+	cfg    Config
+	assets Assets
+	clock  Clock
+
+	titleStart time.Time // When the title card appeared; zero before the first update
+	lastUpdate time.Time // Clock time of the previous Update, for frame deltas
+
+	// Images
+	bgGreen  *ebiten.Image
+	bgPink   *ebiten.Image
+	upRaster *ebiten.Image
+	bsRaster *ebiten.Image
+	sprite   *ebiten.Image
+	bsFont   *ebiten.Image
+	upFont   *ebiten.Image
+	lFont    *ebiten.Image
+
+	// Font maps
+	bsFontMap *FontMap
+	upFontMap *FontMap
+	lFontMap  *FontMap
+
+	// Canvases
+	bgCanvas  *ebiten.Image
+	bg2Canvas *ebiten.Image
+	bsCanvas  *ebiten.Image
+	bs2Canvas *ebiten.Image
+	upCanvas  *ebiten.Image
+	lCanvas   *ebiten.Image
+	l2Canvas  *ebiten.Image
+
+	// Screen size the canvases were allocated for
+	width, height int
+
+	bgFadeCanvas *ebiten.Image // Incoming background scheme during a crossfade
+
+	// Offscreen frame used when rendering below screen resolution
+	frame     *ebiten.Image
+	sceneGeoM ebiten.GeoM
+	upscale   float64
+
+	bgClearColor color.Color
+
+	// Background scheme (0 = green under pink, 1 = pink under green)
+	bgScheme     int
+	bgTransition bgTransition
+
+	bgInverted bool // Background motion currently reversed
+
+	// Camera panning over the whole background, replacing the ping-pong
+	camera   *cameraPath
+	cameraOn bool
+
+	bindings []keyBinding
+	showHelp bool // Keyboard help overlay
+
+	// Font preview debug screen (0 = off, otherwise index+1 into previewFonts)
+	fontPreview int
+
+	// Animation state
+	moveY    float64
+	howmuchY float64
+	moveX    float64
+	howmuchX float64
+	bgcount  float64
+
+	Y   float64
+	hY  float64
+	X   float64
+	gox float64
+
+	ychange float64
+	addy    float64
+	sinx    float64
+	siny    float64
+	swing   float64
+	swingy  float64
+	spx     float64
+	spy     float64
+
+	spriteScale float64
+	showPath    bool       // Debug overlay of the sprite trajectory
+	spriteTint  bool       // Palette cycling of the sprites
+	scrollTint  bool       // Color cycling of the small scrolls
+	followMouse bool       // Orbit centre tracks the mouse cursor
+	savedOrbit  [2]float64 // Orbit centre to return to when following stops
+
+	confetti   *confetti
+	confettiOn bool
+
+	grain   *filmGrain
+	grainOn bool
+
+	// Scroll texts
+	scrollText1 *ScrollText
+	scrollText2 *ScrollText
+	scrollText3 *ScrollText
+	scrollText4 *ScrollText
+
+	// Audio
+	audioContext *audio.Context
+	audioPlayer  *audio.Player
+	ymPlayer     *YMPlayer
+
+	// Replay ticks of the tune elapsed since the previous frame
+	ticks    int
+	lastTick int64
+
+	focusPaused bool // Music paused because the window lost focus
+	musicPaused bool // Music paused on its own while the visuals run
+
+	scrollLog *scrollLogger // Big scroll word timing, nil when off
+
+	bigScrollScale float64 // Current section scale of the big scroll
+
+	edgeMask *ebiten.Image // Edge fade of the big scroll, built on first use
+
+	pulse envelope // Smoothed music level driving the sprite pulse
+
+	// Left and right bars of the VU meter, jumping up on peaks and falling
+	// back smoothly
+	vuOn bool
+	vu   [2]envelope
+
+	voicesOn bool // Per-channel waves of the AY chip
+
+	// Metronome flashing on each second of replay ticks of the tune
+	metronomeOn bool
+	beat        int64 // Index of the last beat seen
+	beatFlash   int   // Frames the indicator stays lit
+
+	masterVolume float64 // Music volume kept across track changes
+
+	musicEnded atomic.Bool // Set from the audio goroutine when the tune ends
+
+	// Final pass applying gamma and mirroring, skipped when neither is on
+	gamma       float64
+	mirrored    bool
+	postCanvas  *ebiten.Image
+	gammaShader *ebiten.Shader
+	gammaPixels []byte // Frame read back when correcting on the CPU
+	gammaOnCPU  bool   // The shader failed to compile
+
+	// Jukebox
+	tracks       []musicTrack
+	currentTrack int
+
+	// Short message shown at the bottom of the screen
+	notice       string
+	noticeFrames int
+
+	// GIF recording
+	recorder   *gifRecorder
+	drawnCount int
+
+	// Paused state; uiFrame keeps counting while paused to drive the
+	// blinking indicator
+	isPaused bool
+	uiFrame  int
+
+	// FPS / TPS readout, formatted every statsRefreshFrames updates
+	showStats bool
+	statsText string
+
+	// Fade to black before exiting
+	closing    bool
+	closeFrame int
+
+	stopped bool // Set by Stop; the next Update ends the run loop
+}
+
+// NewGame creates a new game instance using the embedded assets
+func NewGame(cfg Config) *Game {
+	return NewGameWithAssets(cfg, embeddedAssets())
+}
+
+// NewGameWithAssets creates a new game instance from the given assets
+func NewGameWithAssets(cfg Config, assets Assets) *Game {
+	g := &Game{
+		cfg:      cfg,
+		assets:   assets,
+		clock:    realClock{},
+		moveY:    0,
+		howmuchY: 1,
+		moveX:    0,
+		howmuchX: 1,
+		bgcount:  0,
+		Y:        0,
+		hY:       1,
+		X:        0,
+		gox:      0,
+		ychange:  0,
+		addy:     0.1,
+		sinx:     0,
+		siny:     0,
+		swing:    0,
+		swingy:   0,
+		spx:      304,
+		spy:      100,
+
+		spriteScale: cfg.SpriteScale,
+		spriteTint:  cfg.SpriteTint,
+		scrollTint:  cfg.ScrollTint,
+
+		bigScrollScale: 1,
+
+		pulse: envelope{attack: cfg.PulseAttack, release: cfg.PulseRelease},
+
+		vuOn:     cfg.VUMeter,
+		voicesOn: cfg.Voices,
+		vu:       [2]envelope{{release: vuRelease}, {release: vuRelease}},
+
+		metronomeOn: cfg.Metronome,
+
+		bgClearColor: cfg.ClearColor,
+
+		camera: newCameraPath(cfg.CameraSegmentFrames),
+
+		bindings: applyKeyMap(defaultBindings(), cfg.KeyMap),
+
+		confetti: newConfetti(maxConfetti, newRand(cfg.Seed)),
+		grain:    newFilmGrain(newRand(cfg.Seed)),
+		grainOn:  cfg.Grain,
+	}
+	g.SetGamma(cfg.Gamma)
+	g.masterVolume = defaultVolume
+	if cfg.InvertBackgrounds {
+		g.invertBackgrounds()
+	}
+
+	// Load images
+	g.loadImages()
+
+	// Render offscreen for reduced resolution or cropping
+	_, _, g.upscale = internalResolution(cfg.LowRes)
+	if g.usesFrame() {
+		g.sceneGeoM.Scale(1/g.upscale, 1/g.upscale)
+	}
+
+	// Create canvases and draw the backgrounds into them
+	g.resizeCanvases(screenWidth, screenHeight)
+
+	// Initialize scroll texts
+	g.initScrollTexts()
+
+	// Initialize audio
+	g.initAudio()
+
+	return g
+}
+
+// loadImages loads all image assets
+func (g *Game) loadImages() {
+	var err error
+
+	// Load background images
+	img, _, err := image.Decode(bytes.NewReader(g.assets.BgGreen))
+	if err == nil {
+		g.bgGreen = ebiten.NewImageFromImage(img)
+	}
+
+	img, _, err = image.Decode(bytes.NewReader(g.assets.BgPink))
+	if err == nil {
+		g.bgPink = ebiten.NewImageFromImage(img)
+	}
+
+	// Load raster images
+	img, _, err = image.Decode(bytes.NewReader(g.assets.UpRaster))
+	if err == nil {
+		g.upRaster = ebiten.NewImageFromImage(img)
+	}
+
+	if g.cfg.RasterBands > 0 {
+		g.bsRaster = ebiten.NewImageFromImage(generateRaster(bigRasterWidth, g.cfg.RasterBands, g.cfg.RasterBandHeight, g.cfg.RasterSmooth))
+	} else if img, _, err = image.Decode(bytes.NewReader(g.assets.BsRaster)); err == nil {
+		g.bsRaster = ebiten.NewImageFromImage(img)
+	}
+
+	// Load sprite, keying out its background color if asked to
+	img, _, err = image.Decode(bytes.NewReader(g.assets.Sprite))
+	if err == nil {
+		if g.cfg.SpriteKeyed {
+			img = applyColorKey(img, g.cfg.SpriteColorKey)
+		} else if c, ok := opaqueBackground(img); ok {
+			log.Printf("Sprite sheet has an opaque background (#%02X%02X%02X); use -spritekey to make it transparent", c.R, c.G, c.B)
+		}
+		g.sprite = ebiten.NewImageFromImage(img)
+	}
+
+	// Load fonts
+	img, _, err = image.Decode(bytes.NewReader(g.assets.BsFont))
+	if err == nil {
+		g.bsFont = ebiten.NewImageFromImage(img)
+	}
+
+	img, _, err = image.Decode(bytes.NewReader(g.assets.UpFont))
+	if err == nil {
+		g.upFont = ebiten.NewImageFromImage(img)
+	}
+
+	img, _, err = image.Decode(bytes.NewReader(g.assets.LFont))
+	if err == nil {
+		g.lFont = ebiten.NewImageFromImage(img)
+	}
+}
+
+// initBackgrounds initializes the background canvases
+func (g *Game) initBackgrounds() {
+	// Tile each background artwork across its whole canvas
+	tile := func(dst, src *ebiten.Image) {
+		if src == nil {
+			return
+		}
+		b := dst.Bounds()
+		for y := 0; y < b.Dy(); y += 400 {
+			for x := 0; x < b.Dx(); x += 640 {
+				op := &ebiten.DrawImageOptions{}
+				op.GeoM.Translate(float64(x), float64(y))
+				dst.DrawImage(src, op)
+			}
+		}
+	}
+	tile(g.bgCanvas, g.bgGreen)
+	tile(g.bg2Canvas, g.bgPink)
+}
+
+// usesFrame reports whether the scene is rendered into the offscreen frame,
+// for reduced resolution or cropping, rather than straight to the screen
+func (g *Game) usesFrame() bool {
+	return g.upscale != 1 || !g.cfg.Crop.Empty()
+}
+
+// resizeCanvases (re)allocates every canvas for a w x h screen, redraws the
+// backgrounds and fits the scroll viewports to the new canvases
+func (g *Game) resizeCanvases(w, h int) {
+	for _, img := range []*ebiten.Image{g.bgCanvas, g.bg2Canvas, g.bsCanvas, g.bs2Canvas, g.upCanvas, g.lCanvas, g.l2Canvas, g.bgFadeCanvas, g.postCanvas, g.frame} {
+		if img != nil {
+			img.Deallocate()
+		}
+	}
+
+	g.width, g.height = w, h
+	g.bgCanvas = ebiten.NewImage(w*3, h*2)
+	g.bg2Canvas = ebiten.NewImage(w*3, h*2)
+	g.bsCanvas = ebiten.NewImage(w, 40)
+	g.bs2Canvas = ebiten.NewImage(w, h/2)
+	g.upCanvas = ebiten.NewImage(32, h)
+	g.lCanvas = ebiten.NewImage(w/2, 8)
+	g.l2Canvas = ebiten.NewImage(w/2, 8)
+	g.frame = nil
+	if g.usesFrame() {
+		g.frame = ebiten.NewImage(int(float64(w)/g.upscale), int(float64(h)/g.upscale))
+	}
+
+	// Created on demand at the screen size
+	g.bgFadeCanvas = nil
+	g.postCanvas = nil
+	if g.edgeMask != nil {
+		g.edgeMask.Deallocate()
+		g.edgeMask = nil
+	}
+
+	g.initBackgrounds()
+
+	if g.scrollText1 != nil {
+		g.scrollText1.SetViewport(g.bigScrollViewport())
+	}
+	if g.scrollText2 != nil {
+		g.scrollText2.SetViewport(canvasSize(g.upCanvas))
+	}
+	if g.scrollText3 != nil {
+		g.scrollText3.SetViewport(canvasSize(g.lCanvas))
+	}
+	if g.scrollText4 != nil {
+		g.scrollText4.SetViewport(canvasSize(g.l2Canvas))
+	}
+}
+
+// bigScrollViewport returns the part of the big scroll that ends up on
+// screen after the magnification, in font pixels
+func (g *Game) bigScrollViewport() (float64, float64) {
+	w, h := canvasSize(g.bs2Canvas)
+	return w / bigScrollZoomX, h / bigScrollZoomY
+}
+
+// detectGlyphWidths runs AutoDetect on a font map against its encoded
+// font sheet, leaving the map untouched if the sheet does not decode
+func detectGlyphWidths(fm *FontMap, data []byte) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Failed to decode font for width detection: %v", err)
+		return
+	}
+	fm.AutoDetect(img)
+}
+
+// initScrollTexts initializes the scrolling texts
+func (g *Game) initScrollTexts() {
+	// Initialize font maps
+	g.bsFontMap = initBigScrollFont()
+	g.upFontMap = initUpScrollFont()
+	g.lFontMap = initSmallFont()
+	g.bsFontMap.SetTracking(g.cfg.Tracking)
+
+	if g.cfg.Proportional {
+		detectGlyphWidths(g.bsFontMap, g.assets.BsFont)
+		detectGlyphWidths(g.lFontMap, g.assets.LFont)
+	}
+
+	// Catch mismatched font assets early
+	for _, pf := range g.previewFonts() {
+		if pf.img != nil {
+			checkFontImage(pf.name, pf.img, pf.fm)
+		}
+	}
+
+	// Main scroll text
+	mainText := "                                 HI AND WELCOME TO THE GRODAN AND KVACK KVACK DEMO {0.75}(THAT NAME WILL PROBABLY MAKE US FAMOUS IN THE GUINNESS BOOK OF RECORDS - THE MOST STUPID NAME IN DEMO HISTORY.  THE PREVIOUS POSSESSORS OF THAT RECORD WAS OMEGA WITH -OMEGAKUL-.   I'M AFRAID WE WILL SOON BE BEATEN BY SYNC'S 'MJOFFE-DEMO', WITH TWO DOTS ABOVE THE 'O'.  DID YOU KNOW THAT THIS IS A COMMENT IN THE MIDDLE OF A SENTENCE? NO?  WE ALSO FORGOT, BUT LET'S CONTINUE WITH WHAT WE WERE WRITING BEFORE WE STARTED WRITING THIS RECORD-CRAP.){1}, CODED BY NICK AND JAS OF THE CAREBEARS. GRAPHIXXXX BY TANIS, THE GREAT (?) OF THE MEGAMIGHTY CAREBEARS.        WE HAVE TO COVER TWO SUBJECTS IN THIS SCROLLTEXT - THE FANTASTIC WORLD OF HARDWARESCROLLERS  AND  GREETINGS....   LET'S START WITH THE STUFF YOU PROBABLY WANT US TO TALK THE MOST ABOUT - HARDWARESCROLLERS....        TIME: LATE MARCH 1989    PLACE: NICK'S COMPUTER ROOM     IT WORKS!!!!!!!  AFTER HAVING TRIED THE ZANY SCROLLTECHNIQUE ON BOTH NICK'S AND JAS' COMPUTERS, WE CONCLUDED THAT IT ACTUALLY WORKED.    ONE DAY LATER, OMEGA CALLS US AND GOES SOMETHING LIKE THIS: - HAAAA HAAAA  WE KNOW HOW TO SCROLL THE WHOLE SCREEN BOTH HORIZONTALLY AND VERTICALLY IN LESS THAN TEN SCANLINES!!!!!!         WE WERE AMAZED THAT THEY HAD ACTUALLY COME UP WITH THE SAME IDEA ON THE SAME DAY AS US, BUT AT LEAST NOBODY ELSE KNEW HOW TO DO IT.     WE MANAGED TO RELEASE THE FIRST HARDWARESCROLLER THE WORLD HAS SEEN, IN THE CUDDLY DEMOS, AND NOW WE ARE GOING TO USE IT COMERCIALLY (CODING GAMES, DICKHEAD)....     NOW A HINT HOW IT'S DONE:    IT HAS NOTHING TO DO WITH ANY OF THE SOUND-REGISTERS.....         HERE IS ANOTHER ADDRESS TO THE CAREBEARS:     T H E   C A R E B E A R S ,    D R A K E N B E R G S G   2 3    8 T R ,      1 1 7   4  1   S T O  C K H O L M ,     S W E  D E N .                NOW FOR SOME GREETINGS:   MEGADUNDERSUPERDUPERGREETINGS TO  ALL THE OTHER MEMBERS OF THE UNION, ESPECIALLY THE EXCEPTIONS (TANIS WISH TO GIVE A SPECIAL HI TO ES) AND THE REPLICANTS (GOODBYE, RATBOY! YOUR INTROS WERE GREAT).   NORMAL MEGAGREETINGS (IN MERIT-ORDER)(WOW) TO   SYNC (WE'VE CHANGED OUR MINDS, YOU'RE THE SECOND BEST SWEDISH CREW. WE JUST HADN'T SEEN MANY SCREENS BY YOU GUYS (IT'S UNDERSTANDABLE - YOU HAVE ONLY RELEASED THREE NOT VERY GOOD ONES)),  OMEGA (TOO BAD, YOU'RE NOT THE SECOND BEST ANYMORE.  PERHAPS IT HAS SOMETHING TO DO WITH  THE TERA-DISTER, THE 'TCB-E'-JATTEDUMMA'-SIGN OR THE FACT THAT SYNC IS BETTER), THE LOST BOYS (SEE YA' SOON AND WE'RE ANXIOUSLY AWAITING YOUR MEGAMEGADEMO)             SOMETHING BETWEEN MEGAGREETINGS AND NORMAL GREETINGS TO:   FLEXIBLE FRONT (GOODBYE), VECTOR (SO YOU CRACKED OUR DEMO, HUH? NICE SCREEN, BY THE WAY), GHOST (SO YOU TRIED TO CRACK OUR DEMO, HUH? GREAT SCREEN, BY THE WAY), 2 LIFE CREW (YOU ARE IMPROVING), MAGNUM FORCE (YOU SEEM TO BE THE BEST OPTIMIZERS IN FRANCE!), NORDIK CODERS (NICE SCREEN).   NORMAL GREETINGS TO:  FASHION (GOOD LUCK WITH YOUR DEMO), OVERLANDERS (THANKS FOR NOT INCLUDING CUDDLY IN YOUR DEMOBREAKER), NO CREW (ESPECIALLY ROCCO. YOU ARE IMPROVING), AUTOMATION (GREAT COMPACT DISKS), MEDWAY BOYS (NICE CD'S),  ST CONNEXION (HOPE YOUR DEMO WILL BE AS GOOD AS YOUR GRAPHICS), FOXX (COOL SCREEN), FOFT (KEEP ON COMPACTING), ZAE (WE HAD A GREAT TIME IN MARSEILLE), KREATORS (ESPECIALLY CHUD), M.A.R.K.U.S (PLEASE SPREAD THIS DEMO AS MUCH AS YOU SPREAD CUDDLY DEMOS), HACKATARIMAN (THANKS FOR ALL THE STUFF), THE ALLIANCE (ESPECIALLY OVERLANDERS (THANKS FOR TCB-FRIENDLY SCROLLTEXTS AND MANY NICE SCREENS), AND BLACK MONOLITH TEAM (YOUR DEMOSCREEN WAS THE BEST IN THE OLD ALLIANCE DEMO), BIRDY (SEND US YOUR CRACKS), LINKAN 'THE LINK' 'JUDGE LINK' LINKSSON (PING-PONG), NYARLOTHATEPS ADEPTS (STRANGE NAME, STRANGE GUYS), GROWTWIG ( NO COMMENT),  TONY KOLLBERG (TJENA, LYCKA TILL MED ASSEMBLERN)     END OF GREETINGS. IF YOU WERE NOT GREETED, TOO BAD. NORMAL FUCKING GREETINGS TO:  CONSTELLATIONS (NOONE WILL EVER COMPLAIN ABOUT TCB AND GET AWAY WITH IT, BESIDES YOUR DEMO WAS WORTHLESS). MEGA FUCKING GREETINGS TO:     MENACING CRACKING ALLIANCE (SO, YOU DON'T LIKE BEING CALLED LAMERS, HOW YA' LIKE BEING CALLED:       MOTHERFUCKIN'   BLEEDIN' (BRITTISH ENGLISH) ULTIMATE CHICKENBRAINS????!!!! I BET IT'S ALMOST AS FUN AS FUCKING GREET TCB).  END OF SCROLLTEXT. LET'S WRAP."
+
+	// Vertical scroll text
+	vertText := "                           TANIS, THE FAMOUS GRAFIXX-MAN, IS A NEW MEMBER OF TCB.  HE MADE ALL THE GRAPHICS IN THIS SCREEN PLUS LOTSA LOGOS IN THE MAIN MENU.  WE AGREE THAT THIS 'ONE-BIT-PLANE-MANIA' DOESN'T LOOK VERY GOOD, BUT IT HAD TO BE DONE BY SOMEONE........   BAD LUCK FOR TANIS THAT WE WON'T MAKE MORE DEMOS, THOUGH....       9 9 9 9 9 9 9 9 9 9 9 9 9 9 9 9 9 9 9  ..................                 LET'S WRAP (WE SPELLED IT CORRECTLY!!!).......   "
+
+	// Small scroll texts
+	smallText1 := "                                                        ONCE UPON A TIME, WHEN THE JUNK DEMO WAS ALMOST FINISHED - WHEN THE BEST DEMO ON THE ST-MARKET WAS 'LCD' BY TEX, WE VISITED IQ2-CREW (AMIGA-FREAKS). THEY SHOWED US A COUPLE OF DEMOS AND ONE OF THEM WAS THE TECHTECH-DEMO BY SODAN AND MAGICIAN 42. KRILLE AND PUTTE LAUGHED AT US AND SAID THAT IT WAS TOTALLY IMPOSSIBLE TO MAKE ON AN ST. WE STUDIED IT FOR HALF AN HOUR AND SAID: -OF COURSE IT'S POSSIBLE.   WHEN WE WERE BACK HOME (WHEN NO AMIGA-OWNER WAS LISTENING), WE CONCLUDED THAT THERE WAS SIMPLY TOO MUCH MOVEMENT FOR AN ST.        NOW, WE HAVE CONVERTED IT ANYWAY. THE AMIGA VERSION HAD SOME UGLY LINES WHIZZING AROUND, BUT WE HAVE 3 VOICE REAL DIGISOUND AND SOME UGLY SPRITES. BESIDES, WE HAVE SOME TERRIBLE RASTERS.......            WE AGREE THAT THERE ARE BETTER AMIGA-DEMOS NOW, AND PERHAPS WE WILL CONVERT SOME MORE IN THE FUTURE.......     LET'S WRAZZZZZZZ................"
+
+	smallText2 := "                               EVERYBODY THOUGHT IT WAS IMPOSSIBLE.....                                     EVEN WE THOUGHT IT WAS IMPOSSIBLE......                                       IT'S A PITY IT WASN'T.....                                                 THE CAREBEARS PRESENT THE UGLIEST DEMO SO FAR - THE GRODAN AND KVACK KVACK DEMO, A CONVERSION OF THE STUNNING TECHTECH DEMO BY SODAN AND MAGICIAN 42 (ON THE COMPUTER THAT CRASHES WHEN YOU ENTER SUPERVISOR MODE IN SEKA).   IT WAS UGLY ON THE AMIGA TOO, BUT IT SURE KNOCKED YOU OFF THE CHAIR WHEN YOU SAW IT THE FIRST TIME.    "
+
+	if g.bsFont != nil && g.bsFontMap != nil {
+		g.scrollText1 = NewScrollText(mainText, g.bsFont, g.bsFontMap, 2, false)
+		g.scrollText1.SetViewport(g.bigScrollViewport())
+		g.scrollText1.SetSpeedRamp(g.cfg.ScrollEaseFrames)
+		if g.cfg.LogScroll {
+			g.scrollLog = &scrollLogger{w: os.Stdout}
+		}
+		if g.cfg.PrerenderBigScroll {
+			g.scrollText1.Prerender(prerenderTileWidth)
+		}
+		g.scrollText1.SetWave(g.cfg.WaveAmplitude, g.cfg.WaveFrequency)
+	}
+	if g.upFont != nil && g.upFontMap != nil {
+		g.scrollText2 = NewScrollText(vertText, g.upFont, g.upFontMap, 3, true) // Vertical scroll
+		g.scrollText2.scrollX = -scrollRestartGap                               // Start below screen
+		g.scrollText2.SetViewport(canvasSize(g.upCanvas))
+	}
+	if g.lFont != nil && g.lFontMap != nil {
+		g.scrollText3 = NewScrollText(smallText1, g.lFont, g.lFontMap, 1, false)
+		g.scrollText3.SetViewport(canvasSize(g.lCanvas))
+		g.scrollText4 = NewScrollText(smallText2, g.lFont, g.lFontMap, 2, false)
+		g.scrollText4.SetViewport(canvasSize(g.l2Canvas))
+		g.applyScrollTint()
+	}
+
+	// Catch scroll text characters the fonts cannot show
+	for i, s := range g.scrollTexts() {
+		if s == nil {
+			continue
+		}
+		if missing := s.MissingRunes(); len(missing) > 0 {
+			log.Printf("Warning: %s scroll text has characters its font lacks: %q", scrollNames[i], string(missing))
+		}
+	}
+}
+
+// canvasSize returns the dimensions of a canvas as floats
+func canvasSize(img *ebiten.Image) (float64, float64) {
+	b := img.Bounds()
+	return float64(b.Dx()), float64(b.Dy())
+}
+
+// initAudio initializes the audio system
+func (g *Game) initAudio() {
+	// Ebiten allows one audio context per process, so later Games share it
+	g.audioContext = audio.CurrentContext()
+	if g.audioContext == nil {
+		g.audioContext = audio.NewContext(sampleRate)
+	}
+	g.tracks = g.assets.Tracks
+	if len(g.tracks) == 0 {
+		return // Running without music
+	}
+
+	if err := g.LoadMusic(g.tracks[0].data); err != nil {
+		log.Printf("Failed to load music: %v", err)
+		return
+	}
+	if g.cfg.StartMs > 0 {
+		if length := g.ymPlayer.LengthMs(); length == 0 {
+			log.Printf("Cannot start at %s: the tune does not report its length", formatMs(g.cfg.StartMs))
+		} else if g.cfg.StartMs >= length {
+			log.Printf("Start position %s is past the end of the tune (%s), starting from the beginning",
+				formatMs(g.cfg.StartMs), formatMs(length))
+		} else {
+			g.ymPlayer.SetPositionMs(g.cfg.StartMs)
+		}
+	}
+}
+
+// LoadMusic replaces the playing tune with the given YM data
+func (g *Game) LoadMusic(data []byte) error {
+	ymPlayer, err := NewYMPlayer(data, sampleRate, true)
+	if err != nil {
+		return fmt.Errorf("failed to create YM player: %w", err)
+	}
+
+	ymPlayer.SetLoopCount(g.cfg.LoopCount)
+	ymPlayer.OnEnd(func() { g.musicEnded.Store(true) })
+	if g.ymPlayer == nil {
+		// Only the very first tune fades in; jukebox switches cut or crossfade
+		ymPlayer.SetFadeIn(g.cfg.MusicFadeIn)
+	}
+
+	// Stop the old tune first so the two never overlap
+	g.stopMusic()
+
+	audioPlayer, err := g.audioContext.NewPlayer(ymPlayer)
+	if err != nil {
+		ymPlayer.Close()
+		return fmt.Errorf("failed to create audio player: %w", err)
+	}
+
+	g.ymPlayer = ymPlayer
+	g.musicEnded.Store(false)
+	g.lastTick = 0
+	g.audioPlayer = audioPlayer
+	if g.cfg.AudioBuffer > 0 {
+		g.audioPlayer.SetBufferSize(g.cfg.AudioBuffer)
+	}
+	g.applyVolume()
+	g.syncAudio()
+	return nil
+}
+
+// stopMusic stops and releases the current tune
+func (g *Game) stopMusic() {
+	if g.audioPlayer != nil {
+		g.audioPlayer.Pause()
+		g.audioPlayer.Close()
+		g.audioPlayer = nil
+	}
+	if g.ymPlayer != nil {
+		g.ymPlayer.Close()
+		g.ymPlayer = nil
+	}
+}
+
+// togglePause freezes or resumes the animation and the music
+func (g *Game) togglePause() {
+	g.isPaused = !g.isPaused
+	g.syncAudio()
+}
+
+// toggleMusicPause pauses or resumes only the music, leaving the visuals
+// running
+func (g *Game) toggleMusicPause() {
+	g.musicPaused = !g.musicPaused
+	g.syncAudio()
+	if g.musicPaused {
+		g.showNotice("MUSIC PAUSED")
+	} else {
+		g.showNotice("MUSIC RESUMED")
+	}
+}
+
+// syncAudio plays the music unless the demo, the music alone or the lost
+// window focus holds it paused. The YM player is paused too, so samples
+// still pulled from its buffer are silence and the tune position cannot
+// drift.
+func (g *Game) syncAudio() {
+	if g.audioPlayer == nil {
+		return
+	}
+	play := !g.isPaused && !g.musicPaused && !g.focusPaused
+	g.ymPlayer.SetPaused(!play)
+	if play && !g.audioPlayer.IsPlaying() {
+		g.audioPlayer.Play()
+	} else if !play && g.audioPlayer.IsPlaying() {
+		g.audioPlayer.Pause()
+	}
+}
+
+// endMusic applies Config.MusicEnd once the tune has played its last loop
+func (g *Game) endMusic() {
+	switch g.cfg.MusicEnd {
+	case musicEndQuit:
+		g.quit()
+	default:
+		// Release the silent players rather than keep them pulling EOF
+		g.stopMusic()
+	}
+}
+
+// setFocused pauses the music when the window loses focus and resumes it
+// when focus returns, leaving music paused for other reasons alone
+func (g *Game) setFocused(focused bool) {
+	if g.focusPaused == !focused {
+		return
+	}
+	g.focusPaused = !focused
+	g.syncAudio()
+}
+
+// selectTrack switches the jukebox to the given track
+func (g *Game) selectTrack(index int) {
+	if index < 0 || index >= len(g.tracks) {
+		return
+	}
+	var err error
+	if g.cfg.TrackCrossfade > 0 && g.ymPlayer != nil {
+		err = g.ymPlayer.Crossfade(g.tracks[index].data, g.cfg.TrackCrossfade)
+	} else {
+		err = g.LoadMusic(g.tracks[index].data)
+	}
+	if err != nil {
+		log.Printf("Failed to load track %q: %v", g.tracks[index].name, err)
+		return
+	}
+	g.currentTrack = index
+	g.showNotice(g.tracks[index].name)
+}
+
+// showNotice displays a short message at the bottom of the screen
+func (g *Game) showNotice(text string) {
+	g.notice = text
+	g.noticeFrames = noticeFrames
+}
+
+// toggleRecording starts a GIF recording, or stops and saves the current one
+func (g *Game) toggleRecording() {
+	if g.recorder == nil {
+		g.recorder = newGIFRecorder(g.cfg.RecordMaxFrames, g.cfg.RecordMaxBytes)
+		g.showNotice("RECORDING")
+		return
+	}
+	g.finishRecording()
+}
+
+// finishRecording writes the current recording to a timestamped GIF file
+// in the background; the returned channel is closed once it is written
+func (g *Game) finishRecording() <-chan struct{} {
+	rec := g.recorder
+	g.recorder = nil
+	if rec.capped {
+		log.Printf("Recording stopped: memory cap reached (%d frames, %d bytes)", len(rec.frames), rec.size)
+		g.showNotice("RECORDING CAP REACHED")
+	} else {
+		g.showNotice("RECORDING SAVED")
+	}
+
+	path := fmt.Sprintf("grodan-%s.gif", g.clock.Now().Format("20060102-150405"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		f, err := os.Create(path)
+		if err != nil {
+			log.Printf("Failed to save recording: %v", err)
+			return
+		}
+		defer f.Close()
+
+		if err := rec.Write(f); err != nil {
+			log.Printf("Failed to save recording: %v", err)
+			return
+		}
+		log.Printf("Recording saved to %s", path)
+	}()
+	return done
+}
+
+// captureFrame adds the drawn screen to the GIF recording
+func (g *Game) captureFrame(screen *ebiten.Image) {
+	g.drawnCount++
+	if g.drawnCount%recordEvery != 0 {
+		return
+	}
+
+	b := screen.Bounds()
+	rgba := image.NewRGBA(b)
+	screen.ReadPixels(rgba.Pix)
+
+	frame := image.NewPaletted(b, palette.Plan9)
+	draw.Draw(frame, b, rgba, b.Min, draw.Src)
+	if !g.recorder.Append(frame) {
+		g.finishRecording()
+	}
+}
+
+// SetClock replaces the time source used by time-based effects
+func (g *Game) SetClock(clock Clock) {
+	g.clock = clock
+	g.lastUpdate = time.Time{}
+}
+
+// frameDelta returns the clock time since the previous Update, capped at
+// maxFrameDelta. The first Update counts as one tick.
+func (g *Game) frameDelta() time.Duration {
+	now := g.clock.Now()
+	dt := time.Second / time.Duration(ebiten.TPS())
+	if !g.lastUpdate.IsZero() {
+		dt = max(0, min(now.Sub(g.lastUpdate), maxFrameDelta))
+	}
+	g.lastUpdate = now
+	return dt
+}
+
+// resetTunables restores every parameter adjustable at runtime to its
+// configured default
+func (g *Game) resetTunables() {
+	g.spriteScale = g.cfg.SpriteScale
+	g.spriteTint = g.cfg.SpriteTint
+	g.scrollTint = g.cfg.ScrollTint
+	g.applyScrollTint()
+	g.SetGamma(g.cfg.Gamma)
+	if g.bgInverted != g.cfg.InvertBackgrounds {
+		g.invertBackgrounds()
+	}
+	if g.followMouse {
+		g.toggleFollowMouse()
+	}
+	g.SetMasterVolume(defaultVolume)
+}
+
+// keyBinding maps a key to an action. Bindings with help text are listed on
+// the help overlay; labels and help only use characters the small font has.
+type keyBinding struct {
+	key    ebiten.Key
+	name   string // Identifier of the action
+	label  string // Key label on the help overlay
+	help   string // Action description on the help overlay
+	action func(g *Game)
+}
+
+// defaultBindings returns the key table, in the order shown on the help
+// overlay
+func defaultBindings() []keyBinding {
+	bindings := []keyBinding{
+		{ebiten.KeyF3, "help", "F3", "SHOW OR HIDE THIS HELP", (*Game).toggleHelp},
+		{ebiten.KeySpace, "pause", "SPACE", "PAUSE", (*Game).togglePause},
+	}
+	for i, key := range trackKeys {
+		b := keyBinding{key: key, name: fmt.Sprintf("track%d", i+1), action: func(g *Game) { g.selectTrack(i) }}
+		if i == 0 {
+			b.label, b.help = "1 TO 9", "SELECT JUKEBOX TRACK"
+		}
+		bindings = append(bindings, b)
+	}
+	return append(bindings,
+		keyBinding{ebiten.KeyB, "background", "B", "CROSSFADE BACKGROUNDS", (*Game).switchBackground},
+		keyBinding{ebiten.KeyX, "mirror", "X", "MIRROR", (*Game).toggleMirror},
+		keyBinding{ebiten.KeyI, "invert-backgrounds", "I", "REVERSE BACKGROUNDS", (*Game).invertBackgrounds},
+		keyBinding{ebiten.KeyC, "camera", "C", "CAMERA PAN", (*Game).toggleCamera},
+		keyBinding{ebiten.KeyP, "path", "P", "SPRITE PATH PREVIEW", (*Game).togglePath},
+		keyBinding{ebiten.KeyBracketLeft, "sprite-smaller", "BRACKETS", "SPRITE SIZE", (*Game).shrinkSprites},
+		keyBinding{ebiten.KeyBracketRight, "sprite-bigger", "", "", (*Game).growSprites},
+		keyBinding{ebiten.KeyM, "follow-mouse", "M", "SPRITES FOLLOW MOUSE", (*Game).toggleFollowMouse},
+		keyBinding{ebiten.KeyT, "sprite-tint", "T", "SPRITE COLORS", (*Game).toggleSpriteTint},
+		keyBinding{ebiten.KeyL, "scroll-tint", "L", "SMALL SCROLL COLORS", (*Game).toggleScrollTint},
+		keyBinding{ebiten.KeyR, "confetti", "R", "MAKE IT RAIN", (*Game).toggleConfetti},
+		keyBinding{ebiten.KeyN, "grain", "N", "FILM GRAIN", (*Game).toggleGrain},
+		keyBinding{ebiten.KeyV, "vu-meter", "V", "VU METER", (*Game).toggleVUMeter},
+		keyBinding{ebiten.KeyO, "voices", "O", "CHANNEL SCOPE", (*Game).toggleVoices},
+		keyBinding{ebiten.KeyK, "metronome", "K", "METRONOME", (*Game).toggleMetronome},
+		keyBinding{ebiten.KeyG, "record", "G", "RECORD GIF", (*Game).toggleRecording},
+		keyBinding{ebiten.KeyF1, "stats", "F1", "FPS COUNTER", (*Game).toggleStats},
+		keyBinding{ebiten.KeyF2, "font-preview", "F2", "FONT PREVIEW", (*Game).cycleFontPreview},
+		keyBinding{ebiten.KeyPageUp, "brighter", "PAGE UP DOWN", "GAMMA", (*Game).brighten},
+		keyBinding{ebiten.KeyPageDown, "darker", "", "", (*Game).darken},
+		keyBinding{ebiten.KeyU, "music-pause", "U", "PAUSE MUSIC ONLY", (*Game).toggleMusicPause},
+		keyBinding{ebiten.KeyMinus, "volume-down", "MINUS EQUALS", "VOLUME", (*Game).volumeDown},
+		keyBinding{ebiten.KeyEqual, "volume-up", "", "", (*Game).volumeUp},
+		keyBinding{ebiten.KeyF9, "heap-profile", "F9", "SAVE HEAP PROFILE", (*Game).snapshotHeap},
+		keyBinding{ebiten.KeyBackspace, "reset", "BACKSPACE", "RESET TWEAKS", (*Game).resetTunables},
+		keyBinding{ebiten.KeyEscape, "quit", "ESC", "QUIT", (*Game).quit},
+	)
+}
+
+// loadKeyMap reads a JSON object mapping action names to key names
+func loadKeyMap(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key map: %w", err)
+	}
+
+	var keyMap map[string]string
+	if err := json.Unmarshal(data, &keyMap); err != nil {
+		return nil, fmt.Errorf("failed to parse key map %s: %w", path, err)
+	}
+	return keyMap, nil
+}
+
+// applyKeyMap returns the bindings with keys remapped according to keyMap.
+// Unknown actions and invalid key names are logged and keep their default.
+func applyKeyMap(bindings []keyBinding, keyMap map[string]string) []keyBinding {
+	remapped := make([]keyBinding, len(bindings))
+	copy(remapped, bindings)
+
+	for name, keyName := range keyMap {
+		var key ebiten.Key
+		if err := key.UnmarshalText([]byte(keyName)); err != nil {
+			log.Printf("Key map: invalid key %q for action %q, keeping default", keyName, name)
+			continue
+		}
+
+		found := false
+		for i := range remapped {
+			if remapped[i].name != name {
+				continue
+			}
+			remapped[i].key = key
+			if remapped[i].label != "" {
+				remapped[i].label = strings.ToUpper(key.String())
+			}
+			found = true
+		}
+		if !found {
+			log.Printf("Key map: unknown action %q", name)
+		}
+	}
+
+	// A key bound twice runs both actions; warn rather than guess which to
+	// drop, as the default of the other action may be the one meant to go
+	boundTo := make(map[ebiten.Key]string)
+	for _, b := range remapped {
+		if other, ok := boundTo[b.key]; ok {
+			log.Printf("Key map: %s is bound to both %q and %q", b.key, other, b.name)
+			continue
+		}
+		boundTo[b.key] = b.name
+	}
+	return remapped
+}
+
+// dispatchKeys runs the action of every binding whose key was just pressed,
+// as reported by justPressed
+func (g *Game) dispatchKeys(justPressed func(ebiten.Key) bool) {
+	for _, b := range g.bindings {
+		if justPressed(b.key) {
+			b.action(g)
+		}
+	}
+}
+
+// toggleHelp shows or hides the keyboard help overlay
+func (g *Game) toggleHelp() {
+	g.showHelp = !g.showHelp
+}
+
+// cycleFontPreview cycles the font preview screen through the fonts, then off
+func (g *Game) cycleFontPreview() {
+	g.fontPreview = (g.fontPreview + 1) % (len(g.previewFonts()) + 1)
+}
+
+// shrinkSprites makes the sprites one step smaller
+func (g *Game) shrinkSprites() {
+	g.spriteScale = math.Max(g.spriteScale-spriteScaleStep, minSpriteScale)
+}
+
+// growSprites makes the sprites one step bigger
+func (g *Game) growSprites() {
+	g.spriteScale = math.Min(g.spriteScale+spriteScaleStep, maxSpriteScale)
+}
+
+// switchBackground crossfades to the other background scheme
+func (g *Game) switchBackground() {
+	if g.bgTransition.active {
+		return
+	}
+	g.bgTransition.Start(g.bgScheme, 1-g.bgScheme, g.cfg.BackgroundFadeFrames)
+	g.bgScheme = 1 - g.bgScheme
+}
+
+// invertBackgrounds reverses the current direction of both backgrounds;
+// they keep bouncing at the edges of their range as before
+func (g *Game) invertBackgrounds() {
+	g.howmuchX, g.howmuchY = -g.howmuchX, -g.howmuchY
+	g.gox, g.hY = -g.gox, -g.hY
+	g.bgInverted = !g.bgInverted
+}
+
+// toggleCamera switches the camera pan over the backgrounds on or off
+func (g *Game) toggleCamera() {
+	g.cameraOn = !g.cameraOn
+}
+
+// toggleConfetti starts or stops the confetti rain
+func (g *Game) toggleConfetti() {
+	g.confettiOn = !g.confettiOn
+}
+
+// toggleVUMeter shows or hides the VU meter
+func (g *Game) toggleVUMeter() {
+	g.vuOn = !g.vuOn
+}
+
+// toggleMetronome shows or hides the beat indicator
+func (g *Game) toggleMetronome() {
+	g.metronomeOn = !g.metronomeOn
+}
+
+// beatIndex returns which beat a tick count falls in, with a beat every
+// ticksPerBeat ticks
+func beatIndex(ticks int64, ticksPerBeat int) int64 {
+	if ticksPerBeat <= 0 {
+		return 0
+	}
+	return ticks / int64(ticksPerBeat)
+}
+
+// stepMetronome lights the indicator whenever the tune enters a new beat,
+// one per ReplayHz ticks, and lets it fade between beats
+func (g *Game) stepMetronome() {
+	if g.beatFlash > 0 {
+		g.beatFlash--
+	}
+	if g.ymPlayer == nil {
+		return
+	}
+	if beat := beatIndex(g.ymPlayer.TickCount(), g.ymPlayer.ReplayHz()); beat != g.beat {
+		g.beat = beat
+		g.beatFlash = metronomeFlashFrames
+	}
+}
+
+// drawMetronome draws the beat indicator, bright on the beat and fading
+// until the next one
+func (g *Game) drawMetronome(screen *ebiten.Image) {
+	x, y := g.sceneGeoM.Apply(float64(g.width-metronomeSize)/2, float64(g.height-8-metronomeSize))
+	size := float32(metronomeSize / g.upscale)
+	vector.DrawFilledRect(screen, float32(x), float32(y), size, size, color.RGBA{A: 0x80}, false)
+
+	if g.beatFlash > 0 {
+		a := uint8(0xff * g.beatFlash / metronomeFlashFrames)
+		vector.DrawFilledRect(screen, float32(x), float32(y), size, size, color.RGBA{a, a, a, a}, false)
+	}
+}
+
+// toggleVoices shows or hides the per-channel waves
+func (g *Game) toggleVoices() {
+	g.voicesOn = !g.voicesOn
+}
+
+// toggleGrain shows or hides the film grain overlay
+func (g *Game) toggleGrain() {
+	g.grainOn = !g.grainOn
+}
+
+// toggleSpriteTint turns the sprite palette cycling on or off
+func (g *Game) toggleSpriteTint() {
+	g.spriteTint = !g.spriteTint
+}
+
+// toggleScrollTint turns the small scroll color cycling on or off
+func (g *Game) toggleScrollTint() {
+	g.scrollTint = !g.scrollTint
+	g.applyScrollTint()
+}
+
+// applyScrollTint passes the color cycling state and speed on to the
+// small scrolls
+func (g *Game) applyScrollTint() {
+	step := 360 * g.cfg.ScrollTintSpeed / float64(ebiten.TPS())
+	for _, s := range []*ScrollText{g.scrollText3, g.scrollText4} {
+		if s != nil {
+			s.SetTint(g.scrollTint, step)
+		}
+	}
+}
+
+// togglePath shows or hides the sprite path preview
+func (g *Game) togglePath() {
+	g.showPath = !g.showPath
+}
+
+// previewFont describes a font shown on the preview screen
+type previewFont struct {
+	name string
+	img  *ebiten.Image
+	fm   *FontMap
+}
+
+// previewFonts lists the fonts that can be shown on the preview screen
+func (g *Game) previewFonts() []previewFont {
+	return []previewFont{
+		{"BIG SCROLL FONT", g.bsFont, g.bsFontMap},
+		{"VERTICAL SCROLL FONT", g.upFont, g.upFontMap},
+		{"SMALL FONT", g.lFont, g.lFontMap},
+	}
+}
+
+// GameState is a snapshot of everything that moves in the demo, enough to
+// reproduce an exact moment
+type GameState struct {
+	// Background animation
+	MoveY, HowmuchY, MoveX, HowmuchX, BgCount float64
+	Y, HY, X, Gox                             float64
+
+	// Sprite animation and the centre of the orbit
+	YChange, AddY, SinX, SinY, Swing, SwingY float64
+	OrbitX, OrbitY                           float64
+
+	BgScheme    int
+	CameraFrame int
+
+	// Scroll positions: big, vertical, then the two small scrolls, how far
+	// each is into its speed ramp and the hue of its color cycling
+	ScrollX         [4]float64
+	ScrollRampFrame [4]int
+	ScrollTintHue   [4]float64
+
+	BigScrollScale float64 // Section scale the big scroll is easing through
+	BigScrollWave  float64 // Phase of the big scroll's wave, in radians
+
+	MusicMs int64 // Position in the current tune
+}
+
+// CurrentScrollText returns the part of the big scroll currently readable on
+// screen, for accessibility tools or logging
+func (g *Game) CurrentScrollText() string {
+	if g.scrollText1 == nil {
+		return ""
+	}
+	return g.scrollText1.FullyVisibleText()
+}
+
+// SelfTest checks that every asset decoded, the fonts cover the scroll
+// texts and the music is playing, writing one PASS or FAIL line per check
+// to w. It returns an error if any check failed.
+func (g *Game) SelfTest(w io.Writer) error {
+	failed := 0
+	check := func(name string, ok bool, detail string) {
+		if ok {
+			fmt.Fprintf(w, "PASS %s\n", name)
+			return
+		}
+		failed++
+		fmt.Fprintf(w, "FAIL %s: %s\n", name, detail)
+	}
+
+	images := []struct {
+		name string
+		img  *ebiten.Image
+	}{
+		{"green background", g.bgGreen}, {"pink background", g.bgPink},
+		{"vertical raster", g.upRaster}, {"big scroll raster", g.bsRaster},
+		{"sprites", g.sprite},
+		{"big font", g.bsFont}, {"vertical font", g.upFont}, {"small font", g.lFont},
+	}
+	for _, im := range images {
+		check(im.name+" image", im.img != nil, "not decoded")
+	}
+
+	for i, s := range g.scrollTexts() {
+		name := scrollNames[i] + " scroll text"
+		if s == nil {
+			check(name, false, "not created")
+			continue
+		}
+		missing := s.MissingRunes()
+		check(name, len(missing) == 0, fmt.Sprintf("font lacks %q", string(missing)))
+	}
+
+	check("music", g.ymPlayer != nil && g.ymPlayer.LengthMs() > 0, "no tune loaded or zero length")
+	check("music layout", g.ymPlayer != nil && g.ymPlayer.InterleaveMode() != ymUnknown, "unrecognized YM header")
+	check("audio", g.audioContext != nil && g.audioPlayer != nil, "audio output not initialized")
+
+	if failed > 0 {
+		return fmt.Errorf("%d self-test checks failed", failed)
+	}
+	return nil
+}
+
+// scrollNames names the scroll texts in scrollTexts order
+var scrollNames = [4]string{"big", "vertical", "first small", "second small"}
+
+// scrollTexts returns the scroll texts in GameState.ScrollX order
+func (g *Game) scrollTexts() [4]*ScrollText {
+	return [4]*ScrollText{g.scrollText1, g.scrollText2, g.scrollText3, g.scrollText4}
+}
+
+// Snapshot captures the current animation, scroll and music positions
+func (g *Game) Snapshot() GameState {
+	st := GameState{
+		MoveY: g.moveY, HowmuchY: g.howmuchY, MoveX: g.moveX, HowmuchX: g.howmuchX, BgCount: g.bgcount,
+		Y: g.Y, HY: g.hY, X: g.X, Gox: g.gox,
+
+		YChange: g.ychange, AddY: g.addy, SinX: g.sinx, SinY: g.siny, Swing: g.swing, SwingY: g.swingy,
+		OrbitX: g.spx, OrbitY: g.spy,
+
+		BgScheme:    g.bgScheme,
+		CameraFrame: g.camera.frame,
+
+		BigScrollScale: g.bigScrollScale,
+	}
+	for i, s := range g.scrollTexts() {
+		if s != nil {
+			st.ScrollX[i] = s.scrollX
+			st.ScrollRampFrame[i] = s.rampFrame
+			st.ScrollTintHue[i] = s.tintHue
+		}
+	}
+	if g.scrollText1 != nil {
+		st.BigScrollWave = g.scrollText1.wavePhase
+	}
+	if g.ymPlayer != nil {
+		st.MusicMs = g.ymPlayer.CurrentTimeMs()
+	}
+	return st
+}
+
+// Restore returns the demo to a state taken with Snapshot, seeking the
+// music to the saved position
+func (g *Game) Restore(st GameState) {
+	g.moveY, g.howmuchY, g.moveX, g.howmuchX, g.bgcount = st.MoveY, st.HowmuchY, st.MoveX, st.HowmuchX, st.BgCount
+	g.Y, g.hY, g.X, g.gox = st.Y, st.HY, st.X, st.Gox
+	g.ychange, g.addy, g.sinx, g.siny, g.swing, g.swingy = st.YChange, st.AddY, st.SinX, st.SinY, st.Swing, st.SwingY
+	g.spx, g.spy = st.OrbitX, st.OrbitY
+
+	g.bgScheme = st.BgScheme
+	g.bgTransition = bgTransition{}
+	g.camera.frame = st.CameraFrame
+	g.bigScrollScale = st.BigScrollScale
+
+	for i, s := range g.scrollTexts() {
+		if s != nil {
+			s.scrollX = st.ScrollX[i]
+			s.rampFrame = st.ScrollRampFrame[i]
+			s.tintHue = st.ScrollTintHue[i]
+			s.tint = hsvColor(s.tintHue, 1, 1)
+		}
+	}
+	if g.scrollText1 != nil {
+		g.scrollText1.wavePhase = st.BigScrollWave
+	}
+	if g.ymPlayer != nil {
+		g.ymPlayer.SetPositionMs(st.MusicMs)
+		g.lastTick = g.ymPlayer.TickCount()
+	}
+}
+
+// advanceTicks returns how many replay ticks of the tune have passed since
+// the previous call
+func (g *Game) advanceTicks() int {
+	if g.ymPlayer == nil {
+		return 0
+	}
+	tick := g.ymPlayer.TickCount()
+	if tick < g.lastTick {
+		// The tune looped or was rewound
+		g.lastTick = 0
+	}
+	n := int(tick - g.lastTick)
+	g.lastTick = tick
+	return n
+}
+
+// quit starts the fade to black that ends the demo
+func (g *Game) quit() {
+	g.closing = true
+}
+
+// Stop ends the demo at once for a host application embedding it: the music
+// stops, the YM player is released and the next Update returns
+// ebiten.Termination. Like Update, it must be called on the game goroutine.
+// Cleanup is still safe to call afterwards.
+func (g *Game) Stop() {
+	g.stopMusic()
+	g.stopped = true
+}
+
+// FadeOutMusic fades the music to silence over d and waits for it. If the
+// audio stops being pulled, e.g. because the device went away, it gives up
+// shortly after d instead of blocking the exit.
+func (g *Game) FadeOutMusic(d time.Duration) {
+	if d <= 0 || g.ymPlayer == nil || g.audioPlayer == nil || !g.audioPlayer.IsPlaying() {
+		return
+	}
+	select {
+	case <-g.ymPlayer.FadeOut(d):
+	case <-g.clock.After(d + fadeOutGrace):
+	}
+}
+
+// closeAlpha returns the opacity of the exit fade, from 0 to 1
+func (g *Game) closeAlpha() float64 {
+	if g.cfg.ExitFadeFrames <= 0 {
+		return 1
+	}
+	return math.Min(1, float64(g.closeFrame)/float64(g.cfg.ExitFadeFrames))
+}
+
+// Update updates the game state
+func (g *Game) Update() error {
+	if g.stopped {
+		return ebiten.Termination
+	}
+
+	// Handle the keyboard controls
+	g.dispatchKeys(inpututil.IsKeyJustPressed)
+	if ebiten.IsWindowBeingClosed() {
+		g.quit()
+	}
+	if g.closing {
+		// Exit only once a fully black frame has been drawn
+		if g.closeAlpha() >= 1 {
+			return ebiten.Termination
+		}
+		g.closeFrame++
+	}
+
+	if g.musicEnded.CompareAndSwap(true, false) {
+		g.endMusic()
+	}
+
+	if g.cfg.PauseUnfocused {
+		g.setFocused(ebiten.IsFocused())
+	}
+	dt := g.frameDelta()
+	g.uiFrame++
+	if g.showStats && g.uiFrame%statsRefreshFrames == 0 {
+		g.refreshStats()
+	}
+	if g.titleStart.IsZero() {
+		// Not in NewGame, so a clock set with SetClock is used from the start
+		g.titleStart = g.clock.Now()
+	}
+	if g.noticeFrames > 0 {
+		g.noticeFrames--
+	}
+	if g.isPaused {
+		// Freeze the scene; Draw keeps showing it under the indicator
+		return nil
+	}
+	g.ticks = g.advanceTicks()
+	g.bgTransition.Step()
+	if g.cameraOn {
+		g.camera.Step()
+	}
+	g.confetti.Update(dt.Seconds(), g.confettiOn, float64(g.width), float64(g.height))
+	if g.grainOn {
+		g.grain.Step()
+	}
+	if g.followMouse {
+		g.followCursor()
+	}
+	if g.cfg.Pulse {
+		var level float64
+		if g.ymPlayer != nil {
+			level = g.ymPlayer.Level()
+		}
+		g.pulse.Step(level, dt)
+	}
+	if g.metronomeOn {
+		g.stepMetronome()
+	}
+	if g.vuOn {
+		var left, right float64
+		if g.ymPlayer != nil {
+			left, right = g.ymPlayer.Peaks()
+		}
+		g.vu[0].Step(left, dt)
+		g.vu[1].Step(right, dt)
+	}
+
+	// Advance the backgrounds and sprites once per video frame, or once per
+	// replay tick of the tune when synced to the music
+	if g.cfg.TickSync && g.ymPlayer != nil {
+		for i := 0; i < g.ticks; i++ {
+			g.stepAnimation()
 		}
 	} else {
-		s.scrollX -= s.speed
-		// Calculate total width of text
-		totalWidth := 0
-		for _, ch := range s.text {
-			if mapping, ok := s.fontMap.chars[ch]; ok {
-				totalWidth += mapping.width
-			} else if ch == ' ' {
-				totalWidth += s.fontMap.charWidth
-			}
+		g.stepAnimation()
+	}
+
+	// Update scroll texts
+	if g.scrollText1 != nil {
+		g.scrollText1.Update()
+		if g.cfg.SectionScale {
+			// Ease towards the scale of the section in the middle of the screen
+			g.bigScrollScale += (g.scrollText1.CenterScale() - g.bigScrollScale) * sectionScaleEase
 		}
-		if s.scrollX < -float64(totalWidth) {
-			s.scrollX = float64(screenWidth)
+		if g.scrollLog != nil {
+			var ms int64
+			if g.ymPlayer != nil {
+				ms = g.ymPlayer.CurrentTimeMs()
+			}
+			g.scrollLog.Check(g.scrollText1, ms)
 		}
 	}
+	if g.scrollText2 != nil {
+		g.scrollText2.Update() // Moves up at its speed of 3 and wraps below the screen
+	}
+	if g.scrollText3 != nil {
+		g.scrollText3.Update()
+	}
+	if g.scrollText4 != nil {
+		g.scrollText4.Update()
+	}
+
+	return nil
 }
 
-// Draw draws the scrolling text
-func (s *ScrollText) Draw(dst *ebiten.Image, y float64, scale float64) {
-	if s.vertical {
-		// Vertical scrolling - text moves from bottom to top
-		yPos := 400 - s.scrollX // Start from bottom of screen
+// stepAnimation advances the background and sprite motion by one step
+func (g *Game) stepAnimation() {
+	// Update background 1 animation
+	g.bgcount += 0.1
 
-		// Draw text in correct order (not reversed)
-		for _, char := range s.text {
-			if yPos > -float64(s.fontMap.charHeight)*scale && yPos < 400 {
-				s.drawChar(dst, char, 0, yPos, scale)
-			}
-			yPos += float64(s.fontMap.charHeight) * scale
+	if g.moveY < -400 {
+		g.howmuchY = g.cfg.Bg1SpeedY
+	}
+	if g.moveY > 0 {
+		g.howmuchY = -g.cfg.Bg1SpeedY
+	}
+	g.moveY += g.howmuchY
+
+	if g.bgcount > 10 {
+		if g.moveX < -640*2 {
+			g.howmuchX = g.cfg.Bg1SpeedX
 		}
-	} else {
-		// Horizontal scrolling
-		x := s.scrollX
-		for _, char := range s.text {
-			if mapping, ok := s.fontMap.chars[char]; ok {
-				if x > -float64(mapping.width)*scale && x < float64(screenWidth) {
-					s.drawChar(dst, char, x, y, scale)
-				}
-				x += float64(mapping.width) * scale
-			} else if char == ' ' {
-				x += float64(s.fontMap.charWidth) * scale
-			}
+		if g.moveX > 0 {
+			g.howmuchX = -g.cfg.Bg1SpeedX
 		}
+		g.moveX += g.howmuchX
+	}
+
+	if g.bgcount > 20 {
+		g.bgcount = 0
+	}
+
+	// Update background 2 animation
+	if g.Y < -400 {
+		g.hY = g.cfg.Bg2SpeedY
+		g.gox = g.cfg.Bg2SpeedX
+	}
+	if g.Y > 0 {
+		g.hY = -g.cfg.Bg2SpeedY
+		g.gox = -g.cfg.Bg2SpeedX
+	}
+
+	g.X += g.gox
+	if g.X < -710 {
+		g.X = -710
+	}
+	if g.X > 0 {
+		g.X = 0
+	}
+	g.Y += g.hY
+
+	// Update sprite animation
+	if g.ychange > g.cfg.SwingAmplitude {
+		g.addy = -0.1
 	}
+	if g.ychange < -g.cfg.SwingAmplitude {
+		g.addy = 0.1
+	}
+	g.ychange += g.addy
+
+	g.swing += 0.02
+	g.swingy += 0.03
+	g.siny = g.ychange * math.Sin(g.swingy)
 }
 
-// drawChar draws a single character
-func (s *ScrollText) drawChar(dst *ebiten.Image, char rune, x, y, scale float64) {
-	// Convert to uppercase if needed
-	char = unicode.ToUpper(char)
+// Draw draws the game
+func (g *Game) Draw(screen *ebiten.Image) {
+	// Draw into an offscreen copy when it needs a final pass
+	target := screen
+	if g.gamma != 1 || g.mirrored {
+		if g.postCanvas == nil {
+			g.postCanvas = ebiten.NewImage(g.width, g.height)
+		}
+		g.postCanvas.Clear()
+		target = g.postCanvas
+	}
 
-	mapping, ok := s.fontMap.chars[char]
-	if !ok {
-		return // Character not in font map
+	switch {
+	case g.fontPreview > 0:
+		g.drawFontPreview(target, g.previewFonts()[g.fontPreview-1])
+	case g.frame == nil:
+		g.drawScene(target)
+	default:
+		// Render offscreen, then scale the shown region up to the screen
+		g.drawScene(g.frame)
+		src := g.frame.Bounds()
+		if !g.cfg.Crop.Empty() {
+			src = cropSource(g.cfg.Crop, g.upscale)
+		}
+		op := &ebiten.DrawImageOptions{}
+		op.GeoM.Scale(float64(g.width)/float64(src.Dx()), float64(g.height)/float64(src.Dy()))
+		target.DrawImage(g.frame.SubImage(src).(*ebiten.Image), op)
 	}
 
-	srcRect := image.Rect(mapping.x, mapping.y, mapping.x+mapping.width, mapping.y+mapping.height)
+	if g.grainOn {
+		g.grain.Draw(target)
+	}
+	if g.closing {
+		vector.DrawFilledRect(target, 0, 0, float32(g.width), float32(g.height), color.RGBA{A: uint8(0xff * g.closeAlpha())}, false)
+	}
 
-	op := &ebiten.DrawImageOptions{}
-	op.GeoM.Scale(scale, scale)
-	op.GeoM.Translate(x, y)
+	if target != screen {
+		var post ebiten.GeoM
+		if g.mirrored {
+			post = mirrorGeoM(float64(g.width))
+		}
+		switch {
+		case g.gamma == 1:
+			op := &ebiten.DrawImageOptions{}
+			op.GeoM = post
+			screen.DrawImage(target, op)
+		case g.loadGammaShader():
+			op := &ebiten.DrawRectShaderOptions{}
+			op.GeoM = post
+			op.Images[0] = target
+			op.Uniforms = map[string]any{"InvGamma": float32(1 / g.gamma)}
+			screen.DrawRectShader(g.width, g.height, g.gammaShader, op)
+		default:
+			g.correctGammaOnCPU(target)
+			op := &ebiten.DrawImageOptions{}
+			op.GeoM = post
+			screen.DrawImage(target, op)
+		}
+	}
+
+	if g.recorder != nil {
+		g.captureFrame(screen)
+	}
 
-	dst.DrawImage(s.fontImg.SubImage(srcRect).(*ebiten.Image), op)
+	// Last, so it sits above every effect and stays out of recordings
+	if g.showStats {
+		g.drawSmallTextGeoM(screen, g.statsText, 4, 16, 1, 1, ebiten.GeoM{})
+	}
 }
 
-// Game represents the game state
-type Game struct {
-	// Images
-	bgGreen  *ebiten.Image
-	bgPink   *ebiten.Image
-	upRaster *ebiten.Image
-	bsRaster *ebiten.Image
-	sprite   *ebiten.Image
-	bsFont   *ebiten.Image
-	upFont   *ebiten.Image
-	lFont    *ebiten.Image
+// toggleStats shows or hides the FPS / TPS readout
+func (g *Game) toggleStats() {
+	g.showStats = !g.showStats
+	g.refreshStats()
+}
 
-	// Font maps
-	bsFontMap *FontMap
-	upFontMap *FontMap
-	lFontMap  *FontMap
+// refreshStats reformats the FPS / TPS readout from the current rates
+func (g *Game) refreshStats() {
+	g.statsText = fmt.Sprintf("FPS: %.0f TPS: %.0f", ebiten.ActualFPS(), ebiten.ActualTPS())
+}
 
-	// Canvases
-	bgCanvas  *ebiten.Image
-	bg2Canvas *ebiten.Image
-	bsCanvas  *ebiten.Image
-	bs2Canvas *ebiten.Image
-	upCanvas  *ebiten.Image
-	lCanvas   *ebiten.Image
-	l2Canvas  *ebiten.Image
+// mirrorGeoM flips an image of the given width horizontally in place
+func mirrorGeoM(width float64) ebiten.GeoM {
+	var geoM ebiten.GeoM
+	geoM.Scale(-1, 1)
+	geoM.Translate(width, 0)
+	return geoM
+}
 
-	// Animation state
-	moveY    float64
-	howmuchY float64
-	moveX    float64
-	howmuchX float64
-	bgcount  float64
+// toggleMirror flips the whole picture horizontally. It is purely visual:
+// the scrolls then read backwards and move left to right.
+func (g *Game) toggleMirror() {
+	g.mirrored = !g.mirrored
+}
 
-	Y   float64
-	hY  float64
-	X   float64
-	gox float64
+// gammaShaderSrc applies gamma correction to straight (unpremultiplied) color
+var gammaShaderSrc = []byte(`//kage:unit pixels
 
-	ychange float64
-	addy    float64
-	sinx    float64
-	siny    float64
-	swing   float64
-	swingy  float64
-	spx     float64
-	spy     float64
+package main
 
-	// Scroll texts
-	scrollText1 *ScrollText
-	scrollText2 *ScrollText
-	scrollText3 *ScrollText
-	scrollText4 *ScrollText
+var InvGamma float
 
-	// Audio
-	audioContext *audio.Context
-	audioPlayer  *audio.Player
-	ymPlayer     *YMPlayer
+func Fragment(dstPos vec4, srcPos vec2, color vec4) vec4 {
+	c := imageSrc0At(srcPos)
+	if c.a == 0 {
+		return c
+	}
+	return vec4(pow(c.rgb/c.a, vec3(InvGamma))*c.a, c.a)
+}
+`)
+
+// loadGammaShader compiles the gamma shader on first use, reporting whether
+// it is available
+func (g *Game) loadGammaShader() bool {
+	if g.gammaShader == nil && !g.gammaOnCPU {
+		s, err := ebiten.NewShader(gammaShaderSrc)
+		if err != nil {
+			log.Printf("Failed to compile gamma shader, correcting on the CPU: %v", err)
+			g.gammaOnCPU = true
+			return false
+		}
+		g.gammaShader = s
+	}
+	return g.gammaShader != nil
 }
 
-// NewGame creates a new game instance
-func NewGame() *Game {
-	g := &Game{
-		moveY:    0,
-		howmuchY: 1,
-		moveX:    0,
-		howmuchX: 1,
-		bgcount:  0,
-		Y:        0,
-		hY:       1,
-		X:        0,
-		gox:      0,
-		ychange:  0,
-		addy:     0.1,
-		sinx:     0,
-		siny:     0,
-		swing:    0,
-		swingy:   0,
-		spx:      304,
-		spy:      100,
+// gammaLUT returns the gamma correction of every 8-bit channel value, the
+// same curve as the gamma shader
+func gammaLUT(gamma float64) [256]uint8 {
+	var lut [256]uint8
+	for i := range lut {
+		lut[i] = uint8(math.Round(255 * math.Pow(float64(i)/255, 1/gamma)))
 	}
+	return lut
+}
 
-	// Load images
-	g.loadImages()
+// correctGammaOnCPU applies the gamma correction to a screen sized image
+// through a lookup table, for when the shader is unavailable. The scene is
+// opaque, so the color channels need no unpremultiplying.
+func (g *Game) correctGammaOnCPU(img *ebiten.Image) {
+	if n := 4 * g.width * g.height; len(g.gammaPixels) != n {
+		g.gammaPixels = make([]byte, n)
+	}
+	img.ReadPixels(g.gammaPixels)
+	lut := gammaLUT(g.gamma)
+	for i := 0; i < len(g.gammaPixels); i += 4 {
+		px := g.gammaPixels[i : i+3]
+		px[0], px[1], px[2] = lut[px[0]], lut[px[1]], lut[px[2]]
+	}
+	img.WritePixels(g.gammaPixels)
+}
 
-	// Create canvases
-	g.bgCanvas = ebiten.NewImage(640*3, 400*2)
-	g.bg2Canvas = ebiten.NewImage(640*3, 400*2)
-	g.bsCanvas = ebiten.NewImage(640, 40)
-	g.bs2Canvas = ebiten.NewImage(640, 200)
-	g.upCanvas = ebiten.NewImage(32, 400)
-	g.lCanvas = ebiten.NewImage(320, 8)
-	g.l2Canvas = ebiten.NewImage(320, 8)
+// SetGamma sets the gamma correction of the final image, clamped to a sane
+// range; 1 leaves the image untouched and larger values brighten it
+func (g *Game) SetGamma(gamma float64) {
+	g.gamma = math.Max(minGamma, math.Min(gamma, maxGamma))
+}
 
-	// Initialize background canvases
-	g.initBackgrounds()
+// SetMasterVolume sets the music volume, clamped to [0, 1]; it survives
+// track changes for the rest of the session
+func (g *Game) SetMasterVolume(volume float64) {
+	g.masterVolume = math.Max(0, math.Min(volume, 1))
+	g.applyVolume()
+}
 
-	// Initialize scroll texts
-	g.initScrollTexts()
+// applyVolume passes the master volume on to the current tune. Only the YM
+// player applies it, ramped and with exact silence at 0; the audio player
+// stays at full gain so the volume is not applied twice.
+func (g *Game) applyVolume() {
+	if g.ymPlayer != nil {
+		g.ymPlayer.SetVolume(g.masterVolume)
+	}
+}
 
-	// Initialize audio
-	g.initAudio()
+// volumeUp raises the music volume by one step
+func (g *Game) volumeUp() {
+	g.SetMasterVolume(g.masterVolume + volumeStep)
+	g.showVolume()
+}
 
-	return g
+// volumeDown lowers the music volume by one step
+func (g *Game) volumeDown() {
+	g.SetMasterVolume(g.masterVolume - volumeStep)
+	g.showVolume()
 }
 
-// loadImages loads all image assets
-func (g *Game) loadImages() {
-	var err error
+// showVolume flashes the volume as a percentage; the small font has no
+// percent sign, so it is spelled out
+func (g *Game) showVolume() {
+	if g.masterVolume == 0 {
+		g.showNotice("MUTED")
+		return
+	}
+	g.showNotice(fmt.Sprintf("VOLUME %d PERCENT", int(math.Round(g.masterVolume*100))))
+}
 
-	// Load background images
-	img, _, err := image.Decode(bytes.NewReader(bgGreenData))
-	if err == nil {
-		g.bgGreen = ebiten.NewImageFromImage(img)
+// brighten raises the gamma correction by one step
+func (g *Game) brighten() {
+	g.SetGamma(g.gamma + gammaStep)
+	g.showNotice(fmt.Sprintf("GAMMA %.1f", g.gamma))
+}
+
+// darken lowers the gamma correction by one step
+func (g *Game) darken() {
+	g.SetGamma(g.gamma - gammaStep)
+	g.showNotice(fmt.Sprintf("GAMMA %.1f", g.gamma))
+}
+
+// drawScene draws the whole demo scene, applying sceneGeoM to every layer
+func (g *Game) drawScene(screen *ebiten.Image) {
+	// Clear screen
+	screen.Fill(g.bgClearColor)
+
+	// Draw backgrounds, crossfading to the new scheme while switching
+	if !g.bgTransition.active {
+		g.drawBackgrounds(screen, g.bgScheme, g.sceneGeoM)
+	} else {
+		g.drawBackgrounds(screen, g.bgTransition.from, g.sceneGeoM)
+
+		if g.bgFadeCanvas == nil {
+			g.bgFadeCanvas = ebiten.NewImage(g.width, g.height)
+		}
+		g.bgFadeCanvas.Clear()
+		g.drawBackgrounds(g.bgFadeCanvas, g.bgTransition.to, ebiten.GeoM{})
+
+		op := &ebiten.DrawImageOptions{}
+		op.GeoM.Concat(g.sceneGeoM)
+		op.ColorScale.ScaleAlpha(float32(g.bgTransition.Alpha()))
+		screen.DrawImage(g.bgFadeCanvas, op)
 	}
 
-	img, _, err = image.Decode(bytes.NewReader(bgPinkData))
-	if err == nil {
-		g.bgPink = ebiten.NewImageFromImage(img)
+	// Draw sprites
+	if g.showPath {
+		g.drawSpritePath(screen)
 	}
+	g.drawSprites(screen)
 
-	// Load raster images
-	img, _, err = image.Decode(bytes.NewReader(upRasterData))
-	if err == nil {
-		g.upRaster = ebiten.NewImageFromImage(img)
+	// Draw big scroll
+	g.drawBigScroll(screen)
+
+	// Draw up scroll
+	g.drawUpScroll(screen)
+
+	// Draw small scrolls
+	g.drawSmallScrolls(screen)
+
+	g.drawConfetti(screen)
+
+	if g.vuOn {
+		g.drawVUMeter(screen)
+	}
+	if g.voicesOn {
+		g.drawVoices(screen)
+	}
+	if g.metronomeOn {
+		g.drawMetronome(screen)
 	}
 
-	img, _, err = image.Decode(bytes.NewReader(bsRasterData))
-	if err == nil {
-		g.bsRaster = ebiten.NewImageFromImage(img)
+	// Show the current notice for a while
+	if g.noticeFrames > 0 {
+		g.drawSmallText(screen, g.notice, 8, float64(g.height-24), 2)
 	}
 
-	// Load sprite
-	img, _, err = image.Decode(bytes.NewReader(spriteData))
-	if err == nil {
-		g.sprite = ebiten.NewImageFromImage(img)
+	if g.cfg.SongInfo {
+		g.drawSongInfo(screen)
 	}
 
-	// Load fonts
-	img, _, err = image.Decode(bytes.NewReader(bsFontData))
-	if err == nil {
-		g.bsFont = ebiten.NewImageFromImage(img)
+	if !g.titleStart.IsZero() {
+		g.drawTitleCard(screen, titleCardAlpha(g.clock.Now().Sub(g.titleStart), g.cfg.TitleCard))
 	}
 
-	img, _, err = image.Decode(bytes.NewReader(upFontData))
-	if err == nil {
-		g.upFont = ebiten.NewImageFromImage(img)
+	if g.showHelp {
+		g.drawHelp(screen)
 	}
 
-	img, _, err = image.Decode(bytes.NewReader(lFontData))
-	if err == nil {
-		g.lFont = ebiten.NewImageFromImage(img)
+	if g.isPaused {
+		g.drawPaused(screen)
 	}
 }
 
-// initBackgrounds initializes the background canvases
-func (g *Game) initBackgrounds() {
-	// Initialize green background
-	if g.bgGreen != nil {
-		for y := 0; y < 2; y++ {
-			for x := 0; x < 3; x++ {
-				op := &ebiten.DrawImageOptions{}
-				op.GeoM.Translate(float64(640*x), float64(400*y))
-				g.bgCanvas.DrawImage(g.bgGreen, op)
-			}
+// songInfoLine formats a song's title and author for display, leaving out
+// whichever is missing; it is empty when both are
+func songInfoLine(info stsound.YmMusicInfo) string {
+	var parts []string
+	for _, s := range []string{info.SongName, info.SongAuthor} {
+		if s = strings.TrimSpace(s); s != "" {
+			parts = append(parts, strings.ToUpper(s))
 		}
 	}
+	return strings.Join(parts, " BY ")
+}
 
-	// Initialize pink background
-	if g.bgPink != nil {
-		for y := 0; y < 2; y++ {
-			for x := 0; x < 3; x++ {
-				op := &ebiten.DrawImageOptions{}
-				op.GeoM.Translate(float64(640*x), float64(400*y))
-				g.bg2Canvas.DrawImage(g.bgPink, op)
-			}
-		}
+// drawSongInfo shows the playing song's title and author in the top-left
+// corner, above the first small scroll
+func (g *Game) drawSongInfo(screen *ebiten.Image) {
+	if g.ymPlayer == nil {
+		return
+	}
+	if line := songInfoLine(g.ymPlayer.Info()); line != "" {
+		g.drawSmallTextAlpha(screen, line, 4, 4, 1, 0.8)
 	}
 }
 
-// initScrollTexts initializes the scrolling texts
-func (g *Game) initScrollTexts() {
-	// Initialize font maps
-	g.bsFontMap = initBigScrollFont()
-	g.upFontMap = initUpScrollFont()
-	g.lFontMap = initSmallFont()
-
-	// Main scroll text
-	mainText := "                                 HI AND WELCOME TO THE GRODAN AND KVACK KVACK DEMO (THAT NAME WILL PROBABLY MAKE US FAMOUS IN THE GUINNESS BOOK OF RECORDS - THE MOST STUPID NAME IN DEMO HISTORY.  THE PREVIOUS POSSESSORS OF THAT RECORD WAS OMEGA WITH -OMEGAKUL-.   I'M AFRAID WE WILL SOON BE BEATEN BY SYNC'S 'MJOFFE-DEMO', WITH TWO DOTS ABOVE THE 'O'.  DID YOU KNOW THAT THIS IS A COMMENT IN THE MIDDLE OF A SENTENCE? NO?  WE ALSO FORGOT, BUT LET'S CONTINUE WITH WHAT WE WERE WRITING BEFORE WE STARTED WRITING THIS RECORD-CRAP.), CODED BY NICK AND JAS OF THE CAREBEARS. GRAPHIXXXX BY TANIS, THE GREAT (?) OF THE MEGAMIGHTY CAREBEARS.        WE HAVE TO COVER TWO SUBJECTS IN THIS SCROLLTEXT - THE FANTASTIC WORLD OF HARDWARESCROLLERS  AND  GREETINGS....   LET'S START WITH THE STUFF YOU PROBABLY WANT US TO TALK THE MOST ABOUT - HARDWARESCROLLERS....        TIME: LATE MARCH 1989    PLACE: NICK'S COMPUTER ROOM     IT WORKS!!!!!!!  AFTER HAVING TRIED THE ZANY SCROLLTECHNIQUE ON BOTH NICK'S AND JAS' COMPUTERS, WE CONCLUDED THAT IT ACTUALLY WORKED.    ONE DAY LATER, OMEGA CALLS US AND GOES SOMETHING LIKE THIS: - HAAAA HAAAA  WE KNOW HOW TO SCROLL THE WHOLE SCREEN BOTH HORIZONTALLY AND VERTICALLY IN LESS THAN TEN SCANLINES!!!!!!         WE WERE AMAZED THAT THEY HAD ACTUALLY COME UP WITH THE SAME IDEA ON THE SAME DAY AS US, BUT AT LEAST NOBODY ELSE KNEW HOW TO DO IT.     WE MANAGED TO RELEASE THE FIRST HARDWARESCROLLER THE WORLD HAS SEEN, IN THE CUDDLY DEMOS, AND NOW WE ARE GOING TO USE IT COMERCIALLY (CODING GAMES, DICKHEAD)....     NOW A HINT HOW IT'S DONE:    IT HAS NOTHING TO DO WITH ANY OF THE SOUND-REGISTERS.....         HERE IS ANOTHER ADDRESS TO THE CAREBEARS:     T H E   C A R E B E A R S ,    D R A K E N B E R G S G   2 3    8 T R ,      1 1 7   4  1   S T O  C K H O L M ,     S W E  D E N .                NOW FOR SOME GREETINGS:   MEGADUNDERSUPERDUPERGREETINGS TO  ALL THE OTHER MEMBERS OF THE UNION, ESPECIALLY THE EXCEPTIONS (TANIS WISH TO GIVE A SPECIAL HI TO ES) AND THE REPLICANTS (GOODBYE, RATBOY! YOUR INTROS WERE GREAT).   NORMAL MEGAGREETINGS (IN MERIT-ORDER)(WOW) TO   SYNC (WE'VE CHANGED OUR MINDS, YOU'RE THE SECOND BEST SWEDISH CREW. WE JUST HADN'T SEEN MANY SCREENS BY YOU GUYS (IT'S UNDERSTANDABLE - YOU HAVE ONLY RELEASED THREE NOT VERY GOOD ONES)),  OMEGA (TOO BAD, YOU'RE NOT THE SECOND BEST ANYMORE.  PERHAPS IT HAS SOMETHING TO DO WITH  THE TERA-DISTER, THE 'TCB-E'-JATTEDUMMA'-SIGN OR THE FACT THAT SYNC IS BETTER), THE LOST BOYS (SEE YA' SOON AND WE'RE ANXIOUSLY AWAITING YOUR MEGAMEGADEMO)             SOMETHING BETWEEN MEGAGREETINGS AND NORMAL GREETINGS TO:   FLEXIBLE FRONT (GOODBYE), VECTOR (SO YOU CRACKED OUR DEMO, HUH? NICE SCREEN, BY THE WAY), GHOST (SO YOU TRIED TO CRACK OUR DEMO, HUH? GREAT SCREEN, BY THE WAY), 2 LIFE CREW (YOU ARE IMPROVING), MAGNUM FORCE (YOU SEEM TO BE THE BEST OPTIMIZERS IN FRANCE!), NORDIK CODERS (NICE SCREEN).   NORMAL GREETINGS TO:  FASHION (GOOD LUCK WITH YOUR DEMO), OVERLANDERS (THANKS FOR NOT INCLUDING CUDDLY IN YOUR DEMOBREAKER), NO CREW (ESPECIALLY ROCCO. YOU ARE IMPROVING), AUTOMATION (GREAT COMPACT DISKS), MEDWAY BOYS (NICE CD'S),  ST CONNEXION (HOPE YOUR DEMO WILL BE AS GOOD AS YOUR GRAPHICS), FOXX (COOL SCREEN), FOFT (KEEP ON COMPACTING), ZAE (WE HAD A GREAT TIME IN MARSEILLE), KREATORS (ESPECIALLY CHUD), M.A.R.K.U.S (PLEASE SPREAD THIS DEMO AS MUCH AS YOU SPREAD CUDDLY DEMOS), HACKATARIMAN (THANKS FOR ALL THE STUFF), THE ALLIANCE (ESPECIALLY OVERLANDERS (THANKS FOR TCB-FRIENDLY SCROLLTEXTS AND MANY NICE SCREENS), AND BLACK MONOLITH TEAM (YOUR DEMOSCREEN WAS THE BEST IN THE OLD ALLIANCE DEMO), BIRDY (SEND US YOUR CRACKS), LINKAN 'THE LINK' 'JUDGE LINK' LINKSSON (PING-PONG), NYARLOTHATEPS ADEPTS (STRANGE NAME, STRANGE GUYS), GROWTWIG ( NO COMMENT),  TONY KOLLBERG (TJENA, LYCKA TILL MED ASSEMBLERN)     END OF GREETINGS. IF YOU WERE NOT GREETED, TOO BAD. NORMAL FUCKING GREETINGS TO:  CONSTELLATIONS (NOONE WILL EVER COMPLAIN ABOUT TCB AND GET AWAY WITH IT, BESIDES YOUR DEMO WAS WORTHLESS). MEGA FUCKING GREETINGS TO:     MENACING CRACKING ALLIANCE (SO, YOU DON'T LIKE BEING CALLED LAMERS, HOW YA' LIKE BEING CALLED:       MOTHERFUCKIN'   BLEEDIN' (BRITTISH ENGLISH) ULTIMATE CHICKENBRAINS????!!!! I BET IT'S ALMOST AS FUN AS FUCKING GREET TCB).  END OF SCROLLTEXT. LET'S WRAP."
-
-	// Vertical scroll text
-	vertText := "                           TANIS, THE FAMOUS GRAFIXX-MAN, IS A NEW MEMBER OF TCB.  HE MADE ALL THE GRAPHICS IN THIS SCREEN PLUS LOTSA LOGOS IN THE MAIN MENU.  WE AGREE THAT THIS 'ONE-BIT-PLANE-MANIA' DOESN'T LOOK VERY GOOD, BUT IT HAD TO BE DONE BY SOMEONE........   BAD LUCK FOR TANIS THAT WE WON'T MAKE MORE DEMOS, THOUGH....       9 9 9 9 9 9 9 9 9 9 9 9 9 9 9 9 9 9 9  ..................                 LET'S WRAP (WE SPELLED IT CORRECTLY!!!).......   "
-
-	// Small scroll texts
-	smallText1 := "                                                        ONCE UPON A TIME, WHEN THE JUNK DEMO WAS ALMOST FINISHED - WHEN THE BEST DEMO ON THE ST-MARKET WAS 'LCD' BY TEX, WE VISITED IQ2-CREW (AMIGA-FREAKS). THEY SHOWED US A COUPLE OF DEMOS AND ONE OF THEM WAS THE TECHTECH-DEMO BY SODAN AND MAGICIAN 42. KRILLE AND PUTTE LAUGHED AT US AND SAID THAT IT WAS TOTALLY IMPOSSIBLE TO MAKE ON AN ST. WE STUDIED IT FOR HALF AN HOUR AND SAID: -OF COURSE IT'S POSSIBLE.   WHEN WE WERE BACK HOME (WHEN NO AMIGA-OWNER WAS LISTENING), WE CONCLUDED THAT THERE WAS SIMPLY TOO MUCH MOVEMENT FOR AN ST.        NOW, WE HAVE CONVERTED IT ANYWAY. THE AMIGA VERSION HAD SOME UGLY LINES WHIZZING AROUND, BUT WE HAVE 3 VOICE REAL DIGISOUND AND SOME UGLY SPRITES. BESIDES, WE HAVE SOME TERRIBLE RASTERS.......            WE AGREE THAT THERE ARE BETTER AMIGA-DEMOS NOW, AND PERHAPS WE WILL CONVERT SOME MORE IN THE FUTURE.......     LET'S WRAZZZZZZZ................"
-
-	smallText2 := "                               EVERYBODY THOUGHT IT WAS IMPOSSIBLE.....                                     EVEN WE THOUGHT IT WAS IMPOSSIBLE......                                       IT'S A PITY IT WASN'T.....                                                 THE CAREBEARS PRESENT THE UGLIEST DEMO SO FAR - THE GRODAN AND KVACK KVACK DEMO, A CONVERSION OF THE STUNNING TECHTECH DEMO BY SODAN AND MAGICIAN 42 (ON THE COMPUTER THAT CRASHES WHEN YOU ENTER SUPERVISOR MODE IN SEKA).   IT WAS UGLY ON THE AMIGA TOO, BUT IT SURE KNOCKED YOU OFF THE CHAIR WHEN YOU SAW IT THE FIRST TIME.    "
-
-	if g.bsFont != nil && g.bsFontMap != nil {
-		g.scrollText1 = NewScrollText(mainText, g.bsFont, g.bsFontMap, 2, false)
-	}
-	if g.upFont != nil && g.upFontMap != nil {
-		g.scrollText2 = NewScrollText(vertText, g.upFont, g.upFontMap, 3, true) // Vertical scroll
-		g.scrollText2.scrollX = -100                                            // Start below screen
+// titleCardAlpha returns the opacity of the title card after elapsed time
+// on screen: fully opaque, then fading out over the last titleFade of its
+// display time, and zero from then on
+func titleCardAlpha(elapsed, display time.Duration) float64 {
+	if elapsed >= display {
+		return 0
 	}
-	if g.lFont != nil && g.lFontMap != nil {
-		g.scrollText3 = NewScrollText(smallText1, g.lFont, g.lFontMap, 1, false)
-		g.scrollText4 = NewScrollText(smallText2, g.lFont, g.lFontMap, 2, false)
+	fade := min(titleFade, display)
+	if left := display - elapsed; left < fade {
+		return float64(left) / float64(fade)
 	}
+	return 1
 }
 
-// initAudio initializes the audio system
-func (g *Game) initAudio() {
-	g.audioContext = audio.NewContext(sampleRate)
-
-	var err error
-	g.ymPlayer, err = NewYMPlayer(musicData, sampleRate, true)
-	if err != nil {
-		log.Printf("Failed to create YM player: %v", err)
+// drawTitleCard draws the demo title and how to get help, centered
+func (g *Game) drawTitleCard(screen *ebiten.Image, alpha float64) {
+	if alpha <= 0 {
 		return
 	}
 
-	g.audioPlayer, err = g.audioContext.NewPlayer(g.ymPlayer)
-	if err != nil {
-		log.Printf("Failed to create audio player: %v", err)
-		g.ymPlayer.Close()
-		g.ymPlayer = nil
-		return
+	helpKey := "H"
+	for _, b := range g.bindings {
+		if b.name == "help" {
+			helpKey = b.label
+		}
 	}
+	lines := []string{"GRODAN AND KVACK KVACK DEMO", "PRESS " + helpKey + " FOR HELP"}
+
+	const scale = 2
+	y := (float64(g.height) - float64(len(lines)*12*scale)) / 2
+	for _, line := range lines {
+		w := float64(len(line)*8) * scale
+		g.drawSmallTextAlpha(screen, line, (float64(g.width)-w)/2, y, scale, alpha)
+		y += 12 * scale
+	}
+}
 
-	g.audioPlayer.SetVolume(0.7)
-	g.audioPlayer.Play()
+// pauseBlinkVisible reports whether the blinking pause label is shown on the
+// given UI frame; it alternates every pauseBlinkFrames frames
+func pauseBlinkVisible(uiFrame int) bool {
+	return uiFrame/pauseBlinkFrames%2 == 0
 }
 
-// Update updates the game state
-func (g *Game) Update() error {
-	// Update background 1 animation
-	g.bgcount += 0.1
+// drawPaused dims the frozen scene and shows a blinking PAUSED label
+func (g *Game) drawPaused(screen *ebiten.Image) {
+	b := screen.Bounds()
+	vector.DrawFilledRect(screen, 0, 0, float32(b.Dx()), float32(b.Dy()), color.RGBA{A: 0x80}, false)
 
-	if g.moveY < -400 {
-		g.howmuchY = 1
+	if pauseBlinkVisible(g.uiFrame) {
+		const label, scale = "PAUSED", 3
+		w := float64(len(label)*8) * scale
+		g.drawSmallText(screen, label, (float64(g.width)-w)/2, (float64(g.height)-8*scale)/2, scale)
 	}
-	if g.moveY > 0 {
-		g.howmuchY = -1
+}
+
+// drawConfetti draws the confetti particles over the scene
+func (g *Game) drawConfetti(screen *ebiten.Image) {
+	size := float32(confettiSize / g.upscale)
+	for _, p := range g.confetti.particles {
+		x, y := g.sceneGeoM.Apply(p.x, p.y)
+		vector.DrawFilledRect(screen, float32(x), float32(y), size, size, p.clr, false)
 	}
-	g.moveY += g.howmuchY
+}
 
-	if g.bgcount > 10 {
-		if g.moveX < -640*2 {
-			g.howmuchX = 16
+// drawVoices draws one animated wave per AY channel in the top-right
+// corner, as tall as the channel is loud and denser as its pitch rises
+func (g *Game) drawVoices(screen *ebiten.Image) {
+	if g.ymPlayer == nil {
+		return
+	}
+	clr := color.RGBA{0x40, 0xe0, 0x40, 0xff}
+	var played time.Duration
+	if g.audioPlayer != nil {
+		played = g.audioPlayer.Position()
+	}
+	for i, v := range g.ymPlayer.Voices(played) {
+		left := float64(g.width - 8 - voiceWidth)
+		mid := float64(8+voiceHeight/2) + float64(i*voiceHeight)
+
+		var amp, cycles float64
+		if v.ToneOn {
+			amp = float64(voiceHeight) / 2 * voiceLevel(v) / 15
+			if v.Period > 0 {
+				cycles = math.Min(voiceMaxCycles, voicePitchScale/float64(v.Period))
+			}
 		}
-		if g.moveX > 0 {
-			g.howmuchX = -16
+		phase := float64(g.uiFrame) * 0.3
+
+		var prevX, prevY float64
+		for x := 0; x <= voiceWidth; x += 2 {
+			px := left + float64(x)
+			py := mid - amp*math.Sin(2*math.Pi*cycles*float64(x)/voiceWidth+phase)
+			px, py = g.sceneGeoM.Apply(px, py)
+			if x > 0 {
+				vector.StrokeLine(screen, float32(prevX), float32(prevY), float32(px), float32(py), 1, clr, false)
+			}
+			prevX, prevY = px, py
 		}
-		g.moveX += g.howmuchX
 	}
+}
 
-	if g.bgcount > 20 {
-		g.bgcount = 0
+// voiceLevel returns a channel's loudness from 0 to 15, counting channels
+// driven by the envelope as fully loud
+func voiceLevel(v VoiceState) float64 {
+	if v.Envelope {
+		return 15
 	}
+	return float64(v.Volume)
+}
 
-	// Update background 2 animation
-	if g.Y < -400 {
-		g.hY = 2
-		g.gox = 16
-	}
-	if g.Y > 0 {
-		g.hY = -2
-		g.gox = -16
+// drawVUMeter draws the left and right music levels as two bars in the
+// bottom-right corner
+func (g *Game) drawVUMeter(screen *ebiten.Image) {
+	w, h := float32(vuBarWidth/g.upscale), float32(vuBarHeight/g.upscale)
+	for i, e := range g.vu {
+		x, y := g.sceneGeoM.Apply(float64(g.width)-8-float64(len(g.vu)-i)*(vuBarWidth+vuBarGap), float64(g.height)-8-vuBarHeight)
+		vector.DrawFilledRect(screen, float32(x), float32(y), w, h, color.RGBA{A: 0x80}, false)
+
+		level := float32(math.Min(e.value, 1))
+		clr := color.RGBA{0x40, 0xe0, 0x40, 0xff}
+		if level > vuHot {
+			clr = color.RGBA{0xff, 0x40, 0x40, 0xff}
+		}
+		vector.DrawFilledRect(screen, float32(x), float32(y)+h*(1-level), w, h*level, clr, false)
 	}
+}
 
-	g.X += g.gox
-	if g.X < -710 {
-		g.X = -710
-	}
-	if g.X > 0 {
-		g.X = 0
-	}
-	g.Y += g.hY
+// drawHelp draws the keyboard help overlay over a dimmed scene
+func (g *Game) drawHelp(screen *ebiten.Image) {
+	b := screen.Bounds()
+	vector.DrawFilledRect(screen, 0, 0, float32(b.Dx()), float32(b.Dy()), color.RGBA{A: 0xc0}, false)
 
-	// Update sprite animation
-	if g.ychange > 50 {
-		g.addy = -0.1
+	var lines []keyBinding
+	for _, b := range g.bindings {
+		if b.help != "" {
+			lines = append(lines, b)
+		}
 	}
-	if g.ychange < -50 {
-		g.addy = 0.1
+
+	const lineHeight = 20
+	y := float64(g.height-len(lines)*lineHeight) / 2
+	for _, b := range lines {
+		g.drawSmallText(screen, b.label, 48, y, 2)
+		g.drawSmallText(screen, b.help, 256, y, 2)
+		y += lineHeight
 	}
-	g.ychange += g.addy
+}
 
-	g.swing += 0.02
-	g.swingy += 0.03
-	g.siny = g.ychange * math.Sin(g.swingy)
+// drawSmallText draws a line of text with the small font, applying sceneGeoM
+func (g *Game) drawSmallText(screen *ebiten.Image, text string, x, y, scale float64) {
+	g.drawSmallTextAlpha(screen, text, x, y, scale, 1)
+}
 
-	// Update scroll texts
-	if g.scrollText1 != nil {
-		g.scrollText1.Update()
-	}
-	if g.scrollText3 != nil {
-		g.scrollText3.Update()
-	}
-	if g.scrollText4 != nil {
-		g.scrollText4.Update()
+// drawSmallTextAlpha draws text with the small font at the given opacity
+func (g *Game) drawSmallTextAlpha(screen *ebiten.Image, text string, x, y, scale, alpha float64) {
+	g.drawSmallTextGeoM(screen, text, x, y, scale, alpha, g.sceneGeoM)
+}
+
+// drawSmallTextGeoM draws text with the small font, placed by view rather
+// than sceneGeoM, for overlays drawn straight onto the screen
+func (g *Game) drawSmallTextGeoM(screen *ebiten.Image, text string, x, y, scale, alpha float64, view ebiten.GeoM) {
+	if g.lFont == nil || g.lFontMap == nil {
+		return
 	}
 
-	// Update vertical scroll
-	if g.scrollText2 != nil && g.upFontMap != nil {
-		g.scrollText2.scrollX += 3 // Vertical scroll moves up
-		// For vertical scroll, check if we need to reset
-		totalHeight := float64(len(g.scrollText2.text) * g.upFontMap.charHeight)
-		if g.scrollText2.scrollX > totalHeight+400 {
-			g.scrollText2.scrollX = -100
+	for _, char := range text {
+		if _, mapping, ok := g.lFontMap.lookup(char); ok && !mapping.blank {
+			srcRect := image.Rect(mapping.x, mapping.y, mapping.x+mapping.width, mapping.y+mapping.height)
+			op := &ebiten.DrawImageOptions{}
+			op.GeoM.Scale(scale, scale)
+			op.GeoM.Translate(x, y)
+			op.GeoM.Concat(view)
+			op.ColorScale.ScaleAlpha(float32(alpha))
+			screen.DrawImage(g.lFont.SubImage(srcRect).(*ebiten.Image), op)
 		}
+		x += float64(g.lFontMap.Advance(char)) * scale
 	}
-
-	return nil
 }
 
-// Draw draws the game
-func (g *Game) Draw(screen *ebiten.Image) {
-	// Clear screen
-	screen.Fill(color.Black)
+// drawBackgrounds draws both background layers in the given scheme
+func (g *Game) drawBackgrounds(dst *ebiten.Image, scheme int, view ebiten.GeoM) {
+	base, overlay := g.bgCanvas, g.bg2Canvas
+	if scheme == 1 {
+		base, overlay = overlay, base
+	}
+
+	x1, y1, x2, y2 := g.moveX, g.moveY, g.X, g.Y
+	if g.cameraOn {
+		b := g.bgCanvas.Bounds()
+		x1, y1 = g.camera.Offset(float64(b.Dx()-g.width), float64(b.Dy()-g.height))
+		x2, y2 = x1, y1
+	}
 
 	// Draw background 1
 	op := &ebiten.DrawImageOptions{}
-	op.GeoM.Translate(g.moveX, g.moveY)
-	screen.DrawImage(g.bgCanvas, op)
+	op.GeoM.Translate(x1, y1)
+	op.GeoM.Concat(view)
+	dst.DrawImage(base, op)
 
 	// Draw background 2
 	op.GeoM.Reset()
-	op.GeoM.Translate(g.X, g.Y)
-	screen.DrawImage(g.bg2Canvas, op)
-
-	// Draw sprites
-	g.drawSprites(screen)
-
-	// Draw big scroll
-	g.drawBigScroll(screen)
-
-	// Draw up scroll
-	g.drawUpScroll(screen)
-
-	// Draw small scrolls
-	g.drawSmallScrolls(screen)
+	op.GeoM.Translate(x2, y2)
+	op.GeoM.Concat(view)
+	dst.DrawImage(overlay, op)
 }
 
 // drawSprites draws the animated sprites
@@ -859,21 +4738,185 @@ func (g *Game) drawSprites(screen *ebiten.Image) {
 
 	// Draw multiple sprites with different phases
 	for i := 0; i < 12; i++ {
-		phase := float64(i) * 0.2
-		x := g.spx + 290*math.Cos(g.swing-phase)
-		y := g.spy + g.ychange*math.Sin(g.swingy-phase) + g.siny
-
 		srcX := (i % 12) * 17
-		srcRect := image.Rect(srcX, 0, srcX+16, 10)
+		srcRect := image.Rect(srcX, 0, srcX+spriteWidth, spriteHeight)
 
 		op := &ebiten.DrawImageOptions{}
-		op.GeoM.Scale(2, 2)
-		op.GeoM.Translate(x, y)
+		op.GeoM = g.spriteGeoM(i)
+		op.GeoM.Concat(g.sceneGeoM)
+		if g.spriteTint {
+			r, gr, b := spriteTint(i, g.swing)
+			op.ColorScale.Scale(r, gr, b, 1)
+		}
 
 		screen.DrawImage(g.sprite.SubImage(srcRect).(*ebiten.Image), op)
 	}
 }
 
+// OrbitCenter returns the centre of the sprite orbit in scene pixels
+func (g *Game) OrbitCenter() (x, y float64) {
+	return g.spx, g.spy
+}
+
+// SetOrbitCenter moves the centre of the sprite orbit, clamped to the screen
+func (g *Game) SetOrbitCenter(x, y float64) {
+	g.spx = math.Max(0, math.Min(x, float64(g.width)))
+	g.spy = math.Max(0, math.Min(y, float64(g.height)))
+}
+
+// toggleFollowMouse makes the sprite orbit follow the mouse cursor, or
+// returns it to the centre it had before following started
+func (g *Game) toggleFollowMouse() {
+	g.followMouse = !g.followMouse
+	if g.followMouse {
+		g.savedOrbit = [2]float64{g.spx, g.spy}
+	} else {
+		g.SetOrbitCenter(g.savedOrbit[0], g.savedOrbit[1])
+	}
+}
+
+// followCursor centres the orbit on the mouse cursor, mapping window
+// coordinates back into the scene when cropping
+func (g *Game) followCursor() {
+	cx, cy := ebiten.CursorPosition()
+	crop := g.cfg.Crop
+	if crop.Empty() {
+		crop = image.Rect(0, 0, g.width, g.height)
+	}
+	x := float64(crop.Min.X) + float64(cx*crop.Dx())/float64(g.width)
+	y := float64(crop.Min.Y) + float64(cy*crop.Dy())/float64(g.height)
+
+	// The orbit is laid out for the top-left corner of a default sized sprite
+	g.SetOrbitCenter(x-spriteWidth*defaultSpriteScale/2, y-spriteHeight*defaultSpriteScale/2)
+}
+
+// spriteTint returns the color scale of sprite i for the given cycling
+// phase in radians. Neighbouring sprites sit spriteTintSpread apart on the
+// color wheel, so the train shimmers like the rasters.
+func spriteTint(i int, phase float64) (r, g, b float32) {
+	h := phase + 2*math.Pi*spriteTintSpread*float64(i)
+	channel := func(offset float64) float32 {
+		return float32(0.5 + 0.5*math.Sin(h+offset))
+	}
+	return channel(0), channel(2 * math.Pi / 3), channel(4 * math.Pi / 3)
+}
+
+// hsvColor converts a hue in degrees, saturation and value in [0, 1] to
+// an opaque color
+func hsvColor(h, s, v float64) color.RGBA {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g = c, x
+	case h < 120:
+		r, g = x, c
+	case h < 180:
+		g, b = c, x
+	case h < 240:
+		g, b = x, c
+	case h < 300:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	m := v - c
+	to8 := func(f float64) uint8 { return uint8(math.Round((f + m) * 255)) }
+	return color.RGBA{to8(r), to8(g), to8(b), 0xff}
+}
+
+// spriteGeoM returns the transform placing sprite i on its trajectory
+func (g *Game) spriteGeoM(i int) ebiten.GeoM {
+	phase := float64(i) * 0.2
+	x := g.spx + 290*math.Cos(g.swing-phase)
+	y := g.spy + g.ychange*math.Sin(g.swingy-phase) + g.siny
+
+	scale := g.spriteScale
+	if g.cfg.Pulse {
+		scale *= 1 + pulseDepth*g.pulse.value
+	}
+
+	// Keep each sprite centred on the trajectory when the scale changes
+	x += spriteWidth * (defaultSpriteScale - scale) / 2
+	y += spriteHeight * (defaultSpriteScale - scale) / 2
+
+	var geoM ebiten.GeoM
+	geoM.Scale(scale, scale)
+	geoM.Translate(x, y)
+	return geoM
+}
+
+// sampleSpritePath returns n points along one full period of the lead
+// sprite's trajectory, measured at the sprite centre, starting from the
+// current animation state
+func (g *Game) sampleSpritePath(n int) [][2]float64 {
+	if n <= 0 {
+		return nil
+	}
+
+	defaultScale := DefaultConfig().SpriteScale
+	points := make([][2]float64, n)
+	for i := range points {
+		t := orbitPeriod * float64(i) / float64(n)
+		swingy := g.swingy + 0.03*t
+		x := g.spx + 290*math.Cos(g.swing+0.02*t)
+		y := g.spy + 2*g.ychange*math.Sin(swingy)
+		points[i] = [2]float64{x + spriteWidth*defaultScale/2, y + spriteHeight*defaultScale/2}
+	}
+	return points
+}
+
+// drawSpritePath draws the sprite trajectory as a faint closed line
+func (g *Game) drawSpritePath(screen *ebiten.Image) {
+	points := g.sampleSpritePath(g.cfg.PathSamples)
+	clr := color.RGBA{0xff, 0xff, 0xff, 0x40}
+	for i, p := range points {
+		q := points[(i+1)%len(points)]
+		x0, y0 := g.sceneGeoM.Apply(p[0], p[1])
+		x1, y1 := g.sceneGeoM.Apply(q[0], q[1])
+		vector.StrokeLine(screen, float32(x0), float32(y0), float32(x1), float32(y1), 1, clr, true)
+	}
+}
+
+// rasterBandColor returns the color of band i out of n, running once
+// around the color wheel
+func rasterBandColor(i, n int) color.RGBA {
+	h := 2 * math.Pi * float64(i) / float64(n)
+	channel := func(offset float64) uint8 {
+		return uint8(127.5 + 127.5*math.Sin(h+offset))
+	}
+	return color.RGBA{channel(0), channel(2 * math.Pi / 3), channel(4 * math.Pi / 3), 0xff}
+}
+
+// generateRaster builds a raster of bands horizontal color bands, each
+// bandHeight pixels tall. Hard bands are flat; smooth bands blend into the
+// next band's color.
+func generateRaster(width, bands, bandHeight int, smooth bool) *image.RGBA {
+	if bandHeight < 1 {
+		bandHeight = 1
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, bands*bandHeight))
+	for y := 0; y < bands*bandHeight; y++ {
+		band := y / bandHeight
+		c := rasterBandColor(band, bands)
+		if smooth {
+			next := rasterBandColor((band+1)%bands, bands)
+			t := float64(y%bandHeight) / float64(bandHeight)
+			lerp := func(a, b uint8) uint8 {
+				return uint8(float64(a) + (float64(b)-float64(a))*t)
+			}
+			c = color.RGBA{lerp(c.R, next.R), lerp(c.G, next.G), lerp(c.B, next.B), 0xff}
+		}
+		draw.Draw(img, image.Rect(0, y, width, y+1), image.NewUniform(c), image.Point{}, draw.Src)
+	}
+	return img
+}
+
 // drawBigScroll draws the big scrolling text
 func (g *Game) drawBigScroll(screen *ebiten.Image) {
 	if g.scrollText1 == nil || g.bsRaster == nil {
@@ -884,26 +4927,85 @@ func (g *Game) drawBigScroll(screen *ebiten.Image) {
 	g.bsCanvas.Clear()
 	g.bs2Canvas.Clear()
 
-	// Draw scroll text
-	g.scrollText1.Draw(g.bsCanvas, 0, 1)
+	// Draw scroll text, lowered to leave room for the wave crests
+	g.scrollText1.Draw(g.bsCanvas, g.cfg.WaveAmplitude, 1)
 
 	// Scale up
 	op := &ebiten.DrawImageOptions{}
-	op.GeoM.Scale(8, 6)
+	op.GeoM.Scale(bigScrollZoomX, bigScrollZoomY)
 	g.bs2Canvas.DrawImage(g.bsCanvas, op)
 
 	// Apply raster effect
-	op.GeoM.Reset()
-	op.GeoM.Scale(4, 2)
+	op.GeoM = g.rasterGeoM(g.bsRaster, g.bs2Canvas, 0, 4, 2)
 	op.CompositeMode = ebiten.CompositeModeSourceAtop
 	g.bs2Canvas.DrawImage(g.bsRaster, op)
 
-	// Draw to screen
+	// Fade the text out towards the left and right edges
+	if g.cfg.EdgeFade > 0 {
+		b := g.bs2Canvas.Bounds()
+		if g.edgeMask == nil {
+			g.edgeMask = ebiten.NewImageFromImage(edgeFadeMask(b.Dx(), g.cfg.EdgeFade))
+		}
+		op = &ebiten.DrawImageOptions{}
+		op.GeoM.Scale(1, float64(b.Dy()))
+		op.Blend = ebiten.BlendDestinationIn
+		g.bs2Canvas.DrawImage(g.edgeMask, op)
+	}
+
+	// Draw to the bottom of the screen, scaled around the centre of the
+	// scroll area
+	w, h := canvasSize(g.bs2Canvas)
 	op = &ebiten.DrawImageOptions{}
-	op.GeoM.Translate(0, 200)
+	op.GeoM.Translate(-w/2, -h/2)
+	op.GeoM.Scale(g.bigScrollScale, g.bigScrollScale)
+	op.GeoM.Translate(w/2, float64(g.height)-h/2)
+	op.GeoM.Concat(g.sceneGeoM)
 	screen.DrawImage(g.bs2Canvas, op)
 }
 
+// edgeFadeMask returns a one pixel high alpha mask of the given width that
+// rises linearly from transparent at both ends to opaque fade pixels in
+func edgeFadeMask(width, fade int) *image.Alpha {
+	mask := image.NewAlpha(image.Rect(0, 0, width, 1))
+	for x := 0; x < width; x++ {
+		// Distance in pixel centres from the nearest end
+		d := float64(min(x, width-1-x)) + 0.5
+		a := 1.0
+		if fade > 0 {
+			a = math.Min(1, d/float64(fade))
+		}
+		mask.Pix[x] = uint8(math.Round(a * 0xff))
+	}
+	return mask
+}
+
+// rasterGeoM places a raster over a text canvas: shifted up by offsetY
+// raster pixels, then scaled by sx, sy. With RasterClamp the scale is raised
+// and the shift limited so the raster always covers the whole canvas.
+func (g *Game) rasterGeoM(raster, canvas *ebiten.Image, offsetY, sx, sy float64) ebiten.GeoM {
+	rb, cb := raster.Bounds(), canvas.Bounds()
+	if g.cfg.RasterClamp {
+		sx, sy, offsetY = rasterCover(float64(rb.Dx()), float64(rb.Dy()), float64(cb.Dx()), float64(cb.Dy()), offsetY, sx, sy)
+	}
+
+	var geoM ebiten.GeoM
+	geoM.Translate(0, offsetY)
+	geoM.Scale(sx, sy)
+	return geoM
+}
+
+// rasterCover adjusts a raster's scale and vertical shift so a rw x rh
+// raster covers a cw x ch canvas without gaps
+func rasterCover(rw, rh, cw, ch, offsetY, sx, sy float64) (float64, float64, float64) {
+	sx = math.Max(sx, cw/rw)
+	sy = math.Max(sy, ch/rh)
+
+	// In raster pixels the canvas spans ch/sy rows, which must all be
+	// inside the raster: -offsetY in [0, rh-ch/sy]
+	offsetY = math.Max(math.Min(offsetY, 0), ch/sy-rh)
+	return sx, sy, offsetY
+}
+
 // drawUpScroll draws the vertical scrolling text
 func (g *Game) drawUpScroll(screen *ebiten.Image) {
 	if g.scrollText2 == nil || g.upRaster == nil {
@@ -918,15 +5020,17 @@ func (g *Game) drawUpScroll(screen *ebiten.Image) {
 
 	// Apply raster effect
 	op := &ebiten.DrawImageOptions{}
-	op.GeoM.Scale(2, 2)
+	op.GeoM = g.rasterGeoM(g.upRaster, g.upCanvas, 0, 2, 2)
 	op.CompositeMode = ebiten.CompositeModeSourceAtop
 	g.upCanvas.DrawImage(g.upRaster, op)
 
-	// Draw to screen at multiple positions
-	positions := []float64{0, 64, 128, 480, 544, 608}
+	// Draw to screen at multiple positions, mirrored on both edges
+	w := float64(g.width)
+	positions := []float64{0, 64, 128, w - 160, w - 96, w - 32}
 	for _, x := range positions {
 		op = &ebiten.DrawImageOptions{}
 		op.GeoM.Translate(x, 0)
+		op.GeoM.Concat(g.sceneGeoM)
 		screen.DrawImage(g.upCanvas, op)
 	}
 }
@@ -941,20 +5045,22 @@ func (g *Game) drawSmallScrolls(screen *ebiten.Image) {
 	g.lCanvas.Clear()
 	g.l2Canvas.Clear()
 
+	y1, y2 := g.cfg.SmallScroll1Y, g.cfg.SmallScroll2Y
+
 	// Draw scroll text 3
 	g.scrollText3.Draw(g.lCanvas, 0, 1)
 
 	// Apply raster effect
 	op := &ebiten.DrawImageOptions{}
-	op.GeoM.Translate(0, -16)
-	op.GeoM.Scale(2, 2)
+	op.GeoM = g.rasterGeoM(g.upRaster, g.lCanvas, smallScrollRasterOffset(y1), 2, 2)
 	op.CompositeMode = ebiten.CompositeModeSourceAtop
 	g.lCanvas.DrawImage(g.upRaster, op)
 
 	// Draw to screen
 	op = &ebiten.DrawImageOptions{}
 	op.GeoM.Scale(2, 2)
-	op.GeoM.Translate(0, 16)
+	op.GeoM.Translate(0, y1)
+	op.GeoM.Concat(g.sceneGeoM)
 	screen.DrawImage(g.lCanvas, op)
 
 	// Draw scroll text 4
@@ -962,42 +5068,261 @@ func (g *Game) drawSmallScrolls(screen *ebiten.Image) {
 
 	// Apply raster effect
 	op = &ebiten.DrawImageOptions{}
-	op.GeoM.Translate(0, -64)
-	op.GeoM.Scale(2, 2)
+	op.GeoM = g.rasterGeoM(g.upRaster, g.l2Canvas, smallScrollRasterOffset(y2), 2, 2)
 	op.CompositeMode = ebiten.CompositeModeSourceAtop
 	g.l2Canvas.DrawImage(g.upRaster, op)
 
 	// Draw to screen
 	op = &ebiten.DrawImageOptions{}
 	op.GeoM.Scale(2, 2)
-	op.GeoM.Translate(0, 64)
+	op.GeoM.Translate(0, y2)
+	op.GeoM.Concat(g.sceneGeoM)
 	screen.DrawImage(g.l2Canvas, op)
 }
 
+// smallScrollRasterOffset returns the raster shift keeping the colors of a
+// small scroll drawn at screen row y where the original placements put them
+func smallScrollRasterOffset(y float64) float64 {
+	return -y
+}
+
+// drawFontPreview draws every mapped glyph of a font in a labelled grid
+func (g *Game) drawFontPreview(screen *ebiten.Image, pf previewFont) {
+	screen.Fill(color.Black)
+	ebitenutil.DebugPrintAt(screen, pf.name+" (F2: next font)", previewMargin, previewMargin)
+	if pf.img == nil || pf.fm == nil {
+		return
+	}
+
+	runes := pf.fm.Runes()
+	cellW := pf.fm.charWidth + previewMargin
+	cellH := pf.fm.charHeight + previewLabelSpace + previewMargin
+	cols, _ := glyphGrid(len(runes), cellW, g.width-2*previewMargin)
+
+	top := previewMargin + previewLabelSpace
+	for i, r := range runes {
+		x := previewMargin + (i%cols)*cellW
+		y := top + (i/cols)*cellH
+		drawGlyph(screen, pf.img, pf.fm.chars[r], float64(x), float64(y), 1)
+		ebitenutil.DebugPrintAt(screen, fmt.Sprintf("%q", r), x, y+pf.fm.charHeight)
+	}
+}
+
 // Layout returns the screen size
 func (g *Game) Layout(outsideWidth, outsideHeight int) (int, int) {
-	return screenWidth, screenHeight
+	return g.width, g.height
 }
 
 // Cleanup releases resources
 func (g *Game) Cleanup() {
-	if g.audioPlayer != nil {
-		g.audioPlayer.Close()
+	g.stopMusic()
+	if g.recorder != nil {
+		<-g.finishRecording()
 	}
-	if g.ymPlayer != nil {
-		g.ymPlayer.Close()
+}
+
+// parseFlags builds the configuration from the command line
+func parseFlags() Config {
+	cfg := DefaultConfig()
+	flag.BoolVar(&cfg.LowRes, "lowres", cfg.LowRes, "render at half resolution and upscale (for weak hardware)")
+	flag.Func("crop", "show only the scene region `x,y,w,h` scaled to the window (for video walls)", func(s string) error {
+		r, err := parseCrop(s)
+		cfg.Crop = r
+		return err
+	})
+	flag.BoolVar(&cfg.PrerenderBigScroll, "prerender", cfg.PrerenderBigScroll, "pre-render the big scroll text into wide textures instead of drawing glyph by glyph")
+	flag.Func("spritekey", "make sprite pixels of color `RRGGBB` transparent", func(s string) error {
+		c, err := parseColor(s)
+		cfg.SpriteKeyed, cfg.SpriteColorKey = err == nil, c
+		return err
+	})
+	flag.Func("audiobuffer", "audio output buffer `duration` (e.g. 100ms); larger is more stable but adds latency", func(s string) error {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		cfg.AudioBuffer = d
+		return validateAudioBuffer(d)
+	})
+	flag.BoolVar(&cfg.TickSync, "ticksync", cfg.TickSync, "advance the animation on the music's replay ticks instead of video frames")
+	flag.BoolVar(&cfg.PauseUnfocused, "pauseunfocused", cfg.PauseUnfocused, "pause the music while the window is not focused")
+	flag.BoolVar(&cfg.SpriteTint, "spritetint", cfg.SpriteTint, "cycle the sprites through the color wheel")
+	flag.BoolVar(&cfg.ScrollTint, "scrolltint", cfg.ScrollTint, "cycle the small scrolls through the color wheel")
+	flag.Float64Var(&cfg.ScrollTintSpeed, "tintspeed", cfg.ScrollTintSpeed, "small scroll color cycle speed in full `turns` per second")
+	flag.IntVar(&cfg.ScrollEaseFrames, "scrollease", cfg.ScrollEaseFrames, "`frames` the big scroll takes to ease in to full speed, 0 to start at full speed")
+	flag.BoolVar(&cfg.LogScroll, "scrolllog", cfg.LogScroll, "print each big scroll word to stdout with the music time as it appears")
+	flag.IntVar(&cfg.RasterBands, "rasterbands", cfg.RasterBands, "generate the big scroll raster with this many color `bands` instead of loading it")
+	flag.IntVar(&cfg.RasterBandHeight, "rasterbandheight", cfg.RasterBandHeight, "height in `pixels` of each generated raster band")
+	flag.BoolVar(&cfg.RasterSmooth, "rastersmooth", cfg.RasterSmooth, "blend generated raster bands into a smooth gradient")
+	flag.Float64Var(&cfg.Gamma, "gamma", cfg.Gamma, "gamma correction of the whole picture; above 1 brightens, e.g. 1.5 for dim projectors")
+	flag.Func("start", "start the music at position `mm:ss`", func(s string) error {
+		ms, err := parseTimestamp(s)
+		cfg.StartMs = ms
+		return err
+	})
+	flag.BoolVar(&cfg.InvertBackgrounds, "invertbg", cfg.InvertBackgrounds, "start with the background motion reversed")
+	flag.BoolVar(&cfg.SectionScale, "sectionscale", cfg.SectionScale, "resize the big scroll for sections of its text marked with {scale}")
+	flag.BoolVar(&cfg.Pulse, "pulse", cfg.Pulse, "make the sprites pulse with the music")
+	flag.DurationVar(&cfg.PulseAttack, "pulseattack", cfg.PulseAttack, "how fast the sprite pulse follows rising music levels")
+	flag.DurationVar(&cfg.PulseRelease, "pulserelease", cfg.PulseRelease, "how slowly the sprite pulse decays as the music gets quieter")
+	flag.IntVar(&cfg.LoopCount, "loops", cfg.LoopCount, "`times` the tune restarts before the music stops; 0 plays it once, negative loops forever")
+	flag.Func("musicend", "what happens when the music ends after -loops: `stop` the audio (default) or quit the demo", func(s string) error {
+		if s != musicEndStop && s != musicEndQuit {
+			return fmt.Errorf("unknown music end %q, want %s or %s", s, musicEndStop, musicEndQuit)
+		}
+		cfg.MusicEnd = s
+		return nil
+	})
+	flag.DurationVar(&cfg.TrackCrossfade, "crossfade", cfg.TrackCrossfade, "crossfade `duration` when switching jukebox tracks, e.g. 2s; 0 switches instantly")
+	flag.BoolVar(&cfg.RasterClamp, "rasterclamp", cfg.RasterClamp, "stretch the rasters to always cover the scroll texts; -rasterclamp=false keeps the original placement")
+	flag.Float64Var(&cfg.SwingAmplitude, "swing", cfg.SwingAmplitude, "bound in `pixels` of the sprites' vertical swing")
+	flag.Float64Var(&cfg.SmallScroll1Y, "smallscroll1y", cfg.SmallScroll1Y, "screen `row` of the first small scroll")
+	flag.Float64Var(&cfg.SmallScroll2Y, "smallscroll2y", cfg.SmallScroll2Y, "screen `row` of the second small scroll")
+	flag.DurationVar(&cfg.MusicFadeIn, "fadein", cfg.MusicFadeIn, "`duration` of the music fade-in at startup, 0 to start at full volume")
+	flag.DurationVar(&cfg.MusicFadeOut, "fadeout", cfg.MusicFadeOut, "`duration` of the music fade-out when quitting, 0 to cut it")
+	flag.Int64Var(&cfg.Seed, "seed", cfg.Seed, "`seed` for the randomized effects, for reproducible captures; 0 picks a new one each run")
+	flag.BoolVar(&cfg.Grain, "grain", cfg.Grain, "start with a subtle film grain overlay")
+	flag.DurationVar(&cfg.TitleCard, "title", cfg.TitleCard, "`duration` the title card shows at startup, 0 to skip it")
+	flag.BoolVar(&cfg.Proportional, "proportional", cfg.Proportional, "lay out the big and small scrolls with glyph widths detected from the font images")
+	flag.BoolVar(&cfg.SongInfo, "songinfo", cfg.SongInfo, "show the playing song's title and author; -songinfo=false hides them")
+	flag.BoolVar(&cfg.VUMeter, "vu", cfg.VUMeter, "start with a VU meter of the music in the bottom-right corner")
+	flag.BoolVar(&cfg.Voices, "voices", cfg.Voices, "start with a scope of the three AY channels in the top-right corner")
+	flag.IntVar(&cfg.Tracking, "tracking", cfg.Tracking, "extra `pixels` between the big scroll characters, negative to tighten them")
+	flag.IntVar(&cfg.EdgeFade, "edgefade", cfg.EdgeFade, "fade the big scroll out over this many `pixels` at the left and right screen edges")
+	flag.Func("wave", fmt.Sprintf("make the big scroll characters bob by up to `pixels` of the font, at most %d", maxWaveAmplitude), func(s string) error {
+		a, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		if a < 0 || a > maxWaveAmplitude {
+			return fmt.Errorf("wave amplitude %v: must be between 0 and %d", a, maxWaveAmplitude)
+		}
+		cfg.WaveAmplitude = a
+		return nil
+	})
+	flag.Float64Var(&cfg.WaveFrequency, "wavefreq", cfg.WaveFrequency, "phase step in `radians` between neighbouring characters of the big scroll wave")
+	flag.BoolVar(&cfg.Metronome, "metronome", cfg.Metronome, "start with an indicator flashing once per second of the tune's replay ticks")
+	flag.IntVar(&cfg.ExitFadeFrames, "exitfade", cfg.ExitFadeFrames, "`frames` to fade to black when quitting, 0 to quit at once")
+	keyMapPath := flag.String("keymap", "", "JSON `file` remapping controls, e.g. {\"help\": \"F4\"}")
+	flag.Parse()
+
+	if *keyMapPath != "" {
+		keyMap, err := loadKeyMap(*keyMapPath)
+		if err != nil {
+			log.Printf("%v; using default keys", err)
+		} else {
+			cfg.KeyMap = keyMap
+		}
+	}
+	return cfg
+}
+
+// startCPUProfile starts writing a CPU profile to path. The returned stop
+// function flushes and closes it and is safe to call more than once.
+func startCPUProfile(path string) (stop func(), err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CPU profile: %w", err)
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to start CPU profile: %w", err)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			pprof.StopCPUProfile()
+			if err := f.Close(); err != nil {
+				log.Printf("Failed to write CPU profile: %v", err)
+			}
+		})
+	}, nil
+}
+
+// writeHeapProfile writes a heap profile of live allocations to path
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create heap profile: %w", err)
 	}
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write heap profile: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write heap profile: %w", err)
+	}
+	return nil
+}
+
+// snapshotHeap saves a timestamped heap profile
+func (g *Game) snapshotHeap() {
+	path := fmt.Sprintf("grodan-heap-%s.pprof", g.clock.Now().Format("20060102-150405"))
+	if err := writeHeapProfile(path); err != nil {
+		log.Printf("Failed to save heap profile: %v", err)
+		return
+	}
+	log.Printf("Saved heap profile %s", path)
+	g.showNotice("HEAP PROFILE SAVED")
 }
 
 func main() {
+	cpuProfile := flag.String("cpuprofile", "", "write a CPU profile to `file`")
+	selfTest := flag.Bool("selftest", false, "check the assets, fonts and audio, print a report and exit")
+	musicFile := flag.String("music", "", "play the YM `file` instead of the built-in tune, which stays on the next track key")
+	cfg := parseFlags()
+
+	stopProfile := func() {}
+	if *cpuProfile != "" {
+		stop, err := startCPUProfile(*cpuProfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		stopProfile = stop
+
+		// Still flush the profile when interrupted from the terminal
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		go func() {
+			<-interrupt
+			stop()
+			os.Exit(1)
+		}()
+	}
+
 	ebiten.SetWindowSize(screenWidth, screenHeight)
 	ebiten.SetWindowTitle("Grodan and Kvack Kvack Demo")
-
-	game := NewGame()
+	ebiten.SetWindowClosingHandled(true)
+
+	assets := embeddedAssets()
+	if *musicFile != "" {
+		track, err := loadMusicFile(*musicFile, os.Stdout)
+		if err != nil {
+			log.Printf("Failed to load music, playing the built-in tune: %v", err)
+		} else {
+			assets.Tracks = append([]musicTrack{track}, assets.Tracks...)
+		}
+	}
+	game := NewGameWithAssets(cfg, assets)
+
+	if *selfTest {
+		err := game.SelfTest(os.Stdout)
+		game.Cleanup()
+		stopProfile()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	if err := ebiten.RunGame(game); err != nil {
+		stopProfile()
 		log.Fatal(err)
 	}
 
+	// The audio context outlives the run loop, so the tail is still heard
+	game.FadeOutMusic(cfg.MusicFadeOut)
 	game.Cleanup()
+	stopProfile()
 }
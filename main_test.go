@@ -0,0 +1,2962 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+// testFont returns an 8x8 font map with A-Z on the first rows of a 10x3
+// cell sheet and a blank space, plus a matching empty sheet image
+func testFont() (*ebiten.Image, *FontMap) {
+	fm := NewFontMap(8, 8)
+	for i, ch := range "ABCDEFGHIJKLMNOPQRSTUVWXYZ" {
+		fm.AddChar(ch, i%10, i/10, 0)
+	}
+	fm.AddBlank(' ', 8)
+	return ebiten.NewImage(80, 24), fm
+}
+
+func TestVerticalResetBoundaryFollowsViewport(t *testing.T) {
+	img, fm := testFont()
+	s := NewScrollText("ABC", img, fm, 1, true)
+
+	s.SetViewport(100, 400)
+	short := s.verticalResetBoundary()
+	s.SetViewport(100, 800)
+	if got := s.verticalResetBoundary() - short; got != 400 {
+		t.Errorf("boundary grew by %v for a 400 pixel taller viewport, want 400", got)
+	}
+
+	s.scrollX = s.verticalResetBoundary()
+	s.Update()
+	if s.scrollX != -scrollRestartGap {
+		t.Errorf("scrollX after passing the boundary = %v, want %v", s.scrollX, -scrollRestartGap)
+	}
+}
+
+func TestInternalResolution(t *testing.T) {
+	tests := []struct {
+		lowRes  bool
+		w, h    int
+		upscale float64
+	}{
+		{false, screenWidth, screenHeight, 1},
+		{true, screenWidth / 2, screenHeight / 2, 2},
+	}
+	for _, tt := range tests {
+		w, h, upscale := internalResolution(tt.lowRes)
+		if w != tt.w || h != tt.h || upscale != tt.upscale {
+			t.Errorf("internalResolution(%v) = %d, %d, %v, want %d, %d, %v",
+				tt.lowRes, w, h, upscale, tt.w, tt.h, tt.upscale)
+		}
+	}
+}
+
+func TestSmallFontRunes(t *testing.T) {
+	runes := initSmallFont().Runes()
+	have := make(map[rune]bool)
+	for i, r := range runes {
+		if i > 0 && runes[i-1] >= r {
+			t.Fatalf("Runes() not sorted and unique at %d: %q", i, runes)
+		}
+		have[r] = true
+	}
+	for _, r := range "ABCXYZ0123456789:" {
+		if !have[r] {
+			t.Errorf("small font runes lack %q", r)
+		}
+	}
+}
+
+func TestGlyphGrid(t *testing.T) {
+	tests := []struct {
+		n, cell, area int
+		cols, rows    int
+	}{
+		{0, 8, 100, 0, 0},
+		{5, 10, 100, 5, 1},   // Fits on one row
+		{25, 10, 100, 10, 3}, // Last row partly filled
+		{30, 10, 100, 10, 3}, // Exactly full
+		{3, 50, 20, 1, 3},    // Cells wider than the area still get a column
+	}
+	for _, tt := range tests {
+		cols, rows := glyphGrid(tt.n, tt.cell, tt.area)
+		if cols != tt.cols || rows != tt.rows {
+			t.Errorf("glyphGrid(%d, %d, %d) = %d, %d, want %d, %d",
+				tt.n, tt.cell, tt.area, cols, rows, tt.cols, tt.rows)
+		}
+	}
+}
+
+// newTestPlayer returns a looping player of the embedded tune
+func newTestPlayer(t testing.TB) *YMPlayer {
+	t.Helper()
+	y, err := NewYMPlayer(musicData, sampleRate, true)
+	if err != nil {
+		t.Fatalf("NewYMPlayer: %v", err)
+	}
+	t.Cleanup(func() { y.Close() })
+	return y
+}
+
+func TestSetVolumeRampsGradually(t *testing.T) {
+	y := newTestPlayer(t)
+	start := y.volume
+	y.SetVolume(0)
+
+	buf := make([]byte, 64*4) // 64 stereo 16-bit frames, well inside the ramp
+	if _, err := y.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if y.volume <= 0 || y.volume >= start {
+		t.Errorf("gain after one short Read = %v, want strictly between 0 and %v", y.volume, start)
+	}
+
+	for i := 0; i < 20 && y.volume > 0; i++ {
+		if _, err := y.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if y.volume != 0 {
+		t.Errorf("gain after the ramp = %v, want 0", y.volume)
+	}
+}
+
+func TestFloat32SamplePacking(t *testing.T) {
+	y := newTestPlayer(t)
+	y.SetSampleFormat(SampleFormatFloat32)
+
+	buf := make([]byte, 4096)
+	n, err := y.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(buf) {
+		t.Fatalf("Read = %d bytes, want %d", n, len(buf))
+	}
+	// 4 bytes per sample per channel, stereo
+	const frameBytes = 4 * 2
+	if n%frameBytes != 0 {
+		t.Errorf("Read = %d bytes, not whole %d byte frames", n, frameBytes)
+	}
+	nonZero := false
+	for i := 0; i < n; i += 4 {
+		v := math.Float32frombits(binary.LittleEndian.Uint32(buf[i:]))
+		if v < -1 || v > 1 || math.IsNaN(float64(v)) {
+			t.Fatalf("sample %d = %v, outside [-1, 1]", i/4, v)
+		}
+		nonZero = nonZero || v != 0
+	}
+	if !nonZero {
+		t.Error("all float samples are zero")
+	}
+}
+
+func TestCheckFontImage(t *testing.T) {
+	img, fm := testFont()
+	if !checkFontImage("test", img, fm) {
+		t.Error("checkFontImage rejected a sheet that fits the map")
+	}
+	if checkFontImage("test", ebiten.NewImage(40, 8), fm) {
+		t.Error("checkFontImage accepted an undersized sheet")
+	}
+}
+
+func TestSpriteGeoMCarriesScale(t *testing.T) {
+	g := &Game{spriteScale: 3}
+
+	geoM := g.spriteGeoM(0)
+	if a, d := geoM.Element(0, 0), geoM.Element(1, 1); a != 3 || d != 3 {
+		t.Errorf("sprite GeoM scale = %v x %v, want 3 x 3", a, d)
+	}
+}
+
+func TestScrubReportsLastTarget(t *testing.T) {
+	y := newTestPlayer(t)
+	y.BeginScrub()
+	y.SetPositionMs(5000)
+	y.SetPositionMs(12000)
+
+	buf := make([]byte, 4096)
+	if _, err := y.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := y.CurrentTimeMs(); got != 12000 {
+		t.Errorf("CurrentTimeMs while scrubbing = %d, want the last target 12000", got)
+	}
+
+	y.EndScrub()
+	if got := y.CurrentTimeMs(); got <= 12000 {
+		t.Errorf("CurrentTimeMs after EndScrub = %d, want the live position past 12000", got)
+	}
+}
+
+func TestEmbeddedTracksLoad(t *testing.T) {
+	tracks := embeddedTracks()
+	if len(tracks) != len(trackKeys) {
+		t.Errorf("%d embedded tracks for %d track keys", len(tracks), len(trackKeys))
+	}
+	for _, track := range tracks {
+		y, err := NewYMPlayer(track.data, sampleRate, true)
+		if err != nil {
+			t.Errorf("track %q: %v", track.name, err)
+			continue
+		}
+		y.Close()
+	}
+}
+
+func TestTrackKeyLoadsTrack(t *testing.T) {
+	assets := StubAssets()
+	assets.Tracks = embeddedTracks()
+	g := NewGameWithAssets(DefaultConfig(), assets)
+	t.Cleanup(g.Cleanup)
+
+	pressKey(g, ebiten.KeyDigit2)
+	if g.currentTrack != 1 {
+		t.Errorf("currentTrack = %d, want 1", g.currentTrack)
+	}
+	if g.ymPlayer == nil {
+		t.Fatal("no player after selecting the second track")
+	}
+	if got, want := g.ymPlayer.Info().SongName, "Great Giana Sisters (title)"; got != want {
+		t.Errorf("playing %q, want the second track %q", got, want)
+	}
+}
+
+func TestResetTunablesRestoresDefaults(t *testing.T) {
+	cfg := DefaultConfig()
+	g := newTestGame(t, cfg)
+
+	pressKey(g, ebiten.KeyBracketRight)
+	pressKey(g, ebiten.KeyT)
+	pressKey(g, ebiten.KeyL)
+	pressKey(g, ebiten.KeyI)
+	pressKey(g, ebiten.KeyMinus)
+	g.SetGamma(cfg.Gamma + 0.5)
+
+	g.resetTunables()
+	if g.spriteScale != cfg.SpriteScale {
+		t.Errorf("spriteScale = %v, want %v", g.spriteScale, cfg.SpriteScale)
+	}
+	if g.spriteTint != cfg.SpriteTint {
+		t.Errorf("spriteTint = %v, want %v", g.spriteTint, cfg.SpriteTint)
+	}
+	if g.scrollTint != cfg.ScrollTint || g.scrollText3.tintEnabled != cfg.ScrollTint {
+		t.Errorf("scrollTint = %v, small scroll tinting %v, want %v", g.scrollTint, g.scrollText3.tintEnabled, cfg.ScrollTint)
+	}
+	if g.bgInverted != cfg.InvertBackgrounds {
+		t.Errorf("bgInverted = %v, want %v", g.bgInverted, cfg.InvertBackgrounds)
+	}
+	if g.gamma != cfg.Gamma {
+		t.Errorf("gamma = %v, want %v", g.gamma, cfg.Gamma)
+	}
+	if g.masterVolume != defaultVolume {
+		t.Errorf("masterVolume = %v, want %v", g.masterVolume, defaultVolume)
+	}
+}
+
+// glyphDraw is one DrawGlyph call seen by recordingGlyphs
+type glyphDraw struct {
+	ch   rune
+	x, y float64
+}
+
+// recordingGlyphs is a GlyphRenderer with 8x8 glyphs for every rune but
+// space that records where it is asked to draw instead of drawing
+type recordingGlyphs struct {
+	draws []glyphDraw
+}
+
+func (r *recordingGlyphs) HasGlyph(ch rune) bool { return ch != ' ' }
+func (r *recordingGlyphs) Mapped(ch rune) bool   { return true }
+func (r *recordingGlyphs) Advance(ch rune) int   { return 8 }
+func (r *recordingGlyphs) LineHeight() int       { return 8 }
+func (r *recordingGlyphs) DrawGlyph(dst *ebiten.Image, ch rune, x, y, scale float64, clr ebiten.ColorScale) {
+	r.draws = append(r.draws, glyphDraw{ch, x, y})
+}
+
+// drawnY returns the y of the first recorded draw of ch
+func (r *recordingGlyphs) drawnY(t *testing.T, ch rune) float64 {
+	t.Helper()
+	for _, d := range r.draws {
+		if d.ch == ch {
+			return d.y
+		}
+	}
+	t.Fatalf("%q was not drawn; draws: %v", ch, r.draws)
+	return 0
+}
+
+func TestVerticalTextReadsTopToBottom(t *testing.T) {
+	glyphs := &recordingGlyphs{}
+	s := NewScrollTextWithRenderer("AB", glyphs, 1, true)
+	s.SetViewport(100, 400)
+	s.scrollX = 200 // Both characters are inside the viewport
+
+	s.Draw(ebiten.NewImage(100, 400), 0, 2)
+	a, b := glyphs.drawnY(t, 'A'), glyphs.drawnY(t, 'B')
+	if a >= b {
+		t.Errorf("A drawn at y=%v, B at y=%v; want A above B", a, b)
+	}
+	if b-a != 16 {
+		t.Errorf("A to B = %v pixels, want one 8 pixel line at scale 2", b-a)
+	}
+
+	// Scrolling moves the column up
+	s.scrollX += 10
+	glyphs.draws = nil
+	s.Draw(ebiten.NewImage(100, 400), 0, 2)
+	if got := glyphs.drawnY(t, 'A'); got != a-10 {
+		t.Errorf("A after scrolling 10 pixels at y=%v, want %v", got, a-10)
+	}
+}
+
+func TestLineSpacingWidensVerticalStride(t *testing.T) {
+	step := func(spacing float64) float64 {
+		glyphs := &recordingGlyphs{}
+		s := NewScrollTextWithRenderer("AB", glyphs, 1, true)
+		s.SetViewport(100, 400)
+		s.SetLineSpacing(spacing)
+		s.scrollX = 200
+		s.Draw(ebiten.NewImage(100, 400), 0, 2)
+		return glyphs.drawnY(t, 'B') - glyphs.drawnY(t, 'A')
+	}
+	plain, spaced := step(0), step(3)
+	if spaced-plain != 6 {
+		t.Errorf("line spacing 3 at scale 2 widened the stride by %v, want 6", spaced-plain)
+	}
+}
+
+func TestBackgroundTransitionAlpha(t *testing.T) {
+	var tr bgTransition
+	tr.Start(0, 1, 4)
+	want := []float64{0, 0.25, 0.5, 0.75}
+	for i, w := range want {
+		if !tr.active {
+			t.Fatalf("transition ended after %d of 4 frames", i)
+		}
+		if got := tr.Alpha(); got != w {
+			t.Errorf("Alpha at frame %d = %v, want %v", i, got, w)
+		}
+		tr.Step()
+	}
+	if tr.active || tr.Alpha() != 1 {
+		t.Errorf("after 4 frames active = %v, Alpha = %v; want done at 1", tr.active, tr.Alpha())
+	}
+}
+
+func TestVisibleRange(t *testing.T) {
+	img, fm := testFont()
+	s := NewScrollText("ABCDEFGHIJ", img, fm, 1, false)
+	s.SetViewport(20, 8)
+	tests := []struct {
+		scrollX    float64
+		start, end int
+	}{
+		{0, 0, 3},    // A, B and the left part of C
+		{-12, 1, 4},  // Right half of B through D
+		{-16, 2, 5},  // C and D whole, the left half of E
+		{-76, 9, 10}, // Only the last half of J
+		{-80, 0, 0},  // Scrolled off
+		{30, 0, 0},   // Not entered yet
+	}
+	for _, tt := range tests {
+		s.scrollX = tt.scrollX
+		if start, end := s.VisibleRange(); start != tt.start || end != tt.end {
+			t.Errorf("VisibleRange at scrollX %v = %d, %d, want %d, %d",
+				tt.scrollX, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestBigScrollVisibleRange(t *testing.T) {
+	g := NewGame(DefaultConfig())
+	t.Cleanup(g.Cleanup)
+	s := g.scrollText1
+
+	// The big scroll is magnified 8 times across the 640 pixel wide screen,
+	// so 80 font pixels are on screen: four 24 pixel wide characters
+	lead := len(s.text) - len(strings.TrimLeft(s.text, " "))
+	tests := []struct {
+		scrollX    float64
+		start, end int
+	}{
+		{0, 0, 4},
+		{-12, 0, 4},
+		{-24 * float64(lead), lead, lead + 4},
+		{-24*float64(lead) - 12, lead, lead + 4},
+		{70, 0, 1},
+		{80, 0, 0},
+	}
+	for _, tt := range tests {
+		s.scrollX = tt.scrollX
+		if start, end := s.VisibleRange(); start != tt.start || end != tt.end {
+			t.Errorf("VisibleRange at scrollX %v = %d, %d, want %d, %d",
+				tt.scrollX, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestWordTriggerFiresWhenVisible(t *testing.T) {
+	// CAREBEARS spans x 48 to 120 of the text
+	img, fm := testFont()
+	s := NewScrollText("HELLO CAREBEARS", img, fm, 4, false)
+	s.SetViewport(40, 8)
+	s.scrollX = 40
+	fired := 0
+	s.OnWordVisible("CAREBEARS", func() { fired++ })
+
+	for fired == 0 && s.scrollX > -200 {
+		s.Update()
+	}
+	if fired == 0 {
+		t.Fatal("trigger never fired")
+	}
+	// The word's left edge at 48+scrollX must have just crossed x = 40
+	if edge := 48 + s.scrollX; edge >= 40 || edge < 40-4 {
+		t.Errorf("fired with the word's left edge at x=%v, want just inside 40", edge)
+	}
+
+	// Staying on screen does not fire it again
+	for range 5 {
+		s.Update()
+	}
+	if fired != 1 {
+		t.Errorf("trigger fired %d times while the word stayed visible, want 1", fired)
+	}
+}
+
+func TestBigScrollWordTriggerFiresOnScreen(t *testing.T) {
+	g := NewGame(DefaultConfig())
+	t.Cleanup(g.Cleanup)
+	s := g.scrollText1
+	const word = "WELCOME"
+	fired := false
+	s.OnWordVisible(word, func() { fired = true })
+
+	for frame := 0; !fired; frame++ {
+		if frame == 10000 {
+			t.Fatal("trigger never fired")
+		}
+		s.Update()
+	}
+
+	// The word's left edge, magnified 8 times, has just crossed the right
+	// edge of the screen
+	offset := 0
+	for _, ch := range s.text[:strings.Index(s.text, word)] {
+		offset += s.charAdvance(ch)
+	}
+	screenX := (float64(offset) + s.scrollX) * 8
+	if screenX >= screenWidth || screenX < screenWidth-s.speed*8 {
+		t.Errorf("fired with the word's left edge at screen x=%v, want just inside %d", screenX, screenWidth)
+	}
+}
+
+func TestClearColorFillsScreen(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ClearColor = color.RGBA{0x20, 0x40, 0x60, 0xff}
+	g := newTestGame(t, cfg)
+
+	// The stub assets are transparent, so the clear color shows through
+	screen := ebiten.NewImage(screenWidth, screenHeight)
+	g.drawScene(screen)
+	if got := color.RGBAModel.Convert(screen.At(0, 0)); got != cfg.ClearColor {
+		t.Errorf("screen corner = %v, want the clear color %v", got, cfg.ClearColor)
+	}
+}
+
+func TestReadAfterCloseReturnsEOF(t *testing.T) {
+	y := newTestPlayer(t)
+	y.Close()
+
+	n, err := y.Read(make([]byte, 4096))
+	if n != 0 || err != io.EOF {
+		t.Errorf("Read after Close = %d, %v, want 0, EOF", n, err)
+	}
+}
+
+func TestSampleSpritePath(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	if got := g.sampleSpritePath(0); got != nil {
+		t.Errorf("sampleSpritePath(0) = %v, want nil", got)
+	}
+
+	for _, n := range []int{16, 100, 360} {
+		points := g.sampleSpritePath(n)
+		if len(points) != n {
+			t.Errorf("sampleSpritePath(%d) returned %d points", n, len(points))
+			continue
+		}
+		// One full period closes the loop: the gap from the last point back
+		// to the first is no wider than the steps along the path
+		dist := func(a, b [2]float64) float64 { return math.Hypot(a[0]-b[0], a[1]-b[1]) }
+		maxStep := 0.0
+		for i := 1; i < n; i++ {
+			maxStep = max(maxStep, dist(points[i-1], points[i]))
+		}
+		if gap := dist(points[n-1], points[0]); gap > maxStep*1.01 {
+			t.Errorf("n=%d: closing gap %v exceeds the largest step %v", n, gap, maxStep)
+		}
+	}
+}
+
+func TestLoudnessOfSine(t *testing.T) {
+	// A 0.5 amplitude sine on both channels has a channel-summed mean
+	// square of 0.25, about -6.7 LUFS without K-weighting
+	m := newLoudnessMeter(sampleRate)
+	for i := range 5 * sampleRate {
+		m.add(0.5 * math.Sin(2*math.Pi*1000*float64(i)/sampleRate))
+	}
+	want := -0.691 + 10*math.Log10(0.25)
+	if got := m.integrated(); math.Abs(got-want) > 0.5 {
+		t.Errorf("integrated loudness = %.2f LUFS, want about %.2f", got, want)
+	}
+
+	if got := newLoudnessMeter(sampleRate).integrated(); !math.IsInf(got, -1) {
+		t.Errorf("loudness before any audio = %v, want -Inf", got)
+	}
+}
+
+// newTestGame returns a Game on stub assets, cleaned up with the test
+func newTestGame(t testing.TB, cfg Config) *Game {
+	t.Helper()
+	g := NewGameWithAssets(cfg, StubAssets())
+	t.Cleanup(g.Cleanup)
+	return g
+}
+
+func TestStubGameConstructsAndSteps(t *testing.T) {
+	// The second Game must share the process-wide audio context
+	for i := 0; i < 2; i++ {
+		g := newTestGame(t, DefaultConfig())
+		for frame := 0; frame < 10; frame++ {
+			if err := g.Update(); err != nil {
+				t.Fatalf("Game %d, Update %d: %v", i, frame, err)
+			}
+		}
+	}
+}
+
+func TestGIFRecorderStopsAtCap(t *testing.T) {
+	frame := func() *image.Paletted {
+		return image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9)
+	}
+	tests := []struct {
+		name                string
+		maxFrames, maxBytes int
+		want                int
+	}{
+		{"frame cap", 3, 1 << 20, 3},
+		{"byte cap", 100, 2*16 + 8, 2}, // Room for two 16 byte frames
+	}
+	for _, tt := range tests {
+		r := newGIFRecorder(tt.maxFrames, tt.maxBytes)
+		for i := range 5 {
+			if got, want := r.Append(frame()), i < tt.want; got != want {
+				t.Errorf("%s: Append %d = %v, want %v", tt.name, i, got, want)
+			}
+		}
+		if !r.capped {
+			t.Errorf("%s: recorder not marked capped", tt.name)
+		}
+
+		var buf bytes.Buffer
+		if err := r.Write(&buf); err != nil {
+			t.Fatalf("%s: Write: %v", tt.name, err)
+		}
+		anim, err := gif.DecodeAll(&buf)
+		if err != nil {
+			t.Fatalf("%s: decoding the GIF: %v", tt.name, err)
+		}
+		if len(anim.Image) != tt.want {
+			t.Errorf("%s: GIF has %d frames, want %d", tt.name, len(anim.Image), tt.want)
+		}
+	}
+}
+
+func TestPositionWrapsOnLoop(t *testing.T) {
+	y := newTestPlayer(t)
+	length := y.totalSamples * 1000 / sampleRate
+	if length <= 0 {
+		t.Fatal("the embedded tune reports no length")
+	}
+	y.SetPositionMs(length - 100)
+
+	// Half a second of audio runs 400ms past the end of the tune
+	buf := make([]byte, sampleRate/2*4)
+	if _, err := y.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := y.CurrentTimeMs(); got < 0 || got >= length || got > 1000 {
+		t.Errorf("CurrentTimeMs after looping = %d, want about 400 of %d", got, length)
+	}
+}
+
+// withLoopFrame returns the embedded tune, unpacked, restarting from the
+// given frame when it loops
+func withLoopFrame(t testing.TB, frame uint32) []byte {
+	t.Helper()
+	data := bytes.Clone(unpackYM(musicData))
+	if v := string(data[:4]); v != "YM5!" && v != "YM6!" {
+		t.Fatalf("embedded tune is %q, want a YM5 or YM6 header", v)
+	}
+	binary.BigEndian.PutUint32(data[28:32], frame)
+	return data
+}
+
+func TestPositionWrapsToLoopFrame(t *testing.T) {
+	_, frames := ymLoopFrame(unpackYM(musicData))
+	y, err := NewYMPlayer(withLoopFrame(t, uint32(frames/2)), sampleRate, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer y.Close()
+
+	length := y.totalSamples * 1000 / sampleRate
+	loopMs := y.loopStart * 1000 / sampleRate
+	if loopMs < length/2-20 || loopMs > length/2+20 {
+		t.Fatalf("loop start at %dms, want the middle of the %dms tune", loopMs, length)
+	}
+	y.SetPositionMs(length - 100)
+
+	// Half a second of audio runs 400ms past the end, so past the loop frame
+	buf := make([]byte, sampleRate/2*4)
+	if _, err := y.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := y.CurrentTimeMs(); got < loopMs+400-20 || got > loopMs+400+20 {
+		t.Errorf("CurrentTimeMs after looping = %d, want about %d", got, loopMs+400)
+	}
+}
+
+func TestManualClockAdvances(t *testing.T) {
+	start := time.Date(1989, 3, 31, 12, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	if got := clock.Now(); !got.Equal(start) {
+		t.Errorf("Now = %v, want the start %v", got, start)
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	clock.Advance(500 * time.Millisecond)
+	if got := clock.Now().Sub(start); got != 2*time.Second {
+		t.Errorf("clock moved %v, want 2s", got)
+	}
+}
+
+func TestCameraStaysInsideBackground(t *testing.T) {
+	// The backgrounds are 640*3 x 400*2, the screen shows 640x400 of them
+	const rangeX, rangeY = 640*3 - screenWidth, 400*2 - screenHeight
+	c := newCameraPath(50)
+	frames := len(c.points) * c.segmentFrames
+	for frame := range frames + 10 {
+		x, y := c.Offset(rangeX, rangeY)
+		if x < -rangeX || x > 0 || y < -rangeY || y > 0 {
+			t.Fatalf("frame %d: offset %v, %v outside [%v, 0] x [%v, 0]", frame, x, y, -rangeX, -rangeY)
+		}
+		c.Step()
+	}
+}
+
+func TestCrop(t *testing.T) {
+	tests := []struct {
+		in   string
+		want image.Rectangle
+		ok   bool
+	}{
+		{"0,0,320,200", image.Rect(0, 0, 320, 200), true},
+		{"320, 200, 320, 200", image.Rect(320, 200, 640, 400), true},
+		{"0,0,0,200", image.Rectangle{}, false},     // Empty
+		{"400,0,320,200", image.Rectangle{}, false}, // Past the right edge
+		{"-1,0,10,10", image.Rectangle{}, false},
+		{"0,0,10", image.Rectangle{}, false},
+		{"a,0,10,10", image.Rectangle{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseCrop(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseCrop(%q) = %v, %v, want %v, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+
+	crop := image.Rect(320, 200, 640, 400)
+	if got, want := cropSource(crop, 2), image.Rect(160, 100, 320, 200); got != want {
+		t.Errorf("cropSource at half resolution = %v, want %v", got, want)
+	}
+	if got, want := cropSource(image.Rectangle{}, 1), image.Rect(0, 0, screenWidth, screenHeight); got != want {
+		t.Errorf("cropSource without a crop = %v, want the whole scene %v", got, want)
+	}
+}
+
+func TestHelpListsBindings(t *testing.T) {
+	var pairs [][2]string
+	names := make(map[string]bool)
+	for _, b := range defaultBindings() {
+		if b.name == "" || names[b.name] {
+			t.Errorf("binding name %q is empty or repeated", b.name)
+		}
+		names[b.name] = true
+		if b.help != "" {
+			pairs = append(pairs, [2]string{b.label, b.help})
+		}
+	}
+
+	want := [][2]string{
+		{"F3", "SHOW OR HIDE THIS HELP"},
+		{"SPACE", "PAUSE"},
+		{"1 TO 9", "SELECT JUKEBOX TRACK"},
+		{"B", "CROSSFADE BACKGROUNDS"},
+	}
+	if len(pairs) < len(want) {
+		t.Fatalf("help lists %d entries, want at least %d", len(pairs), len(want))
+	}
+	for i, w := range want {
+		if pairs[i] != w {
+			t.Errorf("help entry %d = %q, want %q", i, pairs[i], w)
+		}
+	}
+	if last := pairs[len(pairs)-1]; last != [2]string{"ESC", "QUIT"} {
+		t.Errorf("last help entry = %q, want ESC QUIT", last)
+	}
+
+	// Everything on the overlay must be drawable with the small font
+	font := initSmallFont()
+	for _, p := range pairs {
+		for _, r := range p[0] + p[1] {
+			if r != ' ' && !font.Has(r) {
+				t.Errorf("help entry %q uses %q, which the small font lacks", p, r)
+			}
+		}
+	}
+}
+
+// pressKey runs the actions bound to key, as if it was just pressed
+func pressKey(g *Game, key ebiten.Key) {
+	g.dispatchKeys(func(k ebiten.Key) bool { return k == key })
+}
+
+func TestDispatchKeysRunsMappedActions(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+
+	pressKey(g, ebiten.KeyC)
+	if !g.cameraOn {
+		t.Error("C did not start the camera pan")
+	}
+	pressKey(g, ebiten.KeyBracketRight)
+	if g.spriteScale != g.cfg.SpriteScale+spriteScaleStep {
+		t.Errorf("] left the sprite scale at %v, want one step bigger", g.spriteScale)
+	}
+
+	// Unbound keys do nothing, and only pressed keys run their action
+	calls := 0
+	g.bindings = []keyBinding{
+		{key: ebiten.KeyA, name: "a", action: func(*Game) { calls++ }},
+		{key: ebiten.KeyB, name: "b", action: func(*Game) { calls += 10 }},
+	}
+	pressKey(g, ebiten.KeyZ)
+	pressKey(g, ebiten.KeyA)
+	if calls != 1 {
+		t.Errorf("pressing Z then A ran actions worth %d, want only A's 1", calls)
+	}
+}
+
+func TestKeyMapRemapsCamera(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.KeyMap = map[string]string{"camera": "Q", "nonsense": "W", "path": "NoSuchKey"}
+	g := newTestGame(t, cfg)
+
+	pressKey(g, ebiten.KeyC)
+	if g.cameraOn {
+		t.Error("C still starts the camera after remapping camera to Q")
+	}
+	pressKey(g, ebiten.KeyQ)
+	if !g.cameraOn {
+		t.Error("Q did not start the camera after remapping camera to it")
+	}
+	// The invalid entry keeps the default key
+	pressKey(g, ebiten.KeyP)
+	if !g.showPath {
+		t.Error("P no longer shows the path after an invalid remap")
+	}
+}
+
+func TestKeyMapWarnsOnDuplicateKey(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	applyKeyMap(defaultBindings(), map[string]string{"help": "F4", "record": "J"})
+	if logged.Len() != 0 {
+		t.Errorf("remapping to free keys logged %q", logged.String())
+	}
+
+	// help on F2 clashes with the font preview; the remap still applies
+	bindings := applyKeyMap(defaultBindings(), map[string]string{"help": "F2"})
+	if want := `Key map: F2 is bound to both "help" and "font-preview"`; !strings.Contains(logged.String(), want) {
+		t.Errorf("log = %q, want a warning containing %q", logged.String(), want)
+	}
+	for _, b := range bindings {
+		if (b.name == "help" || b.name == "font-preview") && b.key != ebiten.KeyF2 {
+			t.Errorf("%s bound to %s, want F2", b.name, b.key)
+		}
+	}
+}
+
+func TestVisibleTileSpans(t *testing.T) {
+	// A 3000 pixel text in 1024 pixel tiles behind a 640 pixel viewport
+	tests := []struct {
+		scrollX float64
+		want    []tileSpan
+	}{
+		{-100, []tileSpan{{0, 100, 740, 0}}},
+		{-900, []tileSpan{{0, 900, 1024, 0}, {1, 0, 516, 124}}}, // Across a tile edge
+		{200, []tileSpan{{0, 0, 440, 200}}},                     // Still entering
+		{-2800, []tileSpan{{2, 752, 952, 0}}},                   // Leaving
+		{-10.5, []tileSpan{{0, 10, 651, -0.5}}},                 // Between pixels
+		{-3000, nil},
+	}
+	for _, tt := range tests {
+		got := visibleTileSpans(tt.scrollX, 640, 1024, 3000)
+		if len(got) != len(tt.want) {
+			t.Errorf("scrollX %v: spans %v, want %v", tt.scrollX, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("scrollX %v: spans %v, want %v", tt.scrollX, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestApplyColorKey(t *testing.T) {
+	magenta := color.RGBA{0xff, 0x00, 0xff, 0xff}
+	red := color.NRGBA{0xff, 0x00, 0x00, 0xff}
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{0xff, 0x00, 0xff, 0xff})
+	img.SetNRGBA(1, 0, red)
+
+	if c, ok := opaqueBackground(img); !ok || c != magenta {
+		t.Errorf("opaqueBackground = %v, %v, want %v, true", c, ok, magenta)
+	}
+	out := applyColorKey(img, magenta)
+	if got := out.NRGBAAt(0, 0); got.A != 0 {
+		t.Errorf("keyed pixel = %v, want transparent", got)
+	}
+	if got := out.NRGBAAt(1, 0); got != red {
+		t.Errorf("other pixel = %v, want it unchanged at %v", got, red)
+	}
+	if img.NRGBAAt(0, 0).A != 0xff {
+		t.Error("applyColorKey modified its input")
+	}
+}
+
+func TestValidateAudioBuffer(t *testing.T) {
+	tests := []struct {
+		d  time.Duration
+		ok bool
+	}{
+		{-time.Millisecond, false},
+		{0, false},
+		{minAudioBuffer - time.Millisecond, false},
+		{minAudioBuffer, true},
+		{100 * time.Millisecond, true},
+		{maxAudioBuffer, true},
+		{maxAudioBuffer + time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		if err := validateAudioBuffer(tt.d); (err == nil) != tt.ok {
+			t.Errorf("validateAudioBuffer(%v) = %v, want ok %v", tt.d, err, tt.ok)
+		}
+	}
+}
+
+func TestConfettiStaysBounded(t *testing.T) {
+	const maxParticles = 50
+	c := newConfetti(maxParticles, rand.New(rand.NewSource(1)))
+	dt := 1.0 / 60
+
+	for range 10 * 60 {
+		c.Update(dt, true, screenWidth, screenHeight)
+		if len(c.particles) > maxParticles {
+			t.Fatalf("%d particles, want at most %d", len(c.particles), maxParticles)
+		}
+	}
+	if len(c.particles) == 0 {
+		t.Fatal("no particles spawned")
+	}
+
+	// Once spawning stops, everything falls out of the screen
+	for range 30 * 60 {
+		c.Update(dt, false, screenWidth, screenHeight)
+		for _, p := range c.particles {
+			if p.y >= screenHeight {
+				t.Fatalf("particle kept at y=%v, below the screen", p.y)
+			}
+		}
+	}
+	if len(c.particles) != 0 {
+		t.Errorf("%d particles left 30s after spawning stopped, want 0", len(c.particles))
+	}
+	if cap(c.particles) != maxParticles {
+		t.Errorf("pool grew to %d, want it to stay at %d", cap(c.particles), maxParticles)
+	}
+}
+
+// longScroll returns a horizontal scroll as long as the main big scroll
+func longScroll() *ScrollText {
+	s := NewScrollText(strings.Repeat("GRODAN AND KVACK KVACK ", 260), ebiten.NewImage(1, 1), initBigScrollFont(), 2, false)
+	s.SetViewport(screenWidth, screenHeight)
+	return s
+}
+
+func TestTextWidthCache(t *testing.T) {
+	s := longScroll()
+	fresh := func() int {
+		w := 0
+		for _, ch := range s.text {
+			w += s.glyphs.Advance(ch)
+		}
+		return w
+	}
+	if got, want := s.textWidth(), fresh(); got != want {
+		t.Errorf("cached width = %d, want %d", got, want)
+	}
+	s.Update()
+	s.SetText("SHORTER")
+	if got, want := s.textWidth(), fresh(); got != want {
+		t.Errorf("width after SetText = %d, want %d", got, want)
+	}
+}
+
+func BenchmarkScrollTextUpdate(b *testing.B) {
+	b.Run("cached", func(b *testing.B) {
+		s := longScroll()
+		for b.Loop() {
+			s.Update()
+		}
+	})
+	// What every Update cost before the width was cached
+	b.Run("relayout", func(b *testing.B) {
+		s := longScroll()
+		for b.Loop() {
+			s.layoutValid = false
+			s.Update()
+		}
+	})
+}
+
+func TestSeekWithoutLength(t *testing.T) {
+	y := newTestPlayer(t)
+	if _, err := y.Seek(1000, io.SeekStart); err != nil {
+		t.Fatalf("Seek with a known length: %v", err)
+	}
+
+	y.totalSamples = 0 // As with bad metadata
+	for _, whence := range []int{io.SeekStart, io.SeekCurrent, io.SeekEnd} {
+		pos, err := y.Seek(500, whence)
+		if !errors.Is(err, errUnseekable) {
+			t.Errorf("Seek(500, %d) error = %v, want errUnseekable", whence, err)
+		}
+		if pos != 1000 || y.position != 1000 {
+			t.Errorf("Seek(500, %d) moved to %d (position %d), want it left at 1000", whence, pos, y.position)
+		}
+	}
+}
+
+func TestSeekMovesEngine(t *testing.T) {
+	want := newTestPlayer(t)
+	want.SetPositionMs(2000)
+	got := newTestPlayer(t)
+	if _, err := got.Seek(2*sampleRate, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+
+	a, b := make([]byte, sampleRate*4), make([]byte, sampleRate*4) // One second
+	want.Read(a)
+	got.Read(b)
+	if !bytes.Equal(a, b) {
+		t.Error("audio after Seek differs from audio after SetPositionMs to the same time")
+	}
+}
+
+func TestExitFadeReachesBlackBeforeClosing(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ExitFadeFrames = 5
+	g := newTestGame(t, cfg)
+	g.quit()
+
+	last := -1.0
+	for frame := range 20 {
+		alpha := g.closeAlpha()
+		err := g.Update()
+		if errors.Is(err, ebiten.Termination) {
+			if alpha < 1 {
+				t.Fatalf("closed at frame %d with the fade at %v, want opaque", frame, alpha)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alpha <= last {
+			t.Errorf("fade went from %v to %v at frame %d, want it rising", last, alpha, frame)
+		}
+		last = alpha
+	}
+	t.Fatal("demo did not close within 20 frames of a 5 frame fade")
+}
+
+// withReplayHz returns a copy of the unpacked embedded tune with its header
+// replay rate set to hz
+func withReplayHz(t testing.TB, hz uint16) []byte {
+	t.Helper()
+	data := bytes.Clone(unpackYM(musicData))
+	if v := string(data[:4]); v != "YM5!" && v != "YM6!" {
+		t.Fatalf("embedded tune is %q, want a YM5 or YM6 header", v)
+	}
+	binary.BigEndian.PutUint16(data[26:28], hz)
+	return data
+}
+
+func TestReplayHz(t *testing.T) {
+	for _, hz := range []uint16{50, 60, 200} {
+		y, err := NewYMPlayer(withReplayHz(t, hz), sampleRate, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := y.ReplayHz(); got != int(hz) {
+			t.Errorf("ReplayHz of a %dHz file = %d", hz, got)
+		}
+		y.Close()
+	}
+
+	// Older formats and a zero rate play at the ST's 50Hz
+	header := make([]byte, 28)
+	copy(header, "YM3!")
+	if got := ymReplayHz(header); got != 50 {
+		t.Errorf("ymReplayHz(YM3) = %d, want 50", got)
+	}
+	copy(header, "YM6!")
+	if got := ymReplayHz(header); got != 50 {
+		t.Errorf("ymReplayHz(YM6 with rate 0) = %d, want 50", got)
+	}
+}
+
+func TestTickSyncCountsReplayTicks(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TickSync = true
+	g := newTestGame(t, cfg)
+	// A player of its own, so no audio device pulls samples behind the test
+	y, err := NewYMPlayer(withReplayHz(t, 50), sampleRate, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.ymPlayer = y
+
+	// One second of 60fps video, the audio pulled one frame at a time
+	buf := make([]byte, sampleRate/60*4)
+	ticks := 0
+	for range 60 {
+		if _, err := y.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		ticks += g.advanceTicks()
+	}
+	if ticks != 50 {
+		t.Errorf("%d ticks over one second at 50Hz, want 50", ticks)
+	}
+}
+
+func TestScrollTextDrawsThroughRenderer(t *testing.T) {
+	glyphs := &recordingGlyphs{}
+	s := NewScrollTextWithRenderer("AB C", glyphs, 1, false)
+	s.SetViewport(640, 100)
+	s.scrollX = 10
+
+	s.Draw(ebiten.NewImage(640, 100), 30, 2)
+	// 8 pixel advances at scale 2; the space is skipped but takes room
+	want := []glyphDraw{{'A', 10, 30}, {'B', 26, 30}, {'C', 58, 30}}
+	if len(glyphs.draws) != len(want) {
+		t.Fatalf("draws = %v, want %v", glyphs.draws, want)
+	}
+	for i, d := range glyphs.draws {
+		if d != want[i] {
+			t.Errorf("draw %d = %v, want %v", i, d, want[i])
+		}
+	}
+}
+
+func TestFocusPausesMusic(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	if err := g.LoadMusic(musicData); err != nil {
+		t.Fatal(err)
+	}
+
+	g.setFocused(false)
+	if g.audioPlayer.IsPlaying() {
+		t.Error("music still playing after losing focus")
+	}
+	g.setFocused(true)
+	if !g.audioPlayer.IsPlaying() {
+		t.Error("music not resumed after regaining focus")
+	}
+
+	// Regaining focus does not override a pause from the user
+	g.togglePause()
+	g.setFocused(false)
+	g.setFocused(true)
+	if g.audioPlayer.IsPlaying() {
+		t.Error("regaining focus resumed music the user paused")
+	}
+}
+
+func TestSpriteTintDiffersPerSprite(t *testing.T) {
+	for _, phase := range []float64{0, 1.3, math.Pi} {
+		for i := range 11 {
+			r1, g1, b1 := spriteTint(i, phase)
+			r2, g2, b2 := spriteTint(i+1, phase)
+			if r1 == r2 && g1 == g2 && b1 == b2 {
+				t.Errorf("sprites %d and %d share the tint %v, %v, %v at phase %v", i, i+1, r1, g1, b1, phase)
+			}
+			for _, c := range []float32{r1, g1, b1} {
+				if c < 0 || c > 1 {
+					t.Errorf("sprite %d channel %v outside [0, 1] at phase %v", i, c, phase)
+				}
+			}
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ScrollEaseFrames = 60 // Still easing in when the snapshot is taken
+	cfg.WaveAmplitude = 2
+	cfg.ScrollTint = true
+	g := newTestGame(t, cfg)
+	g.ymPlayer = newTestPlayer(t)
+	buf := make([]byte, sampleRate/60*4)
+	run := func(frames int) {
+		for range frames {
+			if _, err := g.ymPlayer.Read(buf); err != nil {
+				t.Fatal(err)
+			}
+			if err := g.Update(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	run(30)
+	saved := g.Snapshot()
+	if saved.MusicMs == 0 {
+		t.Fatal("snapshot has no music position after 30 frames")
+	}
+	run(50)
+	g.SetOrbitCenter(10, 20)
+	g.bigScrollScale = 0.5 // As while passing a smaller section
+	if g.Snapshot() == saved {
+		t.Fatal("state did not change in 50 frames")
+	}
+
+	g.Restore(saved)
+	if got := g.Snapshot(); got != saved {
+		t.Errorf("state after Restore:\n%+v\nwant\n%+v", got, saved)
+	}
+}
+
+func TestSpeedRampEasesIn(t *testing.T) {
+	s := NewScrollTextWithRenderer("HELLO", &recordingGlyphs{}, 4, false)
+	s.SetViewport(640, 8)
+	s.SetSpeedRamp(10)
+
+	// Measure the distance moved each update
+	step := func() float64 {
+		before := s.scrollX
+		s.Update()
+		return before - s.scrollX
+	}
+	last := step()
+	if last != 0 {
+		t.Errorf("first step moved %v, want 0 at the start of the ramp", last)
+	}
+	for i := 1; i < 10; i++ {
+		got := step()
+		if got <= last || got >= 4 {
+			t.Errorf("step %d moved %v after %v, want more, under the full speed 4", i, got, last)
+		}
+		last = got
+	}
+	if got := step(); got != 4 {
+		t.Errorf("step after the ramp moved %v, want the full speed 4", got)
+	}
+
+	// SetText starts the ramp again
+	s.SetText("WORLD")
+	if got := step(); got != 0 {
+		t.Errorf("first step after SetText moved %v, want 0", got)
+	}
+}
+
+func TestIsSilentAfterWindow(t *testing.T) {
+	y := newTestPlayer(t)
+	read := func(ms int) {
+		t.Helper()
+		if _, err := y.Read(make([]byte, sampleRate*ms/1000*4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read(500)
+	if y.IsSilent(100) {
+		t.Fatal("silent while the tune plays")
+	}
+
+	// Zero gain feeds zeros to the output
+	y.volume, y.targetVolume = 0, 0
+	read(60)
+	if y.IsSilent(100) {
+		t.Error("silent after 60ms of zeros, want a full 100ms window")
+	}
+	read(60)
+	if !y.IsSilent(100) {
+		t.Error("not silent after 120ms of zeros")
+	}
+}
+
+func TestScrollLoggerLogsEnteringWords(t *testing.T) {
+	s := NewScrollTextWithRenderer("HELLO CAREBEARS WORLD", &recordingGlyphs{}, 1, false)
+	s.SetViewport(40, 8)
+	var buf bytes.Buffer
+	l := &scrollLogger{w: &buf}
+
+	steps := []struct {
+		scrollX float64
+		ms      int64
+		want    string
+	}{
+		{40, 1000, ""}, // Nothing on screen yet
+		{-10, 1500, "00:01.500 HELLO\n00:01.500 CAREBEARS\n"},
+		{-20, 1600, ""}, // No new word entered
+		{-100, 2000, "00:02.000 WORLD\n"},
+	}
+	for _, st := range steps {
+		buf.Reset()
+		s.scrollX = st.scrollX
+		l.Check(s, st.ms)
+		if got := buf.String(); got != st.want {
+			t.Errorf("at scrollX %v logged %q, want %q", st.scrollX, got, st.want)
+		}
+	}
+}
+
+func TestBlankAdvanceDrawsNothing(t *testing.T) {
+	img, fm := testFont()
+	img.SubImage(image.Rect(0, 0, 8, 8)).(*ebiten.Image).Fill(color.White) // The A cell, at (0,0)
+	fm.AddBlank('-', 4)
+
+	s := NewScrollText("-A", img, fm, 1, false)
+	s.SetViewport(40, 8)
+	s.scrollX = 0
+	dst := ebiten.NewImage(40, 8)
+	s.Draw(dst, 0, 1)
+
+	// The dash only moves A along; drawing cell (0,0) would paint its pixels
+	for x := range 12 {
+		_, _, _, a := dst.At(x, 4).RGBA()
+		if wantInk := x >= 4; (a != 0) != wantInk {
+			t.Errorf("pixel %d alpha = %d, want ink %v", x, a, wantInk)
+		}
+	}
+}
+
+func TestGenerateRaster(t *testing.T) {
+	const width, bands, bandHeight = 16, 6, 4
+	img := generateRaster(width, bands, bandHeight, false)
+	if got := img.Bounds().Dy(); got != bands*bandHeight {
+		t.Fatalf("raster height = %d, want %d", got, bands*bandHeight)
+	}
+	for band := range bands {
+		want := rasterBandColor(band, bands)
+		for y := band * bandHeight; y < (band+1)*bandHeight; y++ {
+			for _, x := range []int{0, width - 1} {
+				if got := img.RGBAAt(x, y); got != want {
+					t.Fatalf("hard band %d pixel %d,%d = %v, want %v", band, x, y, got, want)
+				}
+			}
+		}
+	}
+
+	// Smooth bands start on their color and blend towards the next one
+	smooth := generateRaster(width, bands, bandHeight, true)
+	if got, want := smooth.RGBAAt(0, bandHeight), rasterBandColor(1, bands); got != want {
+		t.Errorf("smooth band 1 starts at %v, want %v", got, want)
+	}
+	if smooth.RGBAAt(0, bandHeight+1) == smooth.RGBAAt(0, bandHeight) {
+		t.Error("smooth band is flat")
+	}
+}
+
+func TestSetGammaClamps(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	tests := []struct{ in, want float64 }{
+		{1, 1},
+		{1.5, 1.5},
+		{0, minGamma},
+		{-3, minGamma},
+		{10, maxGamma},
+	}
+	for _, tt := range tests {
+		g.SetGamma(tt.in)
+		if g.gamma != tt.want {
+			t.Errorf("SetGamma(%v) set %v, want %v", tt.in, g.gamma, tt.want)
+		}
+	}
+
+	g.SetGamma(1)
+	pressKey(g, ebiten.KeyPageUp)
+	if math.Abs(g.gamma-(1+gammaStep)) > 1e-9 {
+		t.Errorf("PAGE UP set gamma %v, want %v", g.gamma, 1+gammaStep)
+	}
+}
+
+func TestGammaLUT(t *testing.T) {
+	lut := gammaLUT(2)
+	for _, tt := range []struct{ in, want uint8 }{
+		{0, 0},
+		{255, 255},
+		{128, 181}, // 255 * sqrt(128/255)
+	} {
+		if got := lut[tt.in]; got != tt.want {
+			t.Errorf("gammaLUT(2)[%d] = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	identity := gammaLUT(1)
+	for i, v := range identity {
+		if int(v) != i {
+			t.Errorf("gammaLUT(1)[%d] = %d, want it unchanged", i, v)
+		}
+	}
+}
+
+func TestGammaOnCPU(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	g.SetGamma(2)
+	img := ebiten.NewImage(screenWidth, screenHeight)
+	img.Fill(color.RGBA{128, 0, 255, 255})
+
+	g.correctGammaOnCPU(img)
+	if got, want := img.At(10, 10), (color.RGBA{181, 0, 255, 255}); got != want {
+		t.Errorf("pixel after CPU gamma 2 = %v, want %v", got, want)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"01:30", 90000, true},
+		{"0:05", 5000, true},
+		{"12:00", 720000, true},
+		{"1:5", 0, false},
+		{"01:60", 0, false},
+		{"-1:00", 0, false},
+		{"90", 0, false},
+		{"aa:10", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseTimestamp(%q) = %d, %v, want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestStartPosition(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.StartMs = 5000
+	assets := StubAssets()
+	assets.Tracks = []musicTrack{{"TUNE", musicData}}
+	g := NewGameWithAssets(cfg, assets)
+	t.Cleanup(g.Cleanup)
+
+	if got := g.ymPlayer.CurrentTimeMs(); got < 5000 || got > 6000 {
+		t.Errorf("music starts at %dms, want 5000", got)
+	}
+}
+
+func TestBackgroundSpeedsSetStepDelta(t *testing.T) {
+	for _, speed := range []float64{1, 3} {
+		cfg := DefaultConfig()
+		cfg.Bg1SpeedY = speed
+		cfg.Bg2SpeedY = 2 * speed
+		g := newTestGame(t, cfg)
+
+		// Both backgrounds turn at the top within the first steps
+		for range 5 {
+			g.stepAnimation()
+		}
+		y1, y2 := g.moveY, g.Y
+		g.stepAnimation()
+		if got := y1 - g.moveY; got != speed {
+			t.Errorf("Bg1SpeedY %v: background 1 moved %v per step", speed, got)
+		}
+		if got := y2 - g.Y; got != 2*speed {
+			t.Errorf("Bg2SpeedY %v: background 2 moved %v per step", 2*speed, got)
+		}
+	}
+}
+
+func TestResizeCanvasesScales(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.LowRes = true
+	g := newTestGame(t, cfg)
+
+	g.resizeCanvases(320, 200)
+	tests := []struct {
+		name string
+		img  *ebiten.Image
+		w, h int
+	}{
+		{"background 1", g.bgCanvas, 320 * 3, 200 * 2},
+		{"background 2", g.bg2Canvas, 320 * 3, 200 * 2},
+		{"big scroll", g.bsCanvas, 320, 40},
+		{"raster scroll", g.bs2Canvas, 320, 100},
+		{"vertical scroll", g.upCanvas, 32, 200},
+		{"small scroll", g.lCanvas, 160, 8},
+		{"low-res frame", g.frame, 160, 100},
+	}
+	for _, tt := range tests {
+		if tt.img == nil {
+			t.Errorf("%s canvas missing after resize", tt.name)
+			continue
+		}
+		if w, h := tt.img.Bounds().Dx(), tt.img.Bounds().Dy(); w != tt.w || h != tt.h {
+			t.Errorf("%s canvas = %dx%d, want %dx%d", tt.name, w, h, tt.w, tt.h)
+		}
+	}
+	if got := g.scrollText1.viewWidth; got != 320/bigScrollZoomX {
+		t.Errorf("big scroll viewport width = %v, want %v", got, 320/bigScrollZoomX)
+	}
+	if w, h := g.Layout(0, 0); w != 320 || h != 200 {
+		t.Errorf("Layout = %dx%d, want 320x200", w, h)
+	}
+
+	// The canvases made while drawing follow the new size too
+	g.SetGamma(1.5)
+	g.bgTransition.Start(0, 1, 4)
+	g.Draw(ebiten.NewImage(320, 200))
+	for name, img := range map[string]*ebiten.Image{"post": g.postCanvas, "background fade": g.bgFadeCanvas} {
+		if img == nil {
+			t.Errorf("%s canvas not created while drawing", name)
+		} else if b := img.Bounds(); b.Dx() != 320 || b.Dy() != 200 {
+			t.Errorf("%s canvas = %dx%d, want 320x200", name, b.Dx(), b.Dy())
+		}
+	}
+}
+
+func TestInvertBackgroundsReversesFirstStep(t *testing.T) {
+	firstStep := func(invert bool) (dy1, dy2 float64) {
+		cfg := DefaultConfig()
+		cfg.InvertBackgrounds = invert
+		g := newTestGame(t, cfg)
+		y1, y2 := g.moveY, g.Y
+		g.stepAnimation()
+		return g.moveY - y1, g.Y - y2
+	}
+	plain1, plain2 := firstStep(false)
+	inv1, inv2 := firstStep(true)
+	if plain1 == 0 || inv1 != -plain1 {
+		t.Errorf("background 1 first step = %v inverted, %v normally; want opposite signs", inv1, plain1)
+	}
+	if plain2 == 0 || inv2 != -plain2 {
+		t.Errorf("background 2 first step = %v inverted, %v normally; want opposite signs", inv2, plain2)
+	}
+}
+
+func TestOrbitCenter(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	translation := func() (float64, float64) {
+		m := g.spriteGeoM(0)
+		return m.Element(0, 2), m.Element(1, 2)
+	}
+
+	g.SetOrbitCenter(200, 150)
+	x1, y1 := translation()
+	g.SetOrbitCenter(250, 120)
+	x2, y2 := translation()
+	if x2-x1 != 50 || y2-y1 != -30 {
+		t.Errorf("moving the centre by 50, -30 moved the sprite by %v, %v", x2-x1, y2-y1)
+	}
+
+	g.SetOrbitCenter(-10, 1000)
+	if x, y := g.OrbitCenter(); x != 0 || y != screenHeight {
+		t.Errorf("OrbitCenter after an off-screen set = %v, %v, want 0, %d", x, y, screenHeight)
+	}
+
+	// Following the mouse and stopping returns to where the orbit was
+	g.SetOrbitCenter(200, 150)
+	pressKey(g, ebiten.KeyM)
+	g.SetOrbitCenter(10, 10) // As followCursor would
+	pressKey(g, ebiten.KeyM)
+	if x, y := g.OrbitCenter(); x != 200 || y != 150 {
+		t.Errorf("centre after following the mouse = %v, %v, want it back at 200, 150", x, y)
+	}
+
+	// So does a reset
+	pressKey(g, ebiten.KeyM)
+	g.SetOrbitCenter(10, 10)
+	g.resetTunables()
+	if x, y := g.OrbitCenter(); g.followMouse || x != 200 || y != 150 {
+		t.Errorf("after reset following = %v at %v, %v, want off at 200, 150", g.followMouse, x, y)
+	}
+}
+
+// readProfile checks that path holds a non-empty gzipped pprof profile
+func readProfile(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("profile %s is not gzipped: %v", path, err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("reading profile %s: %v", path, err)
+	}
+	if len(data) == 0 {
+		t.Fatalf("profile %s is empty", path)
+	}
+}
+
+func TestCPUProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cpu.pprof")
+	stop, err := startCPUProfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	y := newTestPlayer(t)
+	buf := make([]byte, 4096)
+	for range 200 {
+		if _, err := y.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop()
+	stop() // Stopping twice, e.g. from a signal and on exit, is harmless
+	readProfile(t, path)
+}
+
+func TestHeapProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heap.pprof")
+	if err := writeHeapProfile(path); err != nil {
+		t.Fatal(err)
+	}
+	readProfile(t, path)
+
+	if err := writeHeapProfile(filepath.Join(t.TempDir(), "missing", "heap.pprof")); err == nil {
+		t.Error("writeHeapProfile into a missing directory succeeded")
+	}
+}
+
+func TestSectionScaleAtScrollPosition(t *testing.T) {
+	text, sections := parseScrollSections("AB{2}CD{0.5}EF{x}G")
+	if text != "ABCDEF{x}G" {
+		t.Errorf("parsed text = %q, want the markers stripped and {x} kept", text)
+	}
+	if want := []scrollSection{{2, 2}, {4, 0.5}}; len(sections) != 2 || sections[0] != want[0] || sections[1] != want[1] {
+		t.Errorf("sections = %v, want %v", sections, want)
+	}
+
+	// 8 pixel glyphs behind a 16 pixel viewport, centred at x = 8
+	s := NewScrollTextWithRenderer("AB{2}CD{0.5}EF{x}G", &recordingGlyphs{}, 1, false)
+	s.SetViewport(16, 8)
+	tests := []struct {
+		scrollX float64
+		want    float64
+	}{
+		{0, 1},     // B at the centre
+		{-16, 2},   // D
+		{-32, 0.5}, // F
+		{-70, 0.5}, // Past the last marker
+	}
+	for _, tt := range tests {
+		s.scrollX = tt.scrollX
+		if got := s.CenterScale(); got != tt.want {
+			t.Errorf("CenterScale at scrollX %v = %v, want %v", tt.scrollX, got, tt.want)
+		}
+	}
+}
+
+func TestBigScrollCenterScale(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	s := g.scrollText1
+	aside := strings.Index(s.text, "(THAT NAME")
+	if aside < 0 {
+		t.Fatal("big scroll lacks the aside marked as smaller")
+	}
+	offset := 0.0
+	for _, ch := range s.text[:aside] {
+		offset += float64(s.charAdvance(ch))
+	}
+
+	// The middle of the screen, in font pixels before the magnification
+	centre := float64(g.width) / 2 / bigScrollZoomX
+	s.scrollX = centre - offset - 1
+	if got := s.CenterScale(); got != 0.75 {
+		t.Errorf("CenterScale with the aside at the middle of the screen = %v, want 0.75", got)
+	}
+	s.scrollX = centre - offset + 1
+	if got := s.CenterScale(); got != 1 {
+		t.Errorf("CenterScale just before the aside = %v, want 1", got)
+	}
+}
+
+func TestMissingRunes(t *testing.T) {
+	img, fm := testFont()
+	s := NewScrollText("HELLO, WORLD! ÉTÉ HI", img, fm, 1, false)
+	got := string(s.MissingRunes())
+	if got != "!,É" {
+		t.Errorf("MissingRunes = %q, want %q", got, "!,É")
+	}
+
+	// Lowercase is drawn uppercased, so it is not missing
+	s.SetText("hello")
+	if got := s.MissingRunes(); len(got) != 0 {
+		t.Errorf("MissingRunes for lowercase = %q, want none", got)
+	}
+}
+
+func TestEnvelopeFollowsAttackAndRelease(t *testing.T) {
+	e := envelope{attack: 100 * time.Millisecond, release: 400 * time.Millisecond}
+	const dt = 10 * time.Millisecond
+
+	// After one attack time of a step input the envelope is 1-1/e of the way
+	for range 10 {
+		e.Step(1, dt)
+	}
+	if want := 1 - 1/math.E; math.Abs(e.value-want) > 1e-9 {
+		t.Errorf("value after one attack time = %v, want %v", e.value, want)
+	}
+	for range 90 {
+		e.Step(1, dt)
+	}
+	if e.value < 0.999 {
+		t.Errorf("value after ten attack times = %v, want settled near 1", e.value)
+	}
+
+	// Falls take the slower release time
+	before := e.value
+	e.Step(0, 100*time.Millisecond)
+	if want := before * math.Exp(-0.25); math.Abs(e.value-want) > 1e-9 {
+		t.Errorf("value 100ms into the release = %v, want about %v", e.value, want)
+	}
+
+	instant := envelope{}
+	if got := instant.Step(0.7, dt); got != 0.7 {
+		t.Errorf("envelope without time constants = %v, want the input 0.7", got)
+	}
+}
+
+func TestClockDrivesPulseRelease(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Pulse = true
+	g := newTestGame(t, cfg)
+	clock := NewManualClock(time.Unix(0, 0))
+	g.SetClock(clock)
+	g.stopMusic() // No music level, so the pulse only decays
+	g.pulse.value = 1
+
+	if err := g.Update(); err != nil {
+		t.Fatal(err)
+	}
+	// Time stands still on a manual clock, however many frames run
+	for range 10 {
+		if err := g.Update(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g.pulse.value >= 1 {
+		t.Errorf("pulse = %v, want some release from the first frame", g.pulse.value)
+	}
+	held := g.pulse.value
+	if err := g.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if g.pulse.value != held {
+		t.Errorf("pulse moved from %v to %v without the clock advancing", held, g.pulse.value)
+	}
+
+	// Twenty release times later the fade is complete
+	for range 20 {
+		clock.Advance(g.pulse.release)
+		if err := g.Update(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g.pulse.value > 1e-6 {
+		t.Errorf("pulse after 20 release times = %v, want faded to 0", g.pulse.value)
+	}
+}
+
+func TestClockDrivesVURelease(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.VUMeter = true
+	g := newTestGame(t, cfg)
+	clock := NewManualClock(time.Unix(0, 0))
+	g.SetClock(clock)
+	g.stopMusic() // No peaks, so the bars only fall
+	if err := g.Update(); err != nil {
+		t.Fatal(err)
+	}
+	g.vu[0].value = 1
+
+	for range 10 {
+		if err := g.Update(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g.vu[0].value != 1 {
+		t.Errorf("VU bar fell to %v without the clock advancing", g.vu[0].value)
+	}
+	clock.Advance(vuRelease)
+	if err := g.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if v := g.vu[0].value; v <= 0 || v >= 1 {
+		t.Errorf("VU bar one release time later = %v, want it falling", v)
+	}
+}
+
+// uncachedGlyphs draws like bitmapGlyphs did before it cached sub-images:
+// a fresh sub-image and draw options for every glyph
+type uncachedGlyphs struct {
+	*bitmapGlyphs
+}
+
+func (u uncachedGlyphs) DrawGlyph(dst *ebiten.Image, ch rune, x, y, scale float64, clr ebiten.ColorScale) {
+	if _, mapping, ok := u.fontMap.lookup(ch); ok {
+		drawGlyph(dst, u.img, mapping, x, y, scale)
+	}
+}
+
+// bigScrollGame returns a Game on the embedded assets, whose big scroll is
+// the demo's own text and font
+func bigScrollGame(t testing.TB) *Game {
+	t.Helper()
+	g := NewGameWithAssets(DefaultConfig(), embeddedAssets())
+	t.Cleanup(g.Cleanup)
+	if g.scrollText1 == nil {
+		t.Fatal("no big scroll")
+	}
+	return g
+}
+
+// drawHash draws s at scrollX into a fresh canvas and hashes the pixels
+func drawHash(s *ScrollText, scrollX float64, w, h int) [sha256.Size]byte {
+	dst := ebiten.NewImage(w, h)
+	s.scrollX = scrollX
+	s.Draw(dst, 0, 1)
+	pix := make([]byte, 4*w*h)
+	dst.ReadPixels(pix)
+	return sha256.Sum256(pix)
+}
+
+func TestBigScrollRenderPathsMatch(t *testing.T) {
+	g := bigScrollGame(t)
+	s := g.scrollText1
+	w, h := s.viewWidth, s.viewHeight
+	cached := s.glyphs.(*bitmapGlyphs)
+	blank := drawHash(s, w, int(w), int(h)) // Nothing entered yet
+
+	for _, scrollX := range []float64{-2000, -2333, -8000, -float64(s.textWidth()) + 100} {
+		s.glyphs, s.tiles = cached, nil
+		want := drawHash(s, scrollX, int(w), int(h))
+		if want == blank {
+			t.Fatalf("scrollX %v: nothing drawn", scrollX)
+		}
+
+		s.glyphs = uncachedGlyphs{cached}
+		if got := drawHash(s, scrollX, int(w), int(h)); got != want {
+			t.Errorf("scrollX %v: cached glyphs differ from per-glyph sub-images", scrollX)
+		}
+
+		s.glyphs = cached
+		s.Prerender(prerenderTileWidth)
+		if got := drawHash(s, scrollX, int(w), int(h)); got != want {
+			t.Errorf("scrollX %v: prerendered tiles differ from glyph by glyph drawing", scrollX)
+		}
+	}
+}
+
+func BenchmarkBigScrollDraw(b *testing.B) {
+	g := bigScrollGame(b)
+	s := g.scrollText1
+	cached := s.glyphs.(*bitmapGlyphs)
+	bench := func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			s.Update()
+			g.bsCanvas.Clear()
+			s.Draw(g.bsCanvas, 0, 1)
+		}
+	}
+
+	b.Run("uncached", func(b *testing.B) {
+		s.glyphs, s.tiles = uncachedGlyphs{cached}, nil
+		bench(b)
+	})
+	b.Run("cached", func(b *testing.B) {
+		s.glyphs, s.tiles = cached, nil
+		bench(b)
+	})
+	b.Run("prerendered", func(b *testing.B) {
+		s.glyphs = cached
+		s.Prerender(prerenderTileWidth)
+		bench(b)
+	})
+}
+
+func TestLoopCountEndsAfterPasses(t *testing.T) {
+	y := newTestPlayer(t)
+	y.SetLoopCount(2)
+	length := y.LengthMs()
+	buf := make([]byte, sampleRate/5*4) // 200ms
+
+	// Skip to just before the end of each pass
+	for pass := 1; pass <= 3; pass++ {
+		y.SetPositionMs(length - 100)
+		n, err := y.Read(buf)
+		if pass < 3 {
+			if err != nil {
+				t.Fatalf("pass %d ended with %v, want the tune to loop", pass, err)
+			}
+			continue
+		}
+		if err != io.EOF {
+			t.Fatalf("third pass ended with %v, want EOF", err)
+		}
+		if n != len(buf) {
+			t.Errorf("last Read = %d bytes, want the %d requested, padded with silence", n, len(buf))
+		}
+	}
+	if _, err := y.Read(buf); err != io.EOF {
+		t.Errorf("Read after the last pass = %v, want EOF", err)
+	}
+}
+
+// readFrames reads n stereo 16-bit frames from y and returns the left channel
+func readFrames(t *testing.T, y *YMPlayer, n int) []int16 {
+	t.Helper()
+	buf := make([]byte, n*4)
+	if _, err := y.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	left := make([]int16, n)
+	for i := range left {
+		left[i] = int16(binary.LittleEndian.Uint16(buf[i*4:]))
+	}
+	return left
+}
+
+func TestCrossfadeMixesBothTunes(t *testing.T) {
+	next := withReplayHz(t, 100) // The same tune at twice the speed
+	y, refOld := newTestPlayer(t), newTestPlayer(t)
+	refNew, err := NewYMPlayer(next, sampleRate, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refNew.Close()
+	for _, p := range []*YMPlayer{y, refOld, refNew} {
+		p.SetVolume(1)
+	}
+
+	// Let the volume ramps settle and the old tune get going
+	readFrames(t, y, sampleRate/2)
+	readFrames(t, refOld, sampleRate/2)
+	refNew.volume = refNew.targetVolume
+
+	// A fade that ends partway through the Read below
+	const fade = 441
+	if err := y.Crossfade(next, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	const n = 2000
+	got := readFrames(t, y, n)
+	if y.next != nil || y.fadeDone != fade {
+		t.Fatalf("after the Read the crossfade ran %d of %d samples, want it finished exactly", y.fadeDone, fade)
+	}
+
+	// The emulator filters across chunk edges, so the references are read
+	// in the same chunks the crossfade split the Read into
+	oldRef := append(readFrames(t, refOld, fade), readFrames(t, refOld, n-fade)...)
+	newRef := append(readFrames(t, refNew, fade), readFrames(t, refNew, n-fade)...)
+
+	oldHeard, newHeard := false, false
+	for i := range n {
+		w := min(float64(i)/fade, 1)
+		want := float64(oldRef[i])*(1-w) + float64(newRef[i])*w
+		if math.Abs(float64(got[i])-want) > 2 {
+			t.Fatalf("sample %d = %d, want %.0f (%.2f of the new tune)", i, got[i], want, w)
+		}
+		if i == fade/2 {
+			oldHeard = oldRef[i] != 0
+			newHeard = newRef[i] != 0
+		}
+	}
+	if !oldHeard || !newHeard {
+		t.Errorf("midway through the fade the old tune is %v and the new %v, want both sounding", oldHeard, newHeard)
+	}
+}
+
+func TestPauseLabelBlinks(t *testing.T) {
+	for frame, want := range map[int]bool{
+		0:                      true,
+		pauseBlinkFrames - 1:   true,
+		pauseBlinkFrames:       false,
+		2*pauseBlinkFrames - 1: false,
+		2 * pauseBlinkFrames:   true,
+		5*pauseBlinkFrames + 3: false,
+	} {
+		if got := pauseBlinkVisible(frame); got != want {
+			t.Errorf("pauseBlinkVisible(%d) = %v, want %v", frame, got, want)
+		}
+	}
+
+	// The blink keeps counting while the scene is frozen
+	g := newTestGame(t, DefaultConfig())
+	g.togglePause()
+	ticks, start := g.ticks, g.uiFrame
+	for range pauseBlinkFrames {
+		if err := g.Update(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g.ticks != ticks {
+		t.Errorf("scene ticks moved from %d to %d while paused", ticks, g.ticks)
+	}
+	if g.uiFrame-start != pauseBlinkFrames || pauseBlinkVisible(g.uiFrame) == pauseBlinkVisible(start) {
+		t.Errorf("after %d paused Updates the label went from frame %d to %d without toggling", pauseBlinkFrames, start, g.uiFrame)
+	}
+}
+
+func TestRasterCoversCanvas(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	raster, canvas := ebiten.NewImage(320, 40), ebiten.NewImage(640, 120)
+	defer raster.Deallocate()
+	defer canvas.Deallocate()
+
+	for _, scale := range []float64{0.5, 1, 2, 3, 4.5} {
+		for _, offsetY := range []float64{0, -10, -35, 20} {
+			geoM := g.rasterGeoM(raster, canvas, offsetY, scale, scale)
+			x0, y0 := geoM.Apply(0, 0)
+			x1, y1 := geoM.Apply(320, 40)
+			if x0 > 0 || y0 > 0 || x1 < 640 || y1 < 120 {
+				t.Errorf("scale %v, offset %v: raster spans (%v, %v)-(%v, %v), want it to cover (0, 0)-(640, 120)",
+					scale, offsetY, x0, y0, x1, y1)
+			}
+		}
+	}
+}
+
+func TestMirrorGeoM(t *testing.T) {
+	geoM := mirrorGeoM(screenWidth)
+	for _, tt := range []struct{ x, y, wantX float64 }{
+		{0, 0, screenWidth},
+		{screenWidth, 10, 0},
+		{100, 50, screenWidth - 100},
+	} {
+		if x, y := geoM.Apply(tt.x, tt.y); x != tt.wantX || y != tt.y {
+			t.Errorf("mirrored (%v, %v) = (%v, %v), want (%v, %v)", tt.x, tt.y, x, y, tt.wantX, tt.y)
+		}
+	}
+}
+
+func TestSwingAmplitudeBoundsYChange(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SwingAmplitude = 80
+	g := newTestGame(t, cfg)
+
+	// A full swing from -80 to 80 takes 1600 steps of 0.1
+	lo, hi, turns := 0.0, 0.0, 0
+	for range 5000 {
+		before := g.addy
+		g.stepAnimation()
+		lo, hi = min(lo, g.ychange), max(hi, g.ychange)
+		if g.addy != before {
+			turns++
+		}
+	}
+	if hi <= 80 || hi > 80.2 || lo >= -80 || lo < -80.2 {
+		t.Errorf("ychange ranged over [%v, %v], want it to turn just past ±80", lo, hi)
+	}
+	if turns < 3 {
+		t.Errorf("ychange turned %d times in 5000 steps, want it to ping-pong", turns)
+	}
+}
+
+func TestFullyVisibleText(t *testing.T) {
+	s := NewScrollTextWithRenderer("HELLO CAREBEARS", &recordingGlyphs{}, 1, false)
+	s.SetViewport(40, 8)
+	tests := []struct {
+		scrollX float64
+		want    string
+	}{
+		{0, "HELLO"},   // H through O, the space trimmed
+		{-4, "ELLO"},   // H cut at the left edge, C at the right
+		{-48, "CAREB"}, // Five whole glyphs from C
+		{-44, "CARE"},  // The space half out, B cut on the right
+		{-112, "S"},    // Only the last glyph left
+		{-200, ""},     // Scrolled off
+		{40, ""},       // Not entered yet
+	}
+	for _, tt := range tests {
+		s.scrollX = tt.scrollX
+		if got := s.FullyVisibleText(); got != tt.want {
+			t.Errorf("FullyVisibleText at scrollX %v = %q, want %q", tt.scrollX, got, tt.want)
+		}
+	}
+
+	// The demo's own big scroll fits three glyphs in its viewport
+	g := bigScrollGame(t)
+	big := g.scrollText1
+	advance := float64(big.charAdvance(' '))
+	hi := -float64(strings.Index(big.text, "HI AND")) * advance
+	for _, tt := range []struct {
+		scrollX float64
+		want    string
+	}{
+		{0, ""},                 // The leading spaces
+		{hi, "HI"},              // H, I and a trimmed space
+		{hi - 5, "I"},           // H cut at the left edge, A at the right
+		{hi - 3*advance, "AND"}, // The next word in full
+	} {
+		big.scrollX = tt.scrollX
+		if got := g.CurrentScrollText(); got != tt.want {
+			t.Errorf("CurrentScrollText at scrollX %v = %q, want %q", tt.scrollX, got, tt.want)
+		}
+	}
+}
+
+func TestChannelStride(t *testing.T) {
+	mono, stereo := newTestPlayer(t), newTestPlayer(t)
+	if err := mono.SetChannels(1); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 3, 6} {
+		if err := stereo.SetChannels(n); err == nil {
+			t.Errorf("SetChannels(%d) succeeded, want an error", n)
+		}
+	}
+
+	const frames = 500
+	m, s := make([]byte, frames*2), make([]byte, frames*4)
+	if n, err := mono.Read(m); err != nil || n != frames*2 {
+		t.Fatalf("mono Read = %d, %v, want %d bytes", n, err, frames*2)
+	}
+	if n, err := stereo.Read(s); err != nil || n != frames*4 {
+		t.Fatalf("stereo Read = %d, %v, want %d bytes", n, err, frames*4)
+	}
+
+	// Mono packs one sample per frame, stereo the same sample twice
+	heard := false
+	for i := range frames {
+		v := binary.LittleEndian.Uint16(m[i*2:])
+		l, r := binary.LittleEndian.Uint16(s[i*4:]), binary.LittleEndian.Uint16(s[i*4+2:])
+		if l != v || r != v {
+			t.Fatalf("frame %d: mono %d, stereo %d/%d, want the same sample", i, int16(v), int16(l), int16(r))
+		}
+		heard = heard || v != 0
+	}
+	if !heard {
+		t.Error("both outputs are silent")
+	}
+}
+
+func TestSelfTestReportsMissingGlyph(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	img, fm := testFont()
+	g.scrollText3 = NewScrollText("HELLO", img, fm, 1, false)
+	var out strings.Builder
+	g.SelfTest(&out)
+	if !strings.Contains(out.String(), "PASS first small scroll text\n") {
+		t.Errorf("report for a covered text:\n%s", out.String())
+	}
+
+	g.scrollText3.SetText("HELLO!")
+	out.Reset()
+	if err := g.SelfTest(&out); err == nil {
+		t.Error("SelfTest with a missing glyph succeeded, want an error")
+	}
+	if want := `FAIL first small scroll text: font lacks "!"`; !strings.Contains(out.String(), want) {
+		t.Errorf("report lacks %q:\n%s", want, out.String())
+	}
+}
+
+func TestMasterVolumeAppliedOnce(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	if err := g.LoadMusic(musicData); err != nil {
+		t.Fatal(err)
+	}
+	pressKey(g, ebiten.KeyMinus)
+	pressKey(g, ebiten.KeyMinus)
+
+	want := defaultVolume - 2*volumeStep
+	if got := g.ymPlayer.targetVolume; math.Abs(got-want) > 1e-9 {
+		t.Errorf("YM player volume = %v, want %v", got, want)
+	}
+	// A second gain on the output would square the volume
+	if got := g.audioPlayer.Volume(); got != 1 {
+		t.Errorf("audio player volume = %v, want 1", got)
+	}
+}
+
+func TestSmallScrollRasterOffset(t *testing.T) {
+	// The defaults give back the original -16 and -64
+	for _, y := range []float64{16, 64, 0, 100, 333.5} {
+		if got := smallScrollRasterOffset(y); got != -y {
+			t.Errorf("smallScrollRasterOffset(%v) = %v, want %v", y, got, -y)
+		}
+	}
+}
+
+func TestStopEndsRunLoop(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	if err := g.LoadMusic(musicData); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Update(); err != nil {
+		t.Fatalf("Update before Stop = %v", err)
+	}
+	ym := g.ymPlayer
+
+	g.Stop()
+	if g.ymPlayer != nil || g.audioPlayer != nil {
+		t.Error("Stop left the music players in place")
+	}
+	if _, err := ym.Read(make([]byte, 64)); err != io.EOF {
+		t.Errorf("Read from the stopped YM player = %v, want io.EOF", err)
+	}
+	for range 2 {
+		if err := g.Update(); !errors.Is(err, ebiten.Termination) {
+			t.Errorf("Update after Stop = %v, want ebiten.Termination", err)
+		}
+	}
+	g.Cleanup() // Also run by the test cleanup, so twice in all
+}
+
+func TestFadeOutMusicTimesOutOnClock(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	if err := g.LoadMusic(musicData); err != nil {
+		t.Fatal(err)
+	}
+	if !g.audioPlayer.IsPlaying() {
+		t.Fatal("music not playing after LoadMusic")
+	}
+	clock := NewManualClock(time.Unix(0, 0))
+	g.SetClock(clock)
+
+	done := make(chan struct{})
+	go func() {
+		g.FadeOutMusic(time.Second)
+		close(done)
+	}()
+	// Advance until the wait gives up, or the audio device finished the fade
+	for range 100 {
+		select {
+		case <-done:
+			return
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(100 * time.Millisecond)
+		}
+	}
+	t.Fatal("FadeOutMusic still waiting 10s of clock time after a 1s fade")
+}
+
+func TestFadeOutLeavesVolumeRamp(t *testing.T) {
+	y := newTestPlayer(t)
+	ramp, volume := y.rampSamples, y.volume
+	const fade = sampleRate / 10
+
+	done := y.FadeOut(100 * time.Millisecond)
+	readFrames(t, y, fade/2)
+	select {
+	case <-done:
+		t.Fatal("fade-out signalled halfway through")
+	default:
+	}
+	readFrames(t, y, fade/2)
+	select {
+	case <-done:
+	default:
+		t.Fatal("fade-out not signalled after its duration")
+	}
+	for i, v := range readFrames(t, y, 1000) {
+		if v != 0 {
+			t.Fatalf("sample %d after the fade-out = %d, want silence", i, v)
+		}
+	}
+
+	// The fade works on top of the volume, which keeps its own ramp
+	if y.rampSamples != ramp || y.volume != volume {
+		t.Errorf("after the fade-out ramp = %d samples at volume %v, want %d at %v", y.rampSamples, y.volume, ramp, volume)
+	}
+	y.SetVolume(0)
+	readFrames(t, y, 100)
+	if want := volume - 100/float64(ramp); math.Abs(y.volume-want) > 1e-9 {
+		t.Errorf("volume ramped to %v in 100 samples, want %v", y.volume, want)
+	}
+}
+
+func TestSeedReproducesEffects(t *testing.T) {
+	a, b := newConfetti(50, newRand(42)), newConfetti(50, newRand(42))
+	for range 10 {
+		a.Update(0.1, true, 640, 480)
+		b.Update(0.1, true, 640, 480)
+	}
+	if len(a.particles) == 0 {
+		t.Fatal("no confetti spawned")
+	}
+	if !slices.Equal(a.particles, b.particles) {
+		t.Error("confetti with the same seed differ")
+	}
+
+	ga, gb, gc := newFilmGrain(newRand(42)), newFilmGrain(newRand(42)), newFilmGrain(newRand(43))
+	if !bytes.Equal(ga.pix, gb.pix) {
+		t.Error("grain with the same seed differs")
+	}
+	if bytes.Equal(ga.pix, gc.pix) {
+		t.Error("grain with different seeds is the same")
+	}
+}
+
+func TestInterleaveMode(t *testing.T) {
+	header := func(id string, attrs uint32) []byte {
+		data := make([]byte, 28)
+		copy(data, id+"LeOnArD!")
+		binary.BigEndian.PutUint32(data[16:20], attrs)
+		return data
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"YM5 interleaved", header("YM5!", 1), ymInterleaved},
+		{"YM6 interleaved with other attributes", header("YM6!", 0x0d), ymInterleaved},
+		{"YM6 sequential", header("YM6!", 0), ymSequential},
+		{"YM5 sequential with other attributes", header("YM5!", 0x0c), ymSequential},
+		{"YM3", []byte("YM3!\x00\x00"), ymInterleaved},
+		{"YM5 cut short", []byte("YM5!LeOnArD!"), ymUnknown},
+		{"not a YM file", []byte("RIFF"), ymUnknown},
+		{"empty", nil, ymUnknown},
+	}
+	for _, tt := range tests {
+		if got := ymInterleaveMode(tt.data); got != tt.want {
+			t.Errorf("%s: ymInterleaveMode = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// The embedded tune is a packed interleaved YM5 or YM6
+	if got := newTestPlayer(t).InterleaveMode(); got != ymInterleaved {
+		t.Errorf("InterleaveMode of the embedded tune = %q, want %q", got, ymInterleaved)
+	}
+}
+
+func TestReadDoesNotAllocate(t *testing.T) {
+	y := newTestPlayer(t)
+	buf := make([]byte, 4096)
+	y.Read(buf) // Warm up: sizes the scratch buffers
+
+	if allocs := testing.AllocsPerRun(100, func() {
+		if _, err := y.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}); allocs != 0 {
+		t.Errorf("Read allocates %v times per call after warmup, want 0", allocs)
+	}
+}
+
+func BenchmarkYMPlayerRead(b *testing.B) {
+	y := newTestPlayer(b)
+	buf := make([]byte, 4096)
+	y.Read(buf)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := y.Read(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFillGrainIsDeterministic(t *testing.T) {
+	a, b := make([]byte, 4*grainSize*grainSize), make([]byte, 4*grainSize*grainSize)
+	fillGrain(a, newRand(7))
+	fillGrain(b, newRand(7))
+	if !bytes.Equal(a, b) {
+		t.Fatal("noise from the same seed differs")
+	}
+
+	// Opaque grey pixels that are not all the same
+	levels := map[byte]bool{}
+	for i := 0; i < len(a); i += 4 {
+		if a[i] != a[i+1] || a[i] != a[i+2] || a[i+3] != 0xff {
+			t.Fatalf("pixel %d = %v, want opaque grey", i/4, a[i:i+4])
+		}
+		levels[a[i]] = true
+	}
+	if len(levels) < 64 {
+		t.Errorf("noise has %d grey levels, want a spread", len(levels))
+	}
+
+	// Each step draws a new frame from the same source
+	f := newFilmGrain(newRand(7))
+	first := bytes.Clone(f.pix)
+	f.Step()
+	if bytes.Equal(first, f.pix) {
+		t.Error("Step left the noise unchanged")
+	}
+}
+
+func TestReadOddSizes(t *testing.T) {
+	for _, paused := range []bool{false, true} {
+		y := newTestPlayer(t)
+		y.SetPaused(paused)
+		for _, size := range []int{13, 1023, 4096, 6} {
+			p := bytes.Repeat([]byte{0xaa}, size)
+			n, err := y.Read(p)
+			if err != nil {
+				t.Fatalf("paused %v: Read of %d bytes: %v", paused, size, err)
+			}
+			if want := size / 4 * 4; n != want {
+				t.Errorf("paused %v: Read of %d bytes = %d, want %d whole frames' worth", paused, size, n, want)
+			}
+			// Nothing past n was written
+			if n <= size && !bytes.Equal(p[n:], bytes.Repeat([]byte{0xaa}, size-n)) {
+				t.Errorf("paused %v: Read of %d bytes wrote past n = %d", paused, size, n)
+			}
+		}
+
+		// Less than a frame can never make progress
+		for _, size := range []int{1, 3} {
+			if n, err := y.Read(make([]byte, size)); n != 0 || !errors.Is(err, io.ErrShortBuffer) {
+				t.Errorf("paused %v: Read of %d bytes = %d, %v, want 0, io.ErrShortBuffer", paused, size, n, err)
+			}
+		}
+	}
+}
+
+func TestTitleCardFadesOut(t *testing.T) {
+	const display = 4 * time.Second
+	for _, tt := range []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 1},
+		{display - titleFade, 1},
+		{display - titleFade/2, 0.5},
+		{display, 0},
+		{display + time.Hour, 0},
+	} {
+		if got := titleCardAlpha(tt.elapsed, display); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("titleCardAlpha(%v) = %v, want %v", tt.elapsed, got, tt.want)
+		}
+	}
+	if got := titleCardAlpha(0, 0); got != 0 {
+		t.Errorf("titleCardAlpha with no display time = %v, want 0", got)
+	}
+
+	// Driven by the game clock from the first Update
+	cfg := DefaultConfig()
+	cfg.TitleCard = display
+	g := newTestGame(t, cfg)
+	clock := NewManualClock(time.Unix(0, 0))
+	g.SetClock(clock)
+	g.Update()
+	alpha := func() float64 { return titleCardAlpha(clock.Now().Sub(g.titleStart), cfg.TitleCard) }
+	if a := alpha(); a != 1 {
+		t.Errorf("title card alpha at start = %v, want 1", a)
+	}
+	clock.Advance(display)
+	g.Update()
+	if a := alpha(); a != 0 {
+		t.Errorf("title card alpha after %v = %v, want 0", display, a)
+	}
+}
+
+func TestAutoDetectProportionalAdvances(t *testing.T) {
+	// Three 8x8 cells holding ink 3, 6 and 1 columns wide
+	glyphs := []struct {
+		ch       rune
+		col      int
+		from, to int // Inked image columns
+	}{
+		{'A', 0, 0, 2},
+		{'B', 1, 9, 14},
+		{'I', 2, 19, 19},
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 24, 8))
+	fm := NewFontMap(8, 8)
+	for _, gl := range glyphs {
+		for x := gl.from; x <= gl.to; x++ {
+			img.Set(x, 4, color.White)
+		}
+		fm.AddChar(gl.ch, gl.col, 0, 0)
+	}
+	fm.AddBlank(' ', 4)
+	fm.AutoDetect(img)
+
+	for _, gl := range glyphs {
+		// The source rect is the ink alone, inside the glyph's own cell
+		m := fm.chars[gl.ch]
+		if m.x != gl.from || m.x+m.width != gl.to+1 {
+			t.Errorf("%c source columns = [%d, %d), want the ink [%d, %d]", gl.ch, m.x, m.x+m.width, gl.from, gl.to+1)
+		}
+		if got, want := fm.Advance(gl.ch), gl.to-gl.from+1+glyphSpacing; got != want {
+			t.Errorf("Advance(%c) = %d, want %d", gl.ch, got, want)
+		}
+	}
+	if got := fm.Advance(' '); got != 4 {
+		t.Errorf("Advance of the blank space = %d, want its own 4", got)
+	}
+
+	// The scroll lays the text out with the same uneven steps
+	s := NewScrollText("AB IA", ebiten.NewImageFromImage(img), fm, 1, false)
+	s.layout()
+	if want := []int{0, 5, 13, 17, 20, 25}; !slices.Equal(s.prefix, want) {
+		t.Errorf("cursor positions = %v, want %v", s.prefix, want)
+	}
+}
+
+func TestDrawStartsAtFirstVisibleChar(t *testing.T) {
+	glyphs := &recordingGlyphs{}
+	s := NewScrollTextWithRenderer(strings.Repeat("ABCDEFGHIJ", 600), glyphs, 1, false)
+	s.SetViewport(40, 8)
+
+	// Character 5000 starts 40000 pixels in and is cut 4 pixels at the left
+	s.scrollX = -40004
+	if got := s.firstCharAfter(40004); got != 5000 {
+		t.Fatalf("first visible character = %d, want 5000", got)
+	}
+	s.Draw(ebiten.NewImage(40, 8), 0, 1)
+
+	// Only 5000 to 5005 are on screen, the last cut at the right
+	if len(glyphs.draws) != 6 {
+		t.Fatalf("drew %d glyphs, want the 6 visible: %v", len(glyphs.draws), glyphs.draws)
+	}
+	for i, d := range glyphs.draws {
+		if want := (glyphDraw{rune('A' + (5000+i)%10), float64(8*i - 4), 0}); d != want {
+			t.Errorf("draw %d = %v, want %v", i, d, want)
+		}
+	}
+}
+
+func TestPrefixWidths(t *testing.T) {
+	fm := initBigScrollFont()
+	s := NewScrollText("HELLO, WORLD! IT IS A BIG SCROLL", ebiten.NewImage(1, 1), fm, 1, false)
+
+	check := func() {
+		t.Helper()
+		s.layout()
+		runes := []rune(s.text)
+		if len(s.prefix) != len(runes)+1 {
+			t.Fatalf("%d prefix widths for %d characters", len(s.prefix), len(runes))
+		}
+		width := 0
+		for i, ch := range runes {
+			if s.prefix[i] != width {
+				t.Fatalf("prefix[%d] = %d, want the width of %q, %d", i, s.prefix[i], string(runes[:i]), width)
+			}
+			width += fm.Advance(ch)
+		}
+		if s.textWidth() != width {
+			t.Errorf("textWidth = %d, want %d", s.textWidth(), width)
+		}
+
+		// The binary searches agree with a linear scan at every edge
+		for _, edge := range s.prefix {
+			for _, offset := range []float64{float64(edge) - 0.5, float64(edge), float64(edge) + 0.5} {
+				after, from := len(runes), len(runes)
+				for i := len(runes) - 1; i >= 0; i-- {
+					if float64(s.prefix[i+1]) > offset {
+						after = i
+					}
+					if float64(s.prefix[i]) >= offset {
+						from = i
+					}
+				}
+				if got := s.firstCharAfter(offset); got != after {
+					t.Errorf("firstCharAfter(%v) = %d, want %d", offset, got, after)
+				}
+				if got := s.firstCharFrom(offset); got != from {
+					t.Errorf("firstCharFrom(%v) = %d, want %d", offset, got, from)
+				}
+			}
+		}
+	}
+	check()
+
+	// SetText rebuilds the index
+	s.SetText("KVACK")
+	check()
+}
+
+func TestVoicesFollowPlayedPosition(t *testing.T) {
+	y := newTestPlayer(t)
+	states := [3][3]VoiceState{{{Volume: 1}}, {{Volume: 2}}, {{Volume: 3}}}
+	// 441 frames is 10ms
+	y.voices = append(y.voices[:0], voiceSnapshot{441, states[0]}, voiceSnapshot{882, states[1]}, voiceSnapshot{1323, states[2]})
+	for _, tt := range []struct {
+		played time.Duration
+		want   int
+	}{
+		{0, 0},
+		{5 * time.Millisecond, 0},
+		{10 * time.Millisecond, 1},
+		{15 * time.Millisecond, 1},
+		{25 * time.Millisecond, 2},
+		{time.Second, 2}, // Past the output so far: the newest
+	} {
+		if got := y.Voices(tt.played); got != states[tt.want] {
+			t.Errorf("Voices(%v) = %v, want the state ending at %d frames", tt.played, got, 441*(tt.want+1))
+		}
+	}
+
+	// Reading ahead, as the audio buffer does, leaves the state heard at
+	// the start unchanged
+	y = newTestPlayer(t)
+	buf := make([]byte, 1000*4)
+	y.Read(buf)
+	heard := y.Voices(0)
+	for range 200 {
+		y.Read(buf)
+	}
+	if got := y.Voices(0); got != heard {
+		t.Errorf("state heard at the start changed from %v to %v after reading ahead", heard, got)
+	}
+	if len(y.voices) > voiceHistory {
+		t.Errorf("%d states kept, want at most %d", len(y.voices), voiceHistory)
+	}
+	if y.Voices(0) == y.Voices(4*time.Second) {
+		t.Error("the tune's channels are the same at the start and 4s in")
+	}
+}
+
+// readToEnd reads y in 100ms pieces until it returns io.EOF, failing after
+// more than limit reads
+func readToEnd(t *testing.T, y *YMPlayer, limit int) {
+	t.Helper()
+	buf := make([]byte, sampleRate/10*4)
+	for range limit {
+		if _, err := y.Read(buf); err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Fatalf("no io.EOF after %d reads", limit)
+}
+
+func TestMusicEndStopsCleanly(t *testing.T) {
+	y, err := NewYMPlayer(musicData, sampleRate, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer y.Close()
+	ended := 0
+	y.OnEnd(func() { ended++ })
+	y.SetPositionMs(y.LengthMs() - 500)
+	readToEnd(t, y, 20)
+	for range 3 {
+		if n, err := y.Read(make([]byte, 256)); n != 0 || err != io.EOF {
+			t.Errorf("Read after the end = %d, %v, want 0, io.EOF", n, err)
+		}
+	}
+	if ended != 1 {
+		t.Errorf("OnEnd ran %d times, want once", ended)
+	}
+
+	// The game releases the players on its next Update
+	cfg := DefaultConfig()
+	cfg.LoopCount = 0
+	g := newTestGame(t, cfg)
+	if err := g.LoadMusic(musicData); err != nil {
+		t.Fatal(err)
+	}
+	g.ymPlayer.SetPositionMs(g.ymPlayer.LengthMs() - 500)
+	readToEnd(t, g.ymPlayer, 20) // As the audio goroutine would
+	if err := g.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if g.ymPlayer != nil || g.audioPlayer != nil {
+		t.Error("players still held after the music ended")
+	}
+	if g.closing {
+		t.Error("the default end behavior started quitting")
+	}
+}
+
+func TestBeatIndexPulsesOncePerSecond(t *testing.T) {
+	tests := []struct {
+		hz, fps    int // Replay rate and updates per second sampling it
+		seconds    int
+		wantPulses int
+	}{
+		{50, 60, 10, 10},  // Some updates see no new tick
+		{60, 60, 10, 10},  // One tick per update
+		{200, 60, 10, 10}, // Several ticks land in one update
+		{50, 7, 4, 4},     // A coarse stream still pulses once a beat
+		{0, 60, 10, 0},    // No replay rate, no beat
+	}
+	for _, tt := range tests {
+		pulses, last := 0, beatIndex(0, tt.hz)
+		for frame := 0; frame <= tt.fps*tt.seconds; frame++ {
+			ticks := int64(frame * tt.hz / tt.fps)
+			if beat := beatIndex(ticks, tt.hz); beat != last {
+				if beat != last+1 {
+					t.Errorf("%dHz: beat jumped from %d to %d at tick %d", tt.hz, last, beat, ticks)
+				}
+				pulses++
+				last = beat
+			}
+		}
+		if pulses != tt.wantPulses {
+			t.Errorf("%dHz sampled at %d fps: %d pulses in %ds, want %d",
+				tt.hz, tt.fps, pulses, tt.seconds, tt.wantPulses)
+		}
+	}
+}
+
+func TestGameUpdateMovesVerticalScroll(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	s := g.scrollText2
+	before := s.scrollX
+	if err := g.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.scrollX - before; got != 3 {
+		t.Errorf("vertical scroll moved %v pixels in one update, want 3", got)
+	}
+
+	s.scrollX = s.verticalResetBoundary()
+	if err := g.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if s.scrollX != -scrollRestartGap {
+		t.Errorf("scrollX after passing the boundary = %v, want %v", s.scrollX, -scrollRestartGap)
+	}
+}
+
+func TestWaveOffsetsCharacters(t *testing.T) {
+	draw := func(amplitude float64) []glyphDraw {
+		glyphs := &recordingGlyphs{}
+		s := NewScrollTextWithRenderer("ABCD", glyphs, 1, false)
+		s.SetViewport(640, 8)
+		s.scrollX = 0
+		s.SetWave(amplitude, math.Pi/2)
+		s.Draw(ebiten.NewImage(640, 8), 10, 2)
+		return glyphs.draws
+	}
+	for _, d := range draw(0) {
+		if d.y != 10 {
+			t.Errorf("flat %q drawn at y=%v, want 10", d.ch, d.y)
+		}
+	}
+	// Quarter turns between neighbours: sin is 0, 1, 0, -1
+	for i, want := range []float64{10, 16, 10, 4} {
+		if got := draw(3)[i].y; math.Abs(got-want) > 1e-9 {
+			t.Errorf("character %d of a 3 pixel wave at scale 2 drawn at y=%v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestEdgeFadeMask(t *testing.T) {
+	const width, fade = 640, 64
+	mask := edgeFadeMask(width, fade)
+	if got := mask.Bounds(); got != image.Rect(0, 0, width, 1) {
+		t.Fatalf("mask bounds = %v, want %dx1", got, width)
+	}
+	alpha := func(x int) uint8 { return mask.AlphaAt(x, 0).A }
+
+	// Lowest at both edges, symmetric and rising towards the middle
+	if alpha(0) > 4 || alpha(width-1) != alpha(0) {
+		t.Errorf("edge alphas = %d, %d, want equal and near 0", alpha(0), alpha(width-1))
+	}
+	for x := 1; x < fade; x++ {
+		if alpha(x) < alpha(x-1) {
+			t.Errorf("alpha falls from %d to %d at x %d inside the fade", alpha(x-1), alpha(x), x)
+		}
+		if alpha(width-1-x) != alpha(x) {
+			t.Errorf("alpha at %d = %d, at the mirrored %d = %d", x, alpha(x), width-1-x, alpha(width-1-x))
+		}
+	}
+	// Opaque everywhere between the fades
+	for x := fade; x < width-fade; x++ {
+		if alpha(x) != 0xff {
+			t.Fatalf("alpha at %d = %d, want opaque in the middle", x, alpha(x))
+		}
+	}
+
+	// No fade leaves the whole mask opaque
+	for x, a := range edgeFadeMask(16, 0).Pix {
+		if a != 0xff {
+			t.Errorf("alpha at %d without a fade = %d, want 0xff", x, a)
+		}
+	}
+}
+
+func TestMusicPauseKeepsScrolling(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	if err := g.LoadMusic(musicData); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	// step runs a few frames, pulling audio as the audio goroutine would
+	step := func() {
+		t.Helper()
+		for range 10 {
+			if err := g.Update(); err != nil {
+				t.Fatal(err)
+			}
+			g.ymPlayer.Read(buf)
+		}
+	}
+
+	pressKey(g, ebiten.KeyU)
+	if g.audioPlayer.IsPlaying() {
+		t.Error("audio player still playing with the music paused")
+	}
+	pos, scrollX := g.ymPlayer.CurrentTimeMs(), g.scrollText1.scrollX
+	step()
+	if got := g.ymPlayer.CurrentTimeMs(); got != pos {
+		t.Errorf("music position moved from %dms to %dms while paused", pos, got)
+	}
+	if g.scrollText1.scrollX == scrollX {
+		t.Error("the big scroll stopped with the music")
+	}
+
+	pressKey(g, ebiten.KeyU)
+	step()
+	if got := g.ymPlayer.CurrentTimeMs(); got <= pos {
+		t.Errorf("music position stayed at %dms after resuming", got)
+	}
+}
+
+func TestTrackingWidensAdvance(t *testing.T) {
+	_, fm := testFont()
+	fm.AddChar('!', 0, 2, 6)
+	fm.SetTracking(-2)
+	for _, tt := range []struct {
+		ch   rune
+		want int
+	}{
+		{'A', 6},
+		{'!', 4},
+		{' ', 6}, // Spaces are tracked too
+		{'~', 6}, // Unmapped characters take a blank cell
+	} {
+		if got := fm.Advance(tt.ch); got != tt.want {
+			t.Errorf("Advance(%q) with tracking -2 = %d, want %d", tt.ch, got, tt.want)
+		}
+	}
+}
+
+func TestLoadFontMapRejectsBadEntries(t *testing.T) {
+	const header = `{"charWidth": 8, "charHeight": 8, "imageWidth": 16, "imageHeight": 8, "chars": [`
+	fm, err := LoadFontMap([]byte(header + `{"char": "A"}, {"char": "B", "col": 1, "width": 5}, {"char": " ", "blank": true, "width": 4}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fm.chars['B']; got.x != 8 || got.width != 5 {
+		t.Errorf("B maps to x=%d width %d, want x=8 width 5", got.x, got.width)
+	}
+	if !fm.chars[' '].blank || fm.Advance(' ') != 4 {
+		t.Errorf("space = %+v, want a blank 4 pixels wide", fm.chars[' '])
+	}
+
+	for _, tt := range []struct {
+		name, chars, want string
+	}{
+		{"outside the grid", `{"char": "A", "col": 2}`, `"A" at col 2`},
+		{"past the image edge", `{"char": "A", "col": 1, "width": 9}`, `"A" is 9 wide`},
+		{"duplicate", `{"char": "A"}, {"char": "A", "col": 1}`, `"A" is mapped twice`},
+		{"several characters", `{"char": "AB"}`, `"AB" must be a single character`},
+		{"negative width", `{"char": "A", "width": -1}`, `negative width`},
+	} {
+		_, err := LoadFontMap([]byte(header + tt.chars + `]}`))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want one containing %s", tt.name, err, tt.want)
+		}
+	}
+
+	// The embedded tables are valid
+	for name, data := range map[string][]byte{"bsfont": bsFontMapData, "upfonts": upFontMapData, "lfont": lFontMapData} {
+		if _, err := LoadFontMap(data); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestCaseSensitiveMixedCase(t *testing.T) {
+	fm := NewFontMap(8, 8)
+	fm.AddChar('A', 0, 0, 0)
+	fm.AddChar('B', 1, 0, 0)
+	fm.AddChar('a', 2, 0, 5) // A narrower lowercase glyph
+	const text = "aAbB"
+
+	for _, tt := range []struct {
+		caseSensitive bool
+		drawn         string // Runes whose glyphs are drawn
+		prefix        []int
+	}{
+		{false, "AABB", []int{0, 8, 16, 24, 32}},
+		{true, "aABB", []int{0, 5, 13, 21, 29}}, // b has no glyph of its own
+	} {
+		fm.SetCaseSensitive(tt.caseSensitive)
+		var drawn []rune
+		for _, ch := range text {
+			r, _, ok := fm.lookup(ch)
+			if !ok {
+				t.Fatalf("caseSensitive %v: %q not found", tt.caseSensitive, ch)
+			}
+			drawn = append(drawn, r)
+		}
+		if string(drawn) != tt.drawn {
+			t.Errorf("caseSensitive %v: %q drawn as %q, want %q", tt.caseSensitive, text, string(drawn), tt.drawn)
+		}
+
+		// Layout goes through the same lookup, so advances match the glyphs
+		s := NewScrollText(text, ebiten.NewImage(24, 8), fm, 1, false)
+		s.layout()
+		if !slices.Equal(s.prefix, tt.prefix) {
+			t.Errorf("caseSensitive %v: cursor positions = %v, want %v", tt.caseSensitive, s.prefix, tt.prefix)
+		}
+	}
+}
+
+// fontGlyphs draws through a real font map but records which glyph lands
+// where instead of drawing
+type fontGlyphs struct {
+	*bitmapGlyphs
+	draws []glyphDraw
+}
+
+func (f *fontGlyphs) DrawGlyph(dst *ebiten.Image, ch rune, x, y, scale float64, clr ebiten.ColorScale) {
+	if r, _, ok := f.fontMap.lookup(ch); ok {
+		f.draws = append(f.draws, glyphDraw{r, x, y})
+	}
+}
+
+func TestMissingGlyphAdvancesConsistently(t *testing.T) {
+	img, fm := testFont()
+	fm.AddChar('?', 6, 2, 6)
+	const text = "AÉ😀B"
+
+	for _, tt := range []struct {
+		missing rune
+		prefix  []int
+		draws   []glyphDraw
+	}{
+		// Stand-ins advance by the placeholder's own width
+		{'?', []int{0, 8, 14, 20, 28}, []glyphDraw{{'A', 0, 0}, {'?', 8, 0}, {'?', 14, 0}, {'B', 20, 0}}},
+		// Without one they leave blank cells
+		{0, []int{0, 8, 16, 24, 32}, []glyphDraw{{'A', 0, 0}, {'B', 24, 0}}},
+	} {
+		fm.SetMissingGlyph(tt.missing)
+		glyphs := &fontGlyphs{bitmapGlyphs: &bitmapGlyphs{img: img, fontMap: fm}}
+		s := NewScrollTextWithRenderer(text, glyphs, 1, false)
+		s.SetViewport(640, 8)
+		s.layout()
+		if !slices.Equal(s.prefix, tt.prefix) {
+			t.Errorf("missing glyph %q: layout positions = %v, want %v", tt.missing, s.prefix, tt.prefix)
+		}
+		s.Draw(ebiten.NewImage(640, 8), 0, 1)
+		if !slices.Equal(glyphs.draws, tt.draws) {
+			t.Errorf("missing glyph %q: draws = %v, want %v", tt.missing, glyphs.draws, tt.draws)
+		}
+
+		// Vertical text gives each of them a line too
+		v := NewScrollTextWithRenderer(text, glyphs, 1, true)
+		if got, want := v.contentHeight(), 4*v.verticalStride(1); got != want {
+			t.Errorf("missing glyph %q: vertical height = %v, want 4 lines, %v", tt.missing, got, want)
+		}
+	}
+}
+
+func TestScrollTintCycles(t *testing.T) {
+	for _, tt := range []struct {
+		hue  float64
+		want color.RGBA
+	}{
+		{0, color.RGBA{0xff, 0, 0, 0xff}},
+		{120, color.RGBA{0, 0xff, 0, 0xff}},
+		{240, color.RGBA{0, 0, 0xff, 0xff}},
+		{-60, color.RGBA{0xff, 0, 0xff, 0xff}}, // Wraps around the wheel
+	} {
+		if got := hsvColor(tt.hue, 1, 1); got != tt.want {
+			t.Errorf("hsvColor(%v, 1, 1) = %v, want %v", tt.hue, got, tt.want)
+		}
+	}
+
+	s := NewScrollTextWithRenderer("AB", &recordingGlyphs{}, 1, false)
+	if s.tintScale() != (ebiten.ColorScale{}) {
+		t.Error("glyphs tinted with color cycling off")
+	}
+	s.SetTint(true, 120)
+	s.Update()
+	if s.tint != hsvColor(120, 1, 1) {
+		t.Errorf("tint after one 120 degree step = %v, want green", s.tint)
+	}
+	var green ebiten.ColorScale
+	green.ScaleWithColor(hsvColor(120, 1, 1))
+	if s.tintScale() != green {
+		t.Errorf("tint scale = %v, want %v", s.tintScale(), green)
+	}
+}
+
+func TestStatsOverlayToggles(t *testing.T) {
+	g := newTestGame(t, DefaultConfig())
+	pressKey(g, ebiten.KeyF1)
+	if !g.showStats || !strings.HasPrefix(g.statsText, "FPS: ") {
+		t.Fatalf("after F1 showStats = %v, text %q, want the readout on", g.showStats, g.statsText)
+	}
+	for _, r := range g.statsText {
+		if r != ' ' && !g.lFontMap.Has(r) {
+			t.Errorf("readout %q uses %q, which the small font lacks", g.statsText, r)
+		}
+	}
+
+	pressKey(g, ebiten.KeyF1)
+	if g.showStats {
+		t.Error("F1 again left the readout on")
+	}
+}